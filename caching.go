@@ -0,0 +1,303 @@
+package sus
+
+import(
+	`sort`
+	`sync`
+	`container/list`
+)
+
+// Hit/miss statistics for a caching store.
+type CacheStats struct{
+	Hits		uint64
+	Misses		uint64
+	Evictions	uint64
+}
+
+// A store that keeps a bounded LRU cache of serialized entities in front of another store.
+type CachingStore interface{
+	Store
+	// Runs transactions on the inner store, failing if it is not a Transactor.
+	Transactor
+	Stats() CacheStats
+}
+
+// Creates and configures a store that caches up to capacity entities from inner as []byte data,
+// populated on reads and refreshed on successful creates and updates, and invalidated on deletes
+// and on any failed update so that a stale cached version is never handed out twice.
+func NewCachingStore(inner Store, capacity int, m Marshaler, un Unmarshaler, vf VersionFactory) CachingStore {
+	return NewCachingStoreWithOptions(inner, capacity, m, un, vf, ByteStoreOptions{})
+}
+
+// Creates and configures a caching store as NewCachingStore does, decoding cached envelopes with the codecs and types
+// in opts.Registry, which should be the one inner decodes them with.
+func NewCachingStoreWithOptions(inner Store, capacity int, m Marshaler, un Unmarshaler, vf VersionFactory, opts ByteStoreOptions) CachingStore {
+	return &cachingStore{
+		inner: inner,
+		capacity: capacity,
+		marshaler: m,
+		unmarshaler: un,
+		versionFactory: vf,
+		registry: opts.Registry,
+		entries: map[string]*list.Element{},
+		lru: list.New(),
+		idLocks: map[string]*idLock{},
+	}
+}
+
+type cacheEntry struct{
+	id	string
+	d	[]byte
+}
+
+type cachingStore struct{
+	inner			Store
+	capacity		int
+	marshaler		Marshaler
+	unmarshaler		Unmarshaler
+	versionFactory	VersionFactory
+	registry		*Registry
+	mtx				sync.Mutex
+	entries			map[string]*list.Element
+	lru				*list.List
+	generation		uint64
+	stats			CacheStats
+	// held by writers from before their inner write until the cache reflects it, so writes to an id reach the cache in
+	// the order they reached the inner store.
+	idLocksMtx		sync.Mutex
+	idLocks			map[string]*idLock
+}
+
+type idLock struct{
+	mtx		sync.Mutex
+	refs	int
+}
+
+// Returns a copy of the current hit/miss statistics.
+func (s *cachingStore) Stats() CacheStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.stats
+}
+
+// Creates a new versioned entity.
+func (s *cachingStore) Create() (id string, v Version, err error) {
+	ids, vs, err := s.CreateMulti(1)
+	if len(ids) == 1 && len(vs) == 1 {
+		id = ids[0]
+		v = vs[0]
+	}
+	return
+}
+
+// Creates a set of new versioned entities.
+func (s *cachingStore) CreateMulti(count uint) (ids []string, vs []Version, err error) {
+	ids, vs, err = s.inner.CreateMulti(count)
+	if err == nil {
+		s.store(ids, vs)
+	}
+	return
+}
+
+// Fetches the versioned entity with id.
+func (s *cachingStore) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the versioned entities with id's, only going to the inner store for those not in the cache.
+func (s *cachingStore) ReadMulti(ids []string) (vs []Version, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	count := len(ids)
+	vs = make([]Version, count, count)
+	missIds := make([]string, 0, count)
+	missIdxs := make([]int, 0, count)
+	s.mtx.Lock()
+	gen := s.generation
+	for i, id := range ids {
+		if e, exists := s.entries[id]; exists {
+			s.lru.MoveToFront(e)
+			v := newRecordVersion(s.registry, s.versionFactory, e.Value.(*cacheEntry).d)
+			if err = unmarshalRecord(s.registry, s.unmarshaler, e.Value.(*cacheEntry).d, v); err != nil {
+				s.mtx.Unlock()
+				return nil, err
+			}
+			vs[i] = v
+			s.stats.Hits++
+		} else {
+			missIds = append(missIds, id)
+			missIdxs = append(missIdxs, i)
+			s.stats.Misses++
+		}
+	}
+	s.mtx.Unlock()
+	if len(missIds) == 0 {
+		return
+	}
+	missVs, err := s.inner.ReadMulti(missIds)
+	if err != nil {
+		return nil, err
+	}
+	for i, idx := range missIdxs {
+		vs[idx] = missVs[i]
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if gen == s.generation {
+		// no write has gone through this store since the inner read began so the fetched data can not be stale.
+		s.storeLocked(missIds, missVs)
+	}
+	return
+}
+
+// Updates the versioned entity with id.
+func (s *cachingStore) Update(id string, v Version) error {
+	return s.UpdateMulti([]string{id}, []Version{v})
+}
+
+// Updates the versioned entities with id's, refreshing the cache on success and invalidating it on failure.
+func (s *cachingStore) UpdateMulti(ids []string, vs []Version) (err error) {
+	defer s.lockIds(ids)()
+	s.invalidate(ids)
+	if err = s.inner.UpdateMulti(ids, vs); err == nil {
+		s.store(ids, vs)
+	}
+	return
+}
+
+// Deletes the versioned entity with id.
+func (s *cachingStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+// Deletes the versioned entities with id's.
+func (s *cachingStore) DeleteMulti(ids []string) error {
+	defer s.lockIds(ids)()
+	s.invalidate(ids)
+	err := s.inner.DeleteMulti(ids)
+	s.invalidate(ids)
+	return err
+}
+
+// Runs fn as an interactive transaction on the inner store, which must be a Transactor, invalidating every entity it
+// writes.
+func (s *cachingStore) Transact(fn func(tx Tx) error) error {
+	inner, ok := s.inner.(Transactor)
+	if !ok {
+		return &notTransactorError{}
+	}
+	written := []string{}
+	err := inner.Transact(func(tx Tx) error {
+		return fn(&cachingTx{tx, s, &written})
+	})
+	s.invalidate(written)
+	return err
+}
+
+// Locks each of ids against other writers, in sorted order so writers of overlapping ids can not deadlock, returning a
+// function that unlocks them.
+func (s *cachingStore) lockIds(ids []string) func() {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	locked := make([]string, 0, len(sorted))
+	locks := make([]*idLock, 0, len(sorted))
+	s.idLocksMtx.Lock()
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		locked = append(locked, id)
+		l, exists := s.idLocks[id]
+		if !exists {
+			l = &idLock{}
+			s.idLocks[id] = l
+		}
+		l.refs++
+		locks = append(locks, l)
+	}
+	s.idLocksMtx.Unlock()
+	for _, l := range locks {
+		l.mtx.Lock()
+	}
+	return func() {
+		s.idLocksMtx.Lock()
+		defer s.idLocksMtx.Unlock()
+		for i, l := range locks {
+			l.mtx.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(s.idLocks, locked[i])
+			}
+		}
+	}
+}
+
+func (s *cachingStore) store(ids []string, vs []Version) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.generation++
+	s.storeLocked(ids, vs)
+}
+
+func (s *cachingStore) storeLocked(ids []string, vs []Version) {
+	if s.capacity <= 0 {
+		return
+	}
+	for i, id := range ids {
+		d, err := s.marshaler(vs[i])
+		if err != nil {
+			s.removeLocked(id)
+			continue
+		}
+		if e, exists := s.entries[id]; exists {
+			e.Value.(*cacheEntry).d = d
+			s.lru.MoveToFront(e)
+			continue
+		}
+		s.entries[id] = s.lru.PushFront(&cacheEntry{id, d})
+		for s.lru.Len() > s.capacity {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.entries, oldest.Value.(*cacheEntry).id)
+			s.stats.Evictions++
+		}
+	}
+}
+
+func (s *cachingStore) invalidate(ids []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.generation++
+	for _, id := range ids {
+		s.removeLocked(id)
+	}
+}
+
+func (s *cachingStore) removeLocked(id string) {
+	if e, exists := s.entries[id]; exists {
+		s.lru.Remove(e)
+		delete(s.entries, id)
+	}
+}
+
+// Invalidates each entity as the transaction writes it so no read can cache a version the transaction is replacing.
+type cachingTx struct{
+	Tx
+	store	*cachingStore
+	written	*[]string
+}
+
+func (t *cachingTx) Update(id string, v Version) error {
+	t.store.invalidate([]string{id})
+	*t.written = append(*t.written, id)
+	return t.Tx.Update(id, v)
+}
+
+func (t *cachingTx) Delete(id string) error {
+	t.store.invalidate([]string{id})
+	*t.written = append(*t.written, id)
+	return t.Tx.Delete(id)
+}
@@ -0,0 +1,234 @@
+package sus
+
+import(
+	`fmt`
+	`sync`
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_CachingStore_Read_hits_and_misses(t *testing.T){
+	_, cs := newFooCachingStore(10)
+	id, f1, _ := cs.Create()
+
+	f2, err := cs.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, f1, f2, `f2 should equal f1`)
+	assert.True(t, f1 != f2, `f2 should be a fresh copy of f1`)
+	assert.Equal(t, CacheStats{Hits: 1}, cs.Stats(), `stats should show one hit`)
+
+	_, err = cs.Read(`a_fake_id`)
+
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, cs.Stats(), `stats should show one hit and one miss`)
+}
+
+func Test_CachingStore_ReadMulti_with_zero_count(t *testing.T){
+	_, cs := newFooCachingStore(10)
+
+	vs, err := cs.ReadMulti([]string{})
+
+	assert.Nil(t, vs, `vs should be nil`)
+	assert.Nil(t, err, `err should be nil`)
+}
+
+func Test_CachingStore_ReadMulti_populates_cache(t *testing.T){
+	inner, cs := newFooCachingStore(10)
+	id, _, _ := inner.Create()
+
+	_, err1 := cs.Read(id)
+	_, err2 := cs.Read(id)
+
+	assert.Nil(t, err1, `err1 should be nil`)
+	assert.Nil(t, err2, `err2 should be nil`)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, cs.Stats(), `stats should show one hit and one miss`)
+}
+
+func Test_CachingStore_evicts_least_recently_used(t *testing.T){
+	_, cs := newFooCachingStore(2)
+	ids, _, _ := cs.CreateMulti(3)
+
+	cs.Read(ids[1])
+	cs.Read(ids[2])
+	cs.Read(ids[0])
+
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Evictions: 2}, cs.Stats(), `ids[0] should have been evicted`)
+}
+
+func Test_CachingStore_Update_refreshes_cache(t *testing.T){
+	_, cs := newFooCachingStore(10)
+	id, f, _ := cs.Create()
+
+	err := cs.Update(id, f)
+	v, _ := cs.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `cached version should be 1`)
+	assert.Equal(t, CacheStats{Hits: 1}, cs.Stats(), `stats should show one hit`)
+}
+
+func Test_CachingStore_stale_entry_is_invalidated_on_nonsequential_update(t *testing.T){
+	inner, cs := newFooCachingStore(10)
+	id, _, _ := cs.Create()
+	f, _ := inner.Read(id)
+	inner.Update(id, f)
+
+	stale, _ := cs.Read(id)
+	err := cs.Update(id, stale)
+	fresh, _ := cs.Read(id)
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, 1, fresh.GetVersion(), `fresh should have been reread from the inner store`)
+	assert.Nil(t, cs.Update(id, fresh), `update with fresh should succeed`)
+}
+
+func Test_CachingStore_concurrent_updates_keep_cache_current(t *testing.T){
+	inner := &pausingStore{Store: NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)}
+	cs := NewCachingStore(inner, 10, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+	id, f, _ := cs.Create()
+	updated := make(chan struct{})
+	inner.updated = updated
+	inner.resume = make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	// the first writer pauses between its inner write and refreshing the cache.
+	go func() {
+		defer wg.Done()
+		cs.Update(id, f)
+	}()
+	<-updated
+	go func() {
+		defer wg.Done()
+		v, _ := inner.Store.Read(id)
+		cs.Update(id, v)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(inner.resume)
+	wg.Wait()
+	cached, _ := cs.Read(id)
+	stored, _ := inner.Read(id)
+	cachedVersion := cached.GetVersion()
+	err := cs.Update(id, cached)
+
+	assert.Equal(t, 2, stored.GetVersion(), `both updates should have reached the inner store`)
+	assert.Equal(t, stored.GetVersion(), cachedVersion, `the cache should hold the inner store's version`)
+	assert.Nil(t, err, `an update with the cached version should succeed`)
+}
+
+func Test_CachingStore_Delete_invalidates_cache(t *testing.T){
+	_, cs := newFooCachingStore(10)
+	id, _, _ := cs.Create()
+
+	err := cs.Delete(id)
+	v, readErr := cs.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, v, `v should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+id+`" does not exist`, readErr.Error(), `readErr should contain expected msg`)
+}
+
+func Test_CachingStore_with_zero_capacity(t *testing.T){
+	_, cs := newFooCachingStore(0)
+	id, _, _ := cs.Create()
+
+	cs.Read(id)
+	cs.Read(id)
+
+	assert.Equal(t, CacheStats{Misses: 2}, cs.Stats(), `nothing should be cached`)
+}
+
+func Test_CachingStore_with_unmarshaler_error(t *testing.T){
+	inner := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	cs := NewCachingStore(inner, 10, JsonMarshaler, errorUnmarshaler, fooVersionFactory)
+	id, _, _ := cs.Create()
+
+	v, err := cs.Read(id)
+
+	assert.Nil(t, v, `v should be nil`)
+	assert.Equal(t, unmarshalerErr, err, `err should be unmarshalerErr`)
+}
+
+func Test_CachingStore_Transact_invalidates_written_entities(t *testing.T){
+	_, cs := newFooCachingStore(10)
+	ids, _, _ := cs.CreateMulti(2)
+
+	err := cs.Transact(func(tx Tx) error {
+		v, _ := tx.Read(ids[0])
+		tx.Update(ids[0], v)
+		return tx.Delete(ids[1])
+	})
+	v, _ := cs.Read(ids[0])
+	_, deletedErr := cs.Read(ids[1])
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `the cache should not serve the old version`)
+	assert.NotNil(t, deletedErr, `the cache should not serve the deleted entity`)
+}
+
+func Test_CachingStore_Transact_needs_a_transactor(t *testing.T){
+	_, qs := newFooQuorumStore()
+	cs := NewCachingStore(qs, 10, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+
+	err := cs.Transact(func(tx Tx) error { return nil })
+
+	assert.Equal(t, `store does not support transactions`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_CachingStore_reads_registered_types_on_hits_and_misses(t *testing.T){
+	reg := newShapeRegistry()
+	m := NewTypedMarshaler(reg, `json`)
+	inner := NewMemoryStoreWithOptions(m, JsonUnmarshaler, newFooIdFactory(), circleVersionFactory, fooEntityInitializer, ByteStoreOptions{reg})
+	ids, vs, _ := inner.CreateMulti(2)
+	inner.UpdateMulti(ids, []Version{vs[0], &square{Side: 2}})
+	cs := NewCachingStoreWithOptions(inner, 10, m, JsonUnmarshaler, circleVersionFactory, ByteStoreOptions{reg})
+
+	missed, missErr := cs.ReadMulti(ids)
+	hit, hitErr := cs.ReadMulti(ids)
+
+	assert.Nil(t, missErr, `missErr should be nil`)
+	assert.Nil(t, hitErr, `hitErr should be nil`)
+	assert.Equal(t, []Version{&circle{1, 0}, &square{1, 2}}, missed, `misses should read each entity as its own type`)
+	assert.Equal(t, missed, hit, `hits should read each entity as its own type too`)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2}, cs.Stats(), `the second read should have been served from the cache`)
+}
+
+// A store whose next UpdateMulti, once updated is set, signals it and then waits for resume after writing.
+type pausingStore struct{
+	Store
+	updated	chan struct{}
+	resume	chan struct{}
+}
+
+func (s *pausingStore) UpdateMulti(ids []string, vs []Version) error {
+	err := s.Store.UpdateMulti(ids, vs)
+	if updated := s.updated; updated != nil {
+		s.updated = nil
+		close(updated)
+		<-s.resume
+	}
+	return err
+}
+
+func newFooCachingStore(capacity int) (Store, CachingStore) {
+	inner := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	return inner, NewCachingStore(inner, capacity, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+}
+
+func newFooIdFactory() IdFactory {
+	idSrc := 0
+	return func() string {
+		idSrc++
+		return fmt.Sprintf(`%d`, idSrc)
+	}
+}
+
+func fooVersionFactory() Version {
+	return &foo{}
+}
+
+func fooEntityInitializer(v Version) Version {
+	return v
+}
@@ -0,0 +1,62 @@
+package sus
+
+import(
+	`bytes`
+	`hash/crc32`
+	`encoding/binary`
+)
+
+const(
+	checksummedMagic	= "\x00SUC"
+	checksumLen			= 4
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Wraps bg and bp so every record is stored with a CRC-32C checksum of its data, checked whenever it is read back.
+// Records that fail the check, or are too short to hold one, are reported with a *CorruptionError. Records written
+// without a checksum are still read as they are.
+func NewChecksummedByteFuncs(bg ByteGetter, bp BytePutter) (ByteGetter, BytePutter) {
+	get := func(id string) ([]byte, error) {
+		d, err := bg(id)
+		if err != nil {
+			return nil, err
+		}
+		return verifyChecksum(id, d)
+	}
+	put := func(id string, d []byte) error {
+		b := make([]byte, len(checksummedMagic)+checksumLen, len(checksummedMagic)+checksumLen+len(d))
+		copy(b, checksummedMagic)
+		binary.BigEndian.PutUint32(b[len(checksummedMagic):], crc32.Checksum(d, castagnoliTable))
+		return bp(id, append(b, d...))
+	}
+	return get, put
+}
+
+// Returns the data in the checksummed record d of the entity with id.
+func verifyChecksum(id string, d []byte) ([]byte, error) {
+	if !bytes.HasPrefix(d, []byte(checksummedMagic)) {
+		if bytes.HasPrefix([]byte(checksummedMagic), d) {
+			// an empty record, or one cut off part way through the magic bytes.
+			return nil, &CorruptionError{id, `record is truncated`}
+		}
+		return d, nil
+	}
+	if len(d) < len(checksummedMagic)+checksumLen {
+		return nil, &CorruptionError{id, `record is truncated`}
+	}
+	sum := binary.BigEndian.Uint32(d[len(checksummedMagic):])
+	d = d[len(checksummedMagic)+checksumLen:]
+	if crc32.Checksum(d, castagnoliTable) != sum {
+		return nil, &CorruptionError{id, `checksum mismatch`}
+	}
+	return d, nil
+}
+
+// Returned when the stored record of an entity has been damaged.
+type CorruptionError struct{
+	Id		string
+	Reason	string
+}
+
+func (e *CorruptionError) Error() string { return `entity with id "`+e.Id+`" is corrupt: `+e.Reason }
@@ -0,0 +1,52 @@
+package sus
+
+import(
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_NewChecksummedByteFuncs(t *testing.T){
+	rawGet, rawPut, _ := memoryByteFuncs()
+	get, put := NewChecksummedByteFuncs(rawGet, rawPut)
+	put(`a`, []byte(`data`))
+	put(`empty`, []byte{})
+	rawPut(`legacy`, []byte(`legacy data`))
+
+	d, err := get(`a`)
+	emptyD, emptyErr := get(`empty`)
+	legacyD, legacyErr := get(`legacy`)
+	_, missingErr := get(`missing`)
+	stored, _ := rawGet(`a`)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, []byte(`data`), d, `d should be the data put`)
+	assert.Nil(t, emptyErr, `emptyErr should be nil`)
+	assert.Equal(t, []byte{}, emptyD, `emptyD should be empty`)
+	assert.Nil(t, legacyErr, `records without checksums should be read as they are`)
+	assert.Equal(t, []byte(`legacy data`), legacyD, `legacyD should be the raw data`)
+	assert.Equal(t, localEntityDoesNotExistError{`missing`}, missingErr, `missingErr should be passed through`)
+	assert.Equal(t, len(`data`)+len(checksummedMagic)+checksumLen, len(stored), `stored should hold the magic and checksum`)
+}
+
+func Test_NewChecksummedByteFuncs_detects_corruption(t *testing.T){
+	rawGet, rawPut, _ := memoryByteFuncs()
+	get, put := NewChecksummedByteFuncs(rawGet, rawPut)
+	put(`a`, []byte(`data`))
+	stored, _ := rawGet(`a`)
+	flipped := append([]byte{}, stored...)
+	flipped[len(flipped)-1] ^= 1
+	rawPut(`flipped`, flipped)
+	rawPut(`truncated`, stored[:len(checksummedMagic)+2])
+	rawPut(`truncatedMagic`, stored[:2])
+	rawPut(`empty`, []byte{})
+
+	_, flippedErr := get(`flipped`)
+	_, truncatedErr := get(`truncated`)
+	_, truncatedMagicErr := get(`truncatedMagic`)
+	_, emptyErr := get(`empty`)
+
+	assert.Equal(t, &CorruptionError{`flipped`, `checksum mismatch`}, flippedErr, `flippedErr should be a *CorruptionError`)
+	assert.Equal(t, `entity with id "truncated" is corrupt: record is truncated`, truncatedErr.Error(), `truncatedErr should contain expected msg`)
+	assert.Equal(t, `entity with id "truncatedMagic" is corrupt: record is truncated`, truncatedMagicErr.Error(), `truncatedMagicErr should contain expected msg`)
+	assert.Equal(t, `entity with id "empty" is corrupt: record is truncated`, emptyErr.Error(), `emptyErr should contain expected msg`)
+}
@@ -0,0 +1,104 @@
+/*
+Command susfsck checks a sus file store for damaged records, entities with impossible versions and files left behind
+by interrupted writes, printing a json report. It exits with 0 if the store is sound, 1 if problems remain and 2 if
+the store could not be checked.
+
+	susfsck [flags] storeDir
+
+Records are decoded as json objects holding the entity's version in the field named by -version-field, or with
+-decode=none only checksums and envelopes are checked. With -repair corrupt files are quarantined and orphaned temp
+files deleted. Without it the store is left exactly as it was, its lock file is not created if it does not exist.
+*/
+package main
+
+import(
+	`io`
+	`os`
+	`fmt`
+	`flag`
+	`encoding/json`
+	`github.com/0xor1/sus`
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet(`susfsck`, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	ext := flags.String(`ext`, `json`, `the file extension of the store's entity files`)
+	fanOut := flags.Int(`fan-out`, 0, `the store's FanOutLevels`)
+	encodeIds := flags.Bool(`encode-ids`, false, `whether the store uses EncodeIds`)
+	decode := flags.String(`decode`, `json`, `how to decode records, json or none`)
+	versionField := flags.String(`version-field`, `version`, `the json field holding each entity's version`)
+	repair := flags.Bool(`repair`, false, `quarantine corrupt files and delete orphaned temp files`)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, `usage: susfsck [flags] storeDir`)
+		return 2
+	}
+
+	var un sus.Unmarshaler
+	switch *decode {
+	case `json`:
+		un = sus.JsonUnmarshaler
+	case `none`:
+		un = func(data []byte, dst sus.Version) error { return nil }
+	default:
+		fmt.Fprintln(stderr, `unknown -decode `+*decode)
+		return 2
+	}
+	vf := func() sus.Version {
+		return &entity{field: *versionField}
+	}
+
+	opts := sus.FileStoreOptions{FanOutLevels: *fanOut, EncodeIds: *encodeIds}
+	report, err := sus.VerifyFileStore(flags.Arg(0), *ext, un, vf, opts, *repair)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	d, err := report.Json()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	fmt.Fprintln(stdout, string(d))
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// Any json object with a numeric version field.
+type entity struct{
+	field	string
+	version	int
+}
+
+func (e *entity) GetVersion() int {
+	return e.version
+}
+
+func (e *entity) IncrementVersion() {
+	e.version++
+}
+
+func (e *entity) DecrementVersion() {
+	e.version--
+}
+
+func (e *entity) UnmarshalJSON(d []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(d, &fields); err != nil {
+		return err
+	}
+	version, exists := fields[e.field]
+	if !exists {
+		return fmt.Errorf(`no %q field`, e.field)
+	}
+	return json.Unmarshal(version, &e.version)
+}
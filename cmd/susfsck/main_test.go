@@ -0,0 +1,88 @@
+package main
+
+import(
+	`os`
+	`bytes`
+	`strings`
+	`io/ioutil`
+	`path/filepath`
+	`encoding/json`
+	`testing`
+	`github.com/0xor1/sus`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_run(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `susfsck`)
+	defer os.RemoveAll(dir)
+	vf := func() sus.Version { return &stored{} }
+	n := 0
+	idf := func() string { n++; return string(rune('a' + n)) }
+	s, _ := sus.NewJsonFileStore(dir, idf, vf, func(v sus.Version) sus.Version { return v })
+	s.CreateMulti(2)
+	ioutil.WriteFile(filepath.Join(dir, `.tmp.orphan.json`), nil, 0600)
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run([]string{dir}, stdout, stderr)
+	report := &sus.VerifyReport{}
+	json.Unmarshal(stdout.Bytes(), report)
+	repairCode := run([]string{`-repair`, dir}, &bytes.Buffer{}, &bytes.Buffer{})
+	soundCode := run([]string{`-decode=none`, dir}, &bytes.Buffer{}, &bytes.Buffer{})
+
+	assert.Equal(t, 1, code, `code should be 1 as there is an orphan temp file`)
+	assert.Equal(t, 2, report.Checked, `both entities should have been checked`)
+	assert.Equal(t, sus.OrphanTempFile, report.Problems[0].Kind, `the orphan temp file should be reported`)
+	assert.Equal(t, 0, repairCode, `repairing should fix every problem`)
+	assert.Equal(t, 0, soundCode, `the repaired store should be sound`)
+}
+
+func Test_run_without_repair_does_not_create_the_lock(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `susfsck`)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, `a.json`), []byte(`{"version":0}`), 0600)
+
+	code := run([]string{dir}, &bytes.Buffer{}, &bytes.Buffer{})
+	_, lockErr := os.Stat(filepath.Join(dir, `.lock`))
+
+	assert.Equal(t, 0, code, `code should be 0 as the store is sound`)
+	assert.True(t, os.IsNotExist(lockErr), `a read only check should not create the store's lock`)
+}
+
+func Test_run_errors(t *testing.T){
+	stderr := &bytes.Buffer{}
+
+	usageCode := run([]string{}, &bytes.Buffer{}, stderr)
+	decodeCode := run([]string{`-decode=xml`, `dir`}, &bytes.Buffer{}, stderr)
+
+	assert.Equal(t, 2, usageCode, `usageCode should be 2`)
+	assert.Equal(t, 2, decodeCode, `decodeCode should be 2`)
+	assert.True(t, strings.Contains(stderr.String(), `usage: susfsck [flags] storeDir`), `the usage should be printed`)
+	assert.True(t, strings.Contains(stderr.String(), `unknown -decode xml`), `the bad flag should be reported`)
+}
+
+func Test_entity_UnmarshalJSON(t *testing.T){
+	e := &entity{field: `v`}
+
+	err := json.Unmarshal([]byte(`{"v":4}`), e)
+	missingErr := json.Unmarshal([]byte(`{"version":4}`), &entity{field: `v`})
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 4, e.GetVersion(), `e's version should be 4`)
+	assert.Equal(t, `no "v" field`, missingErr.Error(), `missingErr should contain expected msg`)
+}
+
+type stored struct{
+	Version	int	`json:"version"`
+}
+
+func (s *stored) GetVersion() int {
+	return s.Version
+}
+
+func (s *stored) IncrementVersion() {
+	s.Version++
+}
+
+func (s *stored) DecrementVersion() {
+	s.Version--
+}
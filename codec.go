@@ -0,0 +1,308 @@
+package sus
+
+import(
+	`bytes`
+	`sort`
+	`math`
+	`reflect`
+	`encoding`
+	`encoding/gob`
+	`encoding/xml`
+	`encoding/json`
+	`encoding/binary`
+)
+
+var(
+	binaryMarshalerType		= reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType	= reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// Options for the codec decorators' WithOptions constructors, zero values are replaced with defaults.
+type CodecOptions struct{
+	// Where the codecs named by enveloped records inside decorated ones are looked up. Defaults to the built in codecs,
+	// see NewRegistry.
+	Registry	*Registry
+}
+
+// Converts src to json []byte data.
+func JsonMarshaler(src Version) ([]byte, error) {
+	return json.Marshal(src)
+}
+
+// Populates dst from json []byte data.
+func JsonUnmarshaler(data []byte, dst Version) error {
+	return json.Unmarshal(data, dst)
+}
+
+// Converts src to gob []byte data, each entity is encoded as a self contained gob stream so concrete types held in
+// interface fields must be registered with gob.Register.
+func GobMarshaler(src Version) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Populates dst from gob []byte data.
+func GobUnmarshaler(data []byte, dst Version) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(dst)
+}
+
+// Converts src to xml []byte data.
+func XmlMarshaler(src Version) ([]byte, error) {
+	return xml.Marshal(src)
+}
+
+// Populates dst from xml []byte data.
+func XmlUnmarshaler(data []byte, dst Version) error {
+	return xml.Unmarshal(data, dst)
+}
+
+// Converts src to a compact binary form holding only its exported field values in declaration order, with no field
+// names or type information. Integers are varints, floats are fixed width, strings, slices and maps are prefixed with
+// their length, map entries are ordered by key so equal entities encode identically, and pointers are prefixed with a
+// byte saying whether they are nil. Empty slices and maps decode as nil, as with gob. Values implementing
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, like time.Time, encode themselves. Channels, functions,
+// interfaces and complex numbers are not supported, nor are slices and maps with more elements than they have bytes of
+// data, like a slice of empty structs. Because nothing describes the data, adding, removing or reordering exported
+// fields makes previously stored entities undecodable.
+func BinaryMarshaler(src Version) ([]byte, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, &unsupportedBinaryTypeError{v.Type()}
+		}
+		v = v.Elem()
+	}
+	return appendBinary(nil, v)
+}
+
+// Populates dst, which must be a pointer, from []byte data produced by BinaryMarshaler.
+func BinaryUnmarshaler(data []byte, dst Version) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return &unsupportedBinaryTypeError{reflect.TypeOf(dst)}
+	}
+	r := &byteReader{b: data}
+	if err := readBinary(r, v.Elem()); err != nil {
+		return err
+	}
+	if r.err != nil || len(r.b) > 0 {
+		return &corruptBinaryDataError{}
+	}
+	return nil
+}
+
+// Whether values of t encode themselves, only if they can be decoded the same way.
+func isSelfBinary(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return pt.Implements(binaryMarshalerType) && pt.Implements(binaryUnmarshalerType)
+}
+
+func appendBinary(b []byte, v reflect.Value) ([]byte, error) {
+	if isSelfBinary(v.Type()) {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		d, err := p.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return append(appendUvarint(b, uint64(len(d))), d...), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var buf [binary.MaxVarintLen64]byte
+		return append(b, buf[:binary.PutVarint(buf[:], v.Int())]...), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUvarint(b, v.Uint()), nil
+	case reflect.Float32:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], math.Float32bits(float32(v.Float())))
+		return append(b, buf[:]...), nil
+	case reflect.Float64:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v.Float()))
+		return append(b, buf[:]...), nil
+	case reflect.String:
+		return append(appendUvarint(b, uint64(v.Len())), v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(appendUvarint(b, uint64(v.Len())), v.Bytes()...), nil
+		}
+		return appendBinaryElems(appendUvarint(b, uint64(v.Len())), v)
+	case reflect.Array:
+		return appendBinaryElems(b, v)
+	case reflect.Map:
+		b = appendUvarint(b, uint64(v.Len()))
+		entries := make([][]byte, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			entry, err := appendBinary(nil, k)
+			if err != nil {
+				return nil, err
+			}
+			if entry, err = appendBinary(entry, v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		// key encodings are unique and none is a prefix of another so sorting whole entries orders them by key.
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+		for _, entry := range entries {
+			b = append(b, entry...)
+		}
+		return b, nil
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != `` {
+				continue
+			}
+			var err error
+			if b, err = appendBinary(b, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return append(b, 0), nil
+		}
+		return appendBinary(append(b, 1), v.Elem())
+	}
+	return nil, &unsupportedBinaryTypeError{v.Type()}
+}
+
+func appendBinaryElems(b []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	for i := 0; i < v.Len(); i++ {
+		if b, err = appendBinary(b, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Sets v from r, v must be settable. Running out of data is left in r.err for the caller to report.
+func readBinary(r *byteReader, v reflect.Value) error {
+	if isSelfBinary(v.Type()) {
+		d := r.bytes(r.uvarint())
+		if r.err != nil {
+			return &corruptBinaryDataError{}
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(append([]byte{}, d...))
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(r.byte() != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(r.b)
+		if n <= 0 || v.OverflowInt(x) {
+			return &corruptBinaryDataError{}
+		}
+		r.b = r.b[n:]
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x := r.uvarint()
+		if v.OverflowUint(x) {
+			return &corruptBinaryDataError{}
+		}
+		v.SetUint(x)
+	case reflect.Float32:
+		if d := r.bytes(4); r.err == nil {
+			v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(d))))
+		}
+	case reflect.Float64:
+		if d := r.bytes(8); r.err == nil {
+			v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(d)))
+		}
+	case reflect.String:
+		v.SetString(string(r.bytes(r.uvarint())))
+	case reflect.Slice:
+		n := r.uvarint()
+		if n > uint64(len(r.b)) {
+			// checked before allocating so a corrupt length can not exhaust memory.
+			return &corruptBinaryDataError{}
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte{}, r.bytes(n)...))
+			return nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), int(n), int(n)))
+		return readBinaryElems(r, v)
+	case reflect.Array:
+		return readBinaryElems(r, v)
+	case reflect.Map:
+		n := r.uvarint()
+		if n > uint64(len(r.b)) {
+			return &corruptBinaryDataError{}
+		}
+		t := v.Type()
+		if n == 0 {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		v.Set(reflect.MakeMapWithSize(t, int(n)))
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			k, e := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+			if err := readBinary(r, k); err != nil {
+				return err
+			}
+			if err := readBinary(r, e); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField() && r.err == nil; i++ {
+			if t.Field(i).PkgPath != `` {
+				continue
+			}
+			if err := readBinary(r, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if r.byte() == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		e := reflect.New(v.Type().Elem())
+		if err := readBinary(r, e.Elem()); err != nil {
+			return err
+		}
+		v.Set(e)
+	default:
+		return &unsupportedBinaryTypeError{v.Type()}
+	}
+	return nil
+}
+
+func readBinaryElems(r *byteReader, v reflect.Value) error {
+	for i := 0; i < v.Len() && r.err == nil; i++ {
+		if err := readBinary(r, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type unsupportedBinaryTypeError struct{
+	t	reflect.Type
+}
+
+func (e *unsupportedBinaryTypeError) Error() string { return `binary codec does not support values of type `+e.t.String() }
+
+type corruptBinaryDataError struct{}
+
+func (e *corruptBinaryDataError) Error() string { return `binary data is corrupt or does not match the entity type` }
@@ -0,0 +1,184 @@
+package sus
+
+import(
+	`os`
+	`time`
+	`io/ioutil`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+var testCodecs = map[string]struct{
+	m	Marshaler
+	un	Unmarshaler
+}{
+	`json`: {JsonMarshaler, JsonUnmarshaler},
+	`gob`: {GobMarshaler, GobUnmarshaler},
+	`xml`: {XmlMarshaler, XmlUnmarshaler},
+	`binary`: {BinaryMarshaler, BinaryUnmarshaler},
+}
+
+func Test_codecs_round_trip(t *testing.T){
+	src := &bar{
+		Version: 3,
+		Name: `name`,
+		Tags: []string{`a`, `b`},
+		Score: -1.5,
+		Active: true,
+		Data: []byte(`raw`),
+		Created: time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC),
+	}
+
+	for name, codec := range testCodecs {
+		fooD, fooMErr := codec.m(&foo{Version: 2})
+		dstFoo := &foo{}
+		fooUnErr := codec.un(fooD, dstFoo)
+		barD, barMErr := codec.m(src)
+		dstBar := &bar{}
+		barUnErr := codec.un(barD, dstBar)
+
+		assert.Nil(t, fooMErr, name+` fooMErr should be nil`)
+		assert.Nil(t, fooUnErr, name+` fooUnErr should be nil`)
+		assert.Equal(t, &foo{Version: 2}, dstFoo, name+` dstFoo should equal the source`)
+		assert.Nil(t, barMErr, name+` barMErr should be nil`)
+		assert.Nil(t, barUnErr, name+` barUnErr should be nil`)
+		assert.Equal(t, src, dstBar, name+` dstBar should equal the source`)
+	}
+}
+
+func Test_BinaryMarshaler_round_trip(t *testing.T){
+	n := 7
+	src := &baz{
+		Version: 1,
+		Small: -3,
+		Big: 1<<40,
+		Ratio: 0.25,
+		Counts: map[string]int{`x`: 1, `y`: 2},
+		Ptr: &n,
+		Fixed: [2]uint16{65535, 1},
+		Nested: []bar{{Name: `nested`}},
+		hidden: `not stored`,
+	}
+
+	d, mErr := BinaryMarshaler(src)
+	again, _ := BinaryMarshaler(src)
+	dst := &baz{}
+	unErr := BinaryUnmarshaler(d, dst)
+	src.hidden = ``
+
+	assert.Nil(t, mErr, `mErr should be nil`)
+	assert.Equal(t, d, again, `equal entities should encode identically`)
+	assert.Nil(t, unErr, `unErr should be nil`)
+	assert.Equal(t, src, dst, `dst should equal the source without its unexported fields`)
+}
+
+func Test_BinaryMarshaler_errors(t *testing.T){
+	_, unsupportedErr := BinaryMarshaler(&qux{Ch: make(chan int)})
+	d, _ := BinaryMarshaler(&foo{Version: 300})
+	truncatedErr := BinaryUnmarshaler(d[:1], &foo{})
+	trailingErr := BinaryUnmarshaler(append(d, 0), &foo{})
+	overflowErr := BinaryUnmarshaler(d, &tiny{})
+
+	assert.Equal(t, `binary codec does not support values of type chan int`, unsupportedErr.Error(), `unsupportedErr should contain expected msg`)
+	assert.Equal(t, `binary data is corrupt or does not match the entity type`, truncatedErr.Error(), `truncatedErr should contain expected msg`)
+	assert.Equal(t, `binary data is corrupt or does not match the entity type`, trailingErr.Error(), `trailingErr should contain expected msg`)
+	assert.Equal(t, `binary data is corrupt or does not match the entity type`, overflowErr.Error(), `overflowErr should contain expected msg`)
+}
+
+func Test_codec_store_constructors(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	gobFs, gobErr := NewGobFileStore(dir+`/gob`, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	xmlFs, xmlErr := NewXmlFileStore(dir+`/xml`, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	binFs, binErr := NewBinaryFileStore(dir+`/bin`, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	stores := []Store{
+		NewGobMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer),
+		NewXmlMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer),
+		NewBinaryMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer),
+		gobFs,
+		xmlFs,
+		binFs,
+	}
+
+	assert.Nil(t, gobErr, `gobErr should be nil`)
+	assert.Nil(t, xmlErr, `xmlErr should be nil`)
+	assert.Nil(t, binErr, `binErr should be nil`)
+	for i, s := range stores {
+		id, f, _ := s.Create()
+		updateErr := s.Update(id, f)
+		v, readErr := s.Read(id)
+
+		assert.Nil(t, updateErr, `updateErr should be nil for store %d`, i)
+		assert.Nil(t, readErr, `readErr should be nil for store %d`, i)
+		assert.Equal(t, 1, v.GetVersion(), `v's version should be 1 for store %d`, i)
+	}
+}
+
+type bar struct{
+	Version	int
+	Name	string
+	Tags	[]string
+	Score	float64
+	Active	bool
+	Data	[]byte
+	Created	time.Time
+}
+
+func (b *bar) GetVersion() int {
+	return b.Version
+}
+
+func (b *bar) IncrementVersion() {
+	b.Version++
+}
+
+func (b *bar) DecrementVersion() {
+	b.Version--
+}
+
+type baz struct{
+	Version	int
+	Small	int8
+	Big		uint64
+	Ratio	float32
+	Counts	map[string]int
+	Ptr		*int
+	NilPtr	*int
+	Fixed	[2]uint16
+	Nested	[]bar
+	hidden	string
+}
+
+func (b *baz) GetVersion() int {
+	return b.Version
+}
+
+func (b *baz) IncrementVersion() {
+	b.Version++
+}
+
+func (b *baz) DecrementVersion() {
+	b.Version--
+}
+
+type qux struct{
+	foo
+	Ch	chan int
+}
+
+// Too small for the data of foos with larger versions.
+type tiny struct{
+	Version	int8
+}
+
+func (t *tiny) GetVersion() int {
+	return int(t.Version)
+}
+
+func (t *tiny) IncrementVersion() {
+	t.Version++
+}
+
+func (t *tiny) DecrementVersion() {
+	t.Version--
+}
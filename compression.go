@@ -0,0 +1,112 @@
+package sus
+
+import(
+	`io`
+	`bytes`
+	`strconv`
+	`io/ioutil`
+	`compress/gzip`
+	`compress/flate`
+)
+
+const(
+	compressedMagic	= "\x00SUZ"
+)
+
+// A compression algorithm for NewCompressedCodec.
+type Compression byte
+
+const(
+	GzipCompression		Compression = 1
+	FlateCompression	Compression = 2
+)
+
+// Wraps the codec m and un so records of at least threshold bytes are compressed with c. Compressed records start with
+// their own magic bytes and the decorated Unmarshaler checks for them, so compressed and uncompressed records, including
+// those written before compression was turned on, can be read side by side. Records that would not get smaller are
+// left uncompressed. Enveloped records can be compressed, but to keep their metadata readable and their Created times
+// carried across updates register the decorated codec in a Registry and envelope its output instead. Enveloped records
+// within compressed ones are decoded with the built in codecs, see NewCompressedCodecWithOptions.
+func NewCompressedCodec(m Marshaler, un Unmarshaler, c Compression, threshold int) (Marshaler, Unmarshaler) {
+	return NewCompressedCodecWithOptions(m, un, c, threshold, CodecOptions{})
+}
+
+// Wraps the codec m and un as NewCompressedCodec does, decoding enveloped records within compressed ones with the codecs
+// and types in opts.Registry.
+func NewCompressedCodecWithOptions(m Marshaler, un Unmarshaler, c Compression, threshold int, opts CodecOptions) (Marshaler, Unmarshaler) {
+	cm := func(src Version) ([]byte, error) {
+		d, err := m(src)
+		if err != nil || len(d) < threshold {
+			return d, err
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(d)/2))
+		buf.WriteString(compressedMagic)
+		buf.WriteByte(byte(c))
+		var w io.WriteCloser
+		switch c {
+		case GzipCompression:
+			w = gzip.NewWriter(buf)
+		case FlateCompression:
+			w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+		default:
+			return nil, &unknownCompressionError{byte(c)}
+		}
+		if _, err := w.Write(d); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() >= len(d) {
+			return d, nil
+		}
+		return buf.Bytes(), nil
+	}
+	cun := func(data []byte, dst Version) error {
+		if !bytes.HasPrefix(data, []byte(compressedMagic)) {
+			return unmarshalRecord(opts.Registry, un, data, dst)
+		}
+		d, err := decompress(data[len(compressedMagic):])
+		if err != nil {
+			return err
+		}
+		return unmarshalRecord(opts.Registry, un, d, dst)
+	}
+	return cm, cun
+}
+
+// Inflates data, whose first byte names its Compression.
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, &corruptCompressedRecordError{}
+	}
+	var r io.ReadCloser
+	switch Compression(data[0]) {
+	case GzipCompression:
+		gr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, &corruptCompressedRecordError{}
+		}
+		r = gr
+	case FlateCompression:
+		r = flate.NewReader(bytes.NewReader(data[1:]))
+	default:
+		return nil, &unknownCompressionError{data[0]}
+	}
+	defer r.Close()
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &corruptCompressedRecordError{}
+	}
+	return d, nil
+}
+
+type unknownCompressionError struct{
+	c	byte
+}
+
+func (e *unknownCompressionError) Error() string { return `unknown compression `+strconv.Itoa(int(e.c)) }
+
+type corruptCompressedRecordError struct{}
+
+func (e *corruptCompressedRecordError) Error() string { return `compressed record is corrupt` }
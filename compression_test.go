@@ -0,0 +1,79 @@
+package sus
+
+import(
+	`strings`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_NewCompressedCodec_round_trip(t *testing.T){
+	src := &bar{Version: 1, Name: strings.Repeat(`repetitive `, 100)}
+
+	for _, c := range []Compression{GzipCompression, FlateCompression} {
+		m, un := NewCompressedCodec(JsonMarshaler, JsonUnmarshaler, c, 64)
+		raw, _ := JsonMarshaler(src)
+		d, mErr := m(src)
+		dst := &bar{}
+		unErr := un(d, dst)
+
+		assert.Nil(t, mErr, `mErr should be nil`)
+		assert.Equal(t, compressedMagic, string(d[:len(compressedMagic)]), `d should be marked as compressed`)
+		assert.True(t, len(d) < len(raw) / 4, `d should be much smaller than the raw data`)
+		assert.Nil(t, unErr, `unErr should be nil`)
+		assert.Equal(t, src, dst, `dst should equal src`)
+	}
+}
+
+func Test_NewCompressedCodec_leaves_small_and_incompressible_records(t *testing.T){
+	m, un := NewCompressedCodec(JsonMarshaler, JsonUnmarshaler, GzipCompression, 64)
+	small := &foo{Version: 1}
+	incompressible := &bar{Name: `abcdefghijklmnopqrstuvwxyz0123456789`}
+
+	smallD, _ := m(small)
+	incompressibleD, _ := m(incompressible)
+	dst := &foo{}
+	unErr := un(smallD, dst)
+
+	assert.Equal(t, `{"version":1}`, string(smallD), `small records should not be compressed`)
+	assert.Equal(t, byte('{'), incompressibleD[0], `records that would not shrink should not be compressed`)
+	assert.Nil(t, unErr, `unErr should be nil`)
+	assert.Equal(t, small, dst, `dst should equal small`)
+}
+
+func Test_NewCompressedCodec_errors(t *testing.T){
+	badM, _ := NewCompressedCodec(JsonMarshaler, JsonUnmarshaler, Compression(9), 0)
+	_, un := NewCompressedCodec(JsonMarshaler, JsonUnmarshaler, GzipCompression, 0)
+
+	_, unknownErr := badM(&foo{})
+	unknownUnErr := un([]byte(compressedMagic+"\x09"), &foo{})
+	corruptErr := un([]byte(compressedMagic+"\x01garbage"), &foo{})
+	emptyErr := un([]byte(compressedMagic), &foo{})
+
+	assert.Equal(t, `unknown compression 9`, unknownErr.Error(), `unknownErr should contain expected msg`)
+	assert.Equal(t, `unknown compression 9`, unknownUnErr.Error(), `unknownUnErr should contain expected msg`)
+	assert.Equal(t, `compressed record is corrupt`, corruptErr.Error(), `corruptErr should contain expected msg`)
+	assert.Equal(t, `compressed record is corrupt`, emptyErr.Error(), `emptyErr should contain expected msg`)
+}
+
+func Test_compressed_records_in_stores(t *testing.T){
+	m, un := NewCompressedCodec(JsonMarshaler, JsonUnmarshaler, FlateCompression, 0)
+	get, put, del := memoryByteFuncs()
+	reg := NewRegistry()
+	reg.RegisterCodec(`test-flate-json`, m, un)
+	plain := NewByteStoreWithOptions(get, put, del, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, mutexRunInTransaction(), ByteStoreOptions{reg})
+	compressed := NewByteStoreWithOptions(get, put, del, m, un, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, mutexRunInTransaction(), ByteStoreOptions{reg})
+	enveloped, _ := NewEnvelopeMarshaler(reg, `test-flate-json`, `foo`, 1)(&foo{Version: 5})
+	put(`enveloped`, enveloped)
+
+	plainId, _, _ := plain.Create()
+	plainV, plainErr := compressed.Read(plainId)
+	envelopedV, envelopedErr := compressed.Read(`enveloped`)
+	fromPlainStore, fromPlainStoreErr := plain.Read(`enveloped`)
+
+	assert.Nil(t, plainErr, `uncompressed records should be readable through the compressed codec`)
+	assert.Equal(t, 0, plainV.GetVersion(), `plainV's version should be 0`)
+	assert.Nil(t, envelopedErr, `envelopedErr should be nil`)
+	assert.Equal(t, 5, envelopedV.GetVersion(), `envelopedV's version should be 5`)
+	assert.Nil(t, fromPlainStoreErr, `envelopes naming the compressed codec should be readable by any store sharing the registry`)
+	assert.Equal(t, 5, fromPlainStore.GetVersion(), `fromPlainStore's version should be 5`)
+}
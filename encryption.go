@@ -0,0 +1,246 @@
+package sus
+
+import(
+	`bytes`
+	`crypto/aes`
+	`crypto/rand`
+	`crypto/cipher`
+)
+
+const(
+	encryptedMagic	= "\x00SUE"
+)
+
+// Supplies the keys NewEncryptedCodec encrypts and decrypts records with. Keys are 16, 24 or 32 bytes long, selecting
+// AES-128, AES-192 or AES-256.
+type KeyProvider interface{
+	// Returns the key new records are encrypted with and its id, which is stored in each record.
+	CurrentKey() (id string, key []byte, err error)
+	// Returns the key with id, needed for as long as any record is encrypted with it.
+	Key(id string) (key []byte, err error)
+}
+
+// Returns a KeyProvider holding keys in memory, with the key under currentId used for new records.
+func NewStaticKeyProvider(currentId string, keys map[string][]byte) KeyProvider {
+	copied := make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		copied[id] = append([]byte{}, key...)
+	}
+	return &staticKeyProvider{currentId, copied}
+}
+
+type staticKeyProvider struct{
+	currentId	string
+	keys		map[string][]byte
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.currentId)
+	return p.currentId, key, err
+}
+
+func (p *staticKeyProvider) Key(id string) ([]byte, error) {
+	key, exists := p.keys[id]
+	if !exists {
+		return nil, &unknownKeyError{id}
+	}
+	return key, nil
+}
+
+// Wraps the codec m and un so records are encrypted with AES-GCM under kp's current key. Each record starts with its
+// own magic bytes and the id of the key it was encrypted with, so records under older keys stay readable while kp
+// still has them and ReEncrypt can move them to the current key. Unencrypted records are still read, so encryption
+// can be turned on for an existing store and its records encrypted with ReEncrypt. For ReEncrypt to work encryption
+// must be the outermost codec layer, so m and un may be compressed or enveloped codecs but the encrypted codec must
+// not itself be compressed or registered for envelopes. Checksums are added by the byte funcs beneath every codec, see
+// NewChecksummedByteFuncs, so sit outside encryption as they should. Enveloped records within encrypted ones are decoded
+// with the built in codecs, see NewEncryptedCodecWithOptions.
+func NewEncryptedCodec(m Marshaler, un Unmarshaler, kp KeyProvider) (Marshaler, Unmarshaler) {
+	return NewEncryptedCodecWithOptions(m, un, kp, CodecOptions{})
+}
+
+// Wraps the codec m and un as NewEncryptedCodec does, decoding enveloped records within encrypted ones with the codecs
+// and types in opts.Registry.
+func NewEncryptedCodecWithOptions(m Marshaler, un Unmarshaler, kp KeyProvider, opts CodecOptions) (Marshaler, Unmarshaler) {
+	em := func(src Version) ([]byte, error) {
+		d, err := m(src)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt(d, kp)
+	}
+	eun := func(data []byte, dst Version) error {
+		if !isEncrypted(data) {
+			return unmarshalRecord(opts.Registry, un, data, dst)
+		}
+		d, _, err := decrypt(data, kp)
+		if err != nil {
+			return err
+		}
+		return unmarshalRecord(opts.Registry, un, d, dst)
+	}
+	return em, eun
+}
+
+// Rewrites the records with ids that are not encrypted under kp's current key so they are, each in its own run of rit,
+// returning how many were rewritten. Records are decrypted and encrypted as raw bytes so entities, and their versions,
+// are unchanged, which needs encryption to be the outermost codec layer, see NewEncryptedCodec. Unencrypted records
+// found to hold encrypted ones beneath a compression or envelope layer fail with an *encryptionNotOutermostError before
+// they are rewritten. Ids that no longer exist are skipped, as are the ids stores reserve for their own records.
+func ReEncrypt(ids []string, bg ByteGetter, bp BytePutter, inee IsNonExtantError, rit RunInTransaction, kp KeyProvider) (int, error) {
+	rewritten := 0
+	for _, id := range ids {
+		if isReservedId(id) {
+			continue
+		}
+		err := rit(func() error {
+			data, err := bg(id)
+			if err != nil {
+				if inee(err) {
+					return nil
+				}
+				return err
+			}
+			currentId, _, err := kp.CurrentKey()
+			if err != nil {
+				return err
+			}
+			d := data
+			if isEncrypted(data) {
+				var keyId string
+				if d, keyId, err = decrypt(data, kp); err != nil {
+					return err
+				}
+				if keyId == currentId {
+					return nil
+				}
+			} else if encryptedBeneath(d) {
+				return &encryptionNotOutermostError{id}
+			}
+			if d, err = encrypt(d, kp); err != nil {
+				return err
+			}
+			rewritten++
+			return bp(id, d)
+		})
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+// Runs ReEncrypt over every entity in the file store in storeDir opened with opts, taking the store's lock for each
+// one.
+func ReEncryptFileStore(storeDir string, fileExt string, opts FileStoreOptions, kp KeyProvider) (int, error) {
+	ids, err := ListFileStoreIds(storeDir, fileExt, opts)
+	if err != nil {
+		return 0, err
+	}
+	get, put, _, err := fileByteFuncs(storeDir, fileExt, opts)
+	if err != nil {
+		return 0, err
+	}
+	rit, closeLock := fileStoreRunInTransaction(storeDir, opts)
+	defer closeLock()
+	return ReEncrypt(ids, get, put, isLocalEntityDoesNotExistError, rit, kp)
+}
+
+func isEncrypted(d []byte) bool {
+	return bytes.HasPrefix(d, []byte(encryptedMagic))
+}
+
+// Reports whether the unencrypted record d holds an encrypted one beneath its compression and envelope layers.
+func encryptedBeneath(d []byte) bool {
+	for {
+		switch {
+		case bytes.HasPrefix(d, []byte(compressedMagic)):
+			var err error
+			if d, err = decompress(d[len(compressedMagic):]); err != nil {
+				return false
+			}
+		case IsEnvelope(d):
+			e, err := DecodeEnvelope(d)
+			if err != nil {
+				return false
+			}
+			d = e.Payload
+		default:
+			return false
+		}
+		if isEncrypted(d) {
+			return true
+		}
+	}
+}
+
+// Returns magic, key id length, key id, nonce and the sealed d, the magic and key id are authenticated too.
+func encrypt(d []byte, kp KeyProvider) ([]byte, error) {
+	keyId, key, err := kp.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append(appendUvarint([]byte(encryptedMagic), uint64(len(keyId))), keyId...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(header)+len(nonce)+len(d)+gcm.Overhead())
+	b = append(append(b, header...), nonce...)
+	return gcm.Seal(b, nonce, d, header), nil
+}
+
+// Returns the plain text of data and the id of the key it was encrypted with.
+func decrypt(data []byte, kp KeyProvider) ([]byte, string, error) {
+	r := &byteReader{b: data[len(encryptedMagic):]}
+	keyId := string(r.bytes(r.uvarint()))
+	if r.err != nil {
+		return nil, ``, &corruptEncryptedRecordError{}
+	}
+	key, err := kp.Key(keyId)
+	if err != nil {
+		return nil, ``, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, ``, err
+	}
+	header := data[:len(data)-len(r.b)]
+	nonce := r.bytes(uint64(gcm.NonceSize()))
+	if r.err != nil {
+		return nil, ``, &corruptEncryptedRecordError{}
+	}
+	d, err := gcm.Open(nil, nonce, r.b, header)
+	if err != nil {
+		return nil, ``, &corruptEncryptedRecordError{}
+	}
+	return d, keyId, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type unknownKeyError struct{
+	id	string
+}
+
+func (e *unknownKeyError) Error() string { return `no key with id "`+e.id+`"` }
+
+type encryptionNotOutermostError struct{
+	id	string
+}
+
+func (e *encryptionNotOutermostError) Error() string { return `record of entity with id "`+e.id+`" is encrypted beneath another codec layer, encryption must be the outermost` }
+
+type corruptEncryptedRecordError struct{}
+
+func (e *corruptEncryptedRecordError) Error() string { return `encrypted record is corrupt or was not encrypted with its key` }
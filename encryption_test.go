@@ -0,0 +1,143 @@
+package sus
+
+import(
+	`os`
+	`bytes`
+	`io/ioutil`
+	`testing`
+	`compress/flate`
+	`github.com/stretchr/testify/assert`
+)
+
+var(
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func Test_NewEncryptedCodec_round_trip(t *testing.T){
+	m, un := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1}))
+	src := &bar{Version: 2, Name: `secret`}
+
+	d, mErr := m(src)
+	again, _ := m(src)
+	dst := &bar{}
+	unErr := un(d, dst)
+
+	assert.Nil(t, mErr, `mErr should be nil`)
+	assert.False(t, bytes.Contains(d, []byte(`secret`)), `d should not contain the plain text`)
+	assert.NotEqual(t, d, again, `each encryption should use a fresh nonce`)
+	assert.Nil(t, unErr, `unErr should be nil`)
+	assert.Equal(t, src, dst, `dst should equal src`)
+}
+
+func Test_NewEncryptedCodec_errors(t *testing.T){
+	kp := NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1})
+	m, _ := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, kp)
+	_, otherUn := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`k2`, map[string][]byte{`k2`: testKey2}))
+	badM, _ := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`bad`, map[string][]byte{`bad`: []byte(`short`)}))
+	missingM, _ := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`missing`, nil))
+	_, un := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, kp)
+	d, _ := m(&foo{})
+
+	unknownKeyErr := otherUn(d, &foo{})
+	tampered := append([]byte{}, d...)
+	tampered[len(tampered)-1] ^= 1
+	tamperedErr := un(tampered, &foo{})
+	truncatedErr := un([]byte(encryptedMagic), &foo{})
+	_, badKeyErr := badM(&foo{})
+	_, missingKeyErr := missingM(&foo{})
+
+	assert.Equal(t, `no key with id "k1"`, unknownKeyErr.Error(), `unknownKeyErr should contain expected msg`)
+	assert.Equal(t, `encrypted record is corrupt or was not encrypted with its key`, tamperedErr.Error(), `tamperedErr should contain expected msg`)
+	assert.Equal(t, `encrypted record is corrupt or was not encrypted with its key`, truncatedErr.Error(), `truncatedErr should contain expected msg`)
+	assert.Equal(t, `crypto/aes: invalid key size 5`, badKeyErr.Error(), `badKeyErr should contain expected msg`)
+	assert.Equal(t, `no key with id "missing"`, missingKeyErr.Error(), `missingKeyErr should contain expected msg`)
+}
+
+func Test_ReEncryptFileStore_rotates_keys(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	opts := FileStoreOptions{FanOutLevels: 1}
+	plainIdf := func() string { return `plain` }
+	plain, _ := NewFileStoreWithOptions(dir, `json`, JsonMarshaler, JsonUnmarshaler, plainIdf, fooVersionFactory, fooEntityInitializer, opts)
+	plainId, plainF, _ := plain.Create()
+	plain.Update(plainId, plainF)
+	m1, un1 := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1}))
+	s1, _ := NewFileStoreWithOptions(dir, `json`, m1, un1, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	ids, _, _ := s1.CreateMulti(2)
+
+	rotated := NewStaticKeyProvider(`k2`, map[string][]byte{`k1`: testKey1, `k2`: testKey2})
+	rewritten, err := ReEncryptFileStore(dir, `json`, opts, rotated)
+	again, againErr := ReEncryptFileStore(dir, `json`, opts, rotated)
+	m2, un2 := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`k2`, map[string][]byte{`k2`: testKey2}))
+	s2, _ := NewFileStoreWithOptions(dir, `json`, m2, un2, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	vs, readErr := s2.ReadMulti(append(ids, plainId))
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 3, rewritten, `the plain and both k1 records should have been rewritten`)
+	assert.Nil(t, againErr, `againErr should be nil`)
+	assert.Equal(t, 0, again, `nothing should need rewriting a second time`)
+	assert.Nil(t, readErr, `every record should be readable with only the new key`)
+	assert.Equal(t, 0, vs[0].GetVersion(), `vs[0]'s version should be unchanged`)
+	assert.Equal(t, 1, vs[2].GetVersion(), `vs[2]'s version should be unchanged`)
+}
+
+func Test_ReEncrypt_errors(t *testing.T){
+	get, put, _ := memoryByteFuncs()
+	rit := func(tran Transaction) error { return tran() }
+	m, _ := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1}))
+	d, _ := m(&foo{})
+	put(`a`, d)
+
+	skipped, skippedErr := ReEncrypt([]string{`missing`}, get, put, isLocalEntityDoesNotExistError, rit, NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1}))
+	_, unknownErr := ReEncrypt([]string{`a`}, get, put, isLocalEntityDoesNotExistError, rit, NewStaticKeyProvider(`k2`, map[string][]byte{`k2`: testKey2}))
+
+	assert.Nil(t, skippedErr, `missing ids should be skipped`)
+	assert.Equal(t, 0, skipped, `skipped should be 0`)
+	assert.Equal(t, `no key with id "k1"`, unknownErr.Error(), `unknownErr should contain expected msg`)
+}
+
+func Test_ReEncrypt_skips_reserved_ids(t *testing.T){
+	get, put, _ := memoryByteFuncs()
+	rit := func(tran Transaction) error { return tran() }
+	ids := []string{`.2pc`, `.2pc.tx`, `.lease.a`, `a:1/.journal`, `a`}
+	for _, id := range ids {
+		put(id, []byte(`{}`))
+	}
+
+	rewritten, err := ReEncrypt(ids, get, put, isLocalEntityDoesNotExistError, rit, NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1}))
+	twoPhase, _ := get(`.2pc`)
+	entity, _ := get(`a`)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, rewritten, `only the entity should have been rewritten`)
+	assert.Equal(t, []byte(`{}`), twoPhase, `reserved records should be left as they are`)
+	assert.True(t, isEncrypted(entity), `the entity should be encrypted`)
+}
+
+func Test_ReEncrypt_rejects_encryption_beneath_other_layers(t *testing.T){
+	get, put, _ := memoryByteFuncs()
+	rit := func(tran Transaction) error { return tran() }
+	kp := NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1})
+	em, eun := NewEncryptedCodec(JsonMarshaler, JsonUnmarshaler, kp)
+	reg := NewRegistry()
+	reg.RegisterCodec(`encrypted-json`, em, eun)
+	encrypted, _ := em(&foo{})
+	buf := bytes.NewBufferString(compressedMagic + string(FlateCompression))
+	w, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	w.Write(encrypted)
+	w.Close()
+	// encrypted records never get smaller so the compressed codec leaves them as they are, this is built by hand.
+	compressed := buf.Bytes()
+	enveloped, _ := NewEnvelopeMarshaler(reg, `encrypted-json`, `foo`, 1)(&foo{})
+	put(`compressed`, compressed)
+	put(`enveloped`, enveloped)
+
+	_, compressedErr := ReEncrypt([]string{`compressed`}, get, put, isLocalEntityDoesNotExistError, rit, kp)
+	_, envelopedErr := ReEncrypt([]string{`enveloped`}, get, put, isLocalEntityDoesNotExistError, rit, kp)
+	unchanged, _ := get(`compressed`)
+
+	assert.Equal(t, `record of entity with id "compressed" is encrypted beneath another codec layer, encryption must be the outermost`, compressedErr.Error(), `compressedErr should contain expected msg`)
+	assert.Equal(t, `record of entity with id "enveloped" is encrypted beneath another codec layer, encryption must be the outermost`, envelopedErr.Error(), `envelopedErr should contain expected msg`)
+	assert.Equal(t, compressed, unchanged, `rejected records should be left as they are`)
+}
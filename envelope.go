@@ -0,0 +1,144 @@
+package sus
+
+import(
+	`time`
+	`bytes`
+	`strconv`
+	`encoding/binary`
+)
+
+const(
+	envelopeMagic			= "\x00SUS"
+	envelopeFormatVersion	= 1
+)
+
+// A stored record along with what produced it. Byte stores recognise enveloped records by their leading magic bytes
+// and decode them with the codec named in the envelope, looked up in their Registry, rather than their own Unmarshaler,
+// so records written with different codecs can be read side by side, raw records without an envelope are still
+// decoded as before.
+type Envelope struct{
+	// The id the payload's codec is registered under, see Registry.
+	Codec			string
+	// The name and version of the entity's schema, for the application's own use.
+	Schema			string
+	SchemaVersion	uint64
+	// The entity's version when it was written.
+	Version			int
+	// When the entity was first written in an envelope and when it was last written.
+	Created			time.Time
+	Updated			time.Time
+	Payload			[]byte
+}
+
+// Returns a Marshaler that encodes entities with the codec registered under codecId in r and wraps them in an Envelope
+// recording codecId, schema and schemaVersion. Byte stores keep the Created time of the record being replaced.
+func NewEnvelopeMarshaler(r *Registry, codecId string, schema string, schemaVersion uint64) Marshaler {
+	return func(src Version) ([]byte, error) {
+		c, err := r.codec(codecId)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := c.m(src)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC()
+		return EncodeEnvelope(&Envelope{codecId, schema, schemaVersion, src.GetVersion(), now, now, payload}), nil
+	}
+}
+
+// Whether d starts with the envelope magic bytes.
+func IsEnvelope(d []byte) bool {
+	return bytes.HasPrefix(d, []byte(envelopeMagic))
+}
+
+// Returns the stored form of e.
+func EncodeEnvelope(e *Envelope) []byte {
+	b := make([]byte, 0, len(envelopeMagic)+len(e.Codec)+len(e.Schema)+len(e.Payload)+32)
+	b = append(b, envelopeMagic...)
+	b = append(b, envelopeFormatVersion)
+	b = append(appendUvarint(b, uint64(len(e.Codec))), e.Codec...)
+	b = append(appendUvarint(b, uint64(len(e.Schema))), e.Schema...)
+	b = appendUvarint(b, e.SchemaVersion)
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutVarint(buf[:], int64(e.Version))]...)
+	b = append(b, buf[:binary.PutVarint(buf[:], e.Created.UnixNano())]...)
+	b = append(b, buf[:binary.PutVarint(buf[:], e.Updated.UnixNano())]...)
+	return append(b, e.Payload...)
+}
+
+// Parses the envelope d, which must start with the envelope magic bytes.
+func DecodeEnvelope(d []byte) (*Envelope, error) {
+	if !IsEnvelope(d) {
+		return nil, &corruptEnvelopeError{}
+	}
+	r := &byteReader{b: d[len(envelopeMagic):]}
+	if format := r.byte(); r.err == nil && format != envelopeFormatVersion {
+		return nil, &unsupportedEnvelopeFormatError{format}
+	}
+	e := &Envelope{}
+	e.Codec = string(r.bytes(r.uvarint()))
+	e.Schema = string(r.bytes(r.uvarint()))
+	e.SchemaVersion = r.uvarint()
+	e.Version = int(r.varint())
+	e.Created = time.Unix(0, r.varint()).UTC()
+	e.Updated = time.Unix(0, r.varint()).UTC()
+	if r.err != nil {
+		return nil, &corruptEnvelopeError{}
+	}
+	e.Payload = r.b
+	return e, nil
+}
+
+// Decodes a stored record into dst, with the codec its envelope names in r if it has one and un otherwise. Enveloped
+// records at an older version of their schema are migrated with the migrations in r.
+func unmarshalRecord(r *Registry, un Unmarshaler, d []byte, dst Version) error {
+	if !IsEnvelope(d) {
+		return un(d, dst)
+	}
+	e, err := DecodeEnvelope(d)
+	if err != nil {
+		return err
+	}
+	c, err := r.codec(e.Codec)
+	if err != nil {
+		return err
+	}
+	if err = c.un(e.Payload, dst); err != nil {
+		return err
+	}
+	return r.migrate(e.Schema, e.SchemaVersion, e.Payload, dst)
+}
+
+// Returns d with the Created time of prev, if both are envelopes.
+func keepEnvelopeCreated(prev []byte, d []byte) []byte {
+	if !IsEnvelope(prev) || !IsEnvelope(d) {
+		return d
+	}
+	old, err := DecodeEnvelope(prev)
+	if err != nil {
+		return d
+	}
+	e, err := DecodeEnvelope(d)
+	if err != nil {
+		return d
+	}
+	e.Created = old.Created
+	return EncodeEnvelope(e)
+}
+
+type corruptEnvelopeError struct{}
+
+func (e *corruptEnvelopeError) Error() string { return `envelope is corrupt` }
+
+type unsupportedEnvelopeFormatError struct{
+	format	byte
+}
+
+func (e *unsupportedEnvelopeFormatError) Error() string { return `envelope format `+strconv.Itoa(int(e.format))+` is not supported` }
+
+type unknownCodecError struct{
+	id	string
+}
+
+func (e *unknownCodecError) Error() string { return `no codec is registered under id "`+e.id+`"` }
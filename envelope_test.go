@@ -0,0 +1,91 @@
+package sus
+
+import(
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_EncodeEnvelope_DecodeEnvelope(t *testing.T){
+	src := &Envelope{`json`, `foo`, 2, 7, time.Unix(1, 2).UTC(), time.Unix(3, 4).UTC(), []byte(`{}`)}
+
+	d := EncodeEnvelope(src)
+	dst, err := DecodeEnvelope(d)
+
+	assert.True(t, IsEnvelope(d), `d should be an envelope`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, src, dst, `dst should equal src`)
+}
+
+func Test_DecodeEnvelope_errors(t *testing.T){
+	d := EncodeEnvelope(&Envelope{Codec: `json`})
+	_, notEnvelopeErr := DecodeEnvelope([]byte(`{}`))
+	_, truncatedErr := DecodeEnvelope(d[:len(envelopeMagic)+3])
+	d[len(envelopeMagic)] = 9
+	_, formatErr := DecodeEnvelope(d)
+
+	assert.Equal(t, `envelope is corrupt`, notEnvelopeErr.Error(), `notEnvelopeErr should contain expected msg`)
+	assert.Equal(t, `envelope is corrupt`, truncatedErr.Error(), `truncatedErr should contain expected msg`)
+	assert.Equal(t, `envelope format 9 is not supported`, formatErr.Error(), `formatErr should contain expected msg`)
+}
+
+func Test_ByteStore_with_envelopes(t *testing.T){
+	get, put, del := memoryByteFuncs()
+	s := NewMutexByteStore(get, put, del, NewEnvelopeMarshaler(nil, `gob`, `foo`, 1), JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError)
+
+	id, f, _ := s.Create()
+	created, _ := get(id)
+	time.Sleep(time.Millisecond)
+	updateErr := s.Update(id, f)
+	updated, _ := get(id)
+	v, readErr := s.Read(id)
+	createdE, _ := DecodeEnvelope(created)
+	updatedE, _ := DecodeEnvelope(updated)
+
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Equal(t, `gob`, updatedE.Codec, `the codec should be recorded`)
+	assert.Equal(t, `foo`, updatedE.Schema, `the schema should be recorded`)
+	assert.Equal(t, uint64(1), updatedE.SchemaVersion, `the schema version should be recorded`)
+	assert.Equal(t, 1, updatedE.Version, `the entity version should be recorded`)
+	assert.Equal(t, createdE.Created, updatedE.Created, `the created time should be kept across updates`)
+	assert.True(t, updatedE.Updated.After(createdE.Updated), `the updated time should move on`)
+}
+
+func Test_ByteStore_reads_mixed_codecs(t *testing.T){
+	get, put, del := memoryByteFuncs()
+	s := NewMutexByteStore(get, put, del, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError)
+	raw, _ := JsonMarshaler(&foo{Version: 1})
+	gobEnvelope, _ := NewEnvelopeMarshaler(nil, `gob`, `foo`, 1)(&foo{Version: 2})
+	binaryEnvelope, _ := NewEnvelopeMarshaler(nil, `binary`, `foo`, 1)(&foo{Version: 3})
+	put(`raw`, raw)
+	put(`gob`, gobEnvelope)
+	put(`binary`, binaryEnvelope)
+
+	vs, err := s.ReadMulti([]string{`raw`, `gob`, `binary`})
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, vs[0].GetVersion(), `vs[0]'s version should be 1`)
+	assert.Equal(t, 2, vs[1].GetVersion(), `vs[1]'s version should be 2`)
+	assert.Equal(t, 3, vs[2].GetVersion(), `vs[2]'s version should be 3`)
+}
+
+func Test_Registry_RegisterCodec(t *testing.T){
+	get, put, del := memoryByteFuncs()
+	reg := NewRegistry()
+	s := NewByteStoreWithOptions(get, put, del, NewEnvelopeMarshaler(reg, `test-codec`, `foo`, 1), JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, mutexRunInTransaction(), ByteStoreOptions{reg})
+	other := NewMutexByteStore(get, put, del, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError)
+
+	_, _, unknownErr := s.Create()
+	reg.RegisterCodec(`test-codec`, XmlMarshaler, XmlUnmarshaler)
+	id, _, createErr := s.Create()
+	v, readErr := s.Read(id)
+	_, otherErr := other.Read(id)
+
+	assert.Equal(t, `no codec is registered under id "test-codec"`, unknownErr.Error(), `unknownErr should contain expected msg`)
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 0, v.GetVersion(), `v's version should be 0`)
+	assert.Equal(t, `no codec is registered under id "test-codec"`, otherErr.Error(), `stores given another registry should not see the codec`)
+}
@@ -2,49 +2,452 @@ package sus
 
 import(
 	`os`
-	`io/ioutil`
+	`sync`
+	`time`
+	`strconv`
+	`strings`
+	`crypto/sha256`
+	`encoding/hex`
+	`encoding/base32`
+	`path/filepath`
 )
 
+const(
+	fileLockName			= `.lock`
+	defaultFileLockTimeout	= 10 * time.Second
+	fileLockRetryInterval	= 5 * time.Millisecond
+	fileTempPrefix			= `.tmp.`
+	fileQuarantineDir		= `.quarantine`
+	maxFanOutLevels			= sha256.Size
+	maxFileNameLen			= 255
+)
+
+// Lower case so file names that differ only in case, which collide on case insensitive file systems, never occur.
+var fileIdEncoding = base32.NewEncoding(`abcdefghijklmnopqrstuvwxyz234567`).WithPadding(base32.NoPadding)
+
 // Creates and configures a store that stores entities by converting them to and from json []byte data and keeps them in the local file system.
 func NewJsonFileStore(storeDir string, idf IdFactory, vf VersionFactory, ei EntityInitializer) (Store, error) {
-	return NewFileStore(storeDir, `json`, jsonMarshaler, jsonUnmarshaler, idf, vf, ei)
+	return NewFileStore(storeDir, `json`, JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a store that stores entities by converting them to and from gob []byte data and keeps them in the local file system.
+func NewGobFileStore(storeDir string, idf IdFactory, vf VersionFactory, ei EntityInitializer) (Store, error) {
+	return NewFileStore(storeDir, `gob`, GobMarshaler, GobUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a store that stores entities by converting them to and from xml []byte data and keeps them in the local file system.
+func NewXmlFileStore(storeDir string, idf IdFactory, vf VersionFactory, ei EntityInitializer) (Store, error) {
+	return NewFileStore(storeDir, `xml`, XmlMarshaler, XmlUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a store that stores entities by converting them to and from compact binary []byte data, see BinaryMarshaler, and keeps them in the local file system.
+func NewBinaryFileStore(storeDir string, idf IdFactory, vf VersionFactory, ei EntityInitializer) (Store, error) {
+	return NewFileStore(storeDir, `bin`, BinaryMarshaler, BinaryUnmarshaler, idf, vf, ei)
 }
 
 // Creates and configures a store that stores entities by converting them to and from []byte and keeps them in the local file system.
 func NewFileStore(storeDir string, fileExt string, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) (Store, error) {
-	err := os.MkdirAll(storeDir, os.ModeDir)
+	return NewFileStoreWithOptions(storeDir, fileExt, m, un, idf, vf, ei, FileStoreOptions{})
+}
+
+// Creates and configures a store that stores entities by converting them to and from []byte and keeps them in the
+// local file system, or opts.FileSystem if set. Every transaction holds the file system's lock ".lock" in storeDir,
+// on the local file system an flock, so processes sharing storeDir see each other's updates in order. The lock is
+// opened by the store's first transaction and held open for the life of the process. On platforms without flock only
+// stores within the same process exclude each other.
+func NewFileStoreWithOptions(storeDir string, fileExt string, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, opts FileStoreOptions) (Store, error) {
+	get, put, del, err := fileByteFuncs(storeDir, fileExt, opts)
 
 	if err != nil {
 		return nil, err
 	}
 
-	getFileName := func(id string) string {
-		return storeDir + `/` + id + `.` + fileExt
+	rit, _ := fileStoreRunInTransaction(storeDir, opts)
+
+	return &verifiableStore{
+		Store: NewByteStoreWithOptions(get, put, del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, rit, ByteStoreOptions{opts.Registry}),
+		verifyFn: func(repair bool) (*VerifyReport, error) {
+			return verifyFileStore(storeDir, fileExt, un, vf, opts, rit, repair)
+		},
+	}, nil
+}
+
+// Returns the RunInTransaction file stores in storeDir use, see NewFileStoreWithOptions, and a func that closes the
+// lock it opens on its first transaction. Callers that only run a few transactions close it when they are done.
+func fileStoreRunInTransaction(storeDir string, opts FileStoreOptions) (RunInTransaction, func() error) {
+	mtx := sync.Mutex{}
+	var lock FileLock
+
+	lockTimeout := opts.LockTimeout
+	if lockTimeout <= 0 {
+		lockTimeout = defaultFileLockTimeout
 	}
 
-	get := func(id string) ([]byte, error) {
-		fn := getFileName(id)
-		if _, err := os.Stat(fn); err != nil {
-			if os.IsNotExist(err) {
-				err = localEntityDoesNotExistError{id}
+	rit := func(tran Transaction) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if lock == nil {
+			l, err := opts.fileSystem().OpenLock(filepath.Join(storeDir, fileLockName))
+			if err != nil {
+				return err
 			}
+			lock = l
+		}
+		if err := lock.Lock(lockTimeout); err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		return tran()
+	}
+
+	closeLock := func() error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if lock == nil {
+			return nil
+		}
+		err := lock.Close()
+		lock = nil
+		return err
+	}
+
+	return rit, closeLock
+}
+
+// Options for NewFileStoreWithOptions, zero values are replaced with defaults.
+type FileStoreOptions struct{
+	// How long a transaction waits for another process to release the store's lock. Defaults to 10 seconds.
+	LockTimeout			time.Duration
+	// How many levels of sub directories entity files are spread across, each level is named by the next two hex
+	// characters of the sha256 hash of the id so holds at most 256 entries. Defaults to 0, every file directly in
+	// storeDir. An existing flat store can be moved to a fanned out layout with MigrateFileStoreFanOut.
+	FanOutLevels		int
+	// Names entity files with the EncodeFileStoreId encoding of their ids, so any id can be stored and ids differing
+	// only in case never collide on case insensitive file systems. By default files are named with the ids themselves,
+	// as they always have been, and ids that are not safe file names are rejected with an *InvalidIdError, see
+	// ValidateRawFileStoreId. Raw names stay the default so existing stores remain readable, new stores should set
+	// this. The naming is fixed once a store holds entities, switching it makes them unreadable.
+	EncodeIds			bool
+	// Where the entity files are kept. Defaults to NewOSFileSystem().
+	FileSystem			FileSystem
+	// Stops records being written with checksums, see NewChecksummedByteFuncs. Records already written with
+	// checksums are still verified.
+	DisableChecksums	bool
+	// Where the codecs named by enveloped records are looked up. Defaults to the built in codecs, see NewRegistry.
+	Registry			*Registry
+	// Moves the files of entities found to be corrupt into the ".quarantine" directory in storeDir, so the read that
+	// finds the corruption fails with a *CorruptionError and later ones find the entity does not exist.
+	QuarantineCorrupt	bool
+}
+
+func (opts FileStoreOptions) fileSystem() FileSystem {
+	if opts.FileSystem == nil {
+		return osFileSystem{}
+	}
+	return opts.FileSystem
+}
+
+// Returns the file name, without extension, a file store opened with EncodeIds keeps the entity with id in. The name
+// is the unpadded lower case base32 encoding of id, which can not escape the store directory or collide with another id on a case
+// insensitive file system. Fails with an *InvalidIdError if id is empty or its encoding is too long for a file name.
+func EncodeFileStoreId(id string) (string, error) {
+	if id == `` {
+		return ``, &InvalidIdError{id, `it is empty`}
+	}
+	name := fileIdEncoding.EncodeToString([]byte(id))
+	if len(name) > maxFileNameLen {
+		return ``, &InvalidIdError{id, `its encoding is longer than `+strconv.Itoa(maxFileNameLen)+` bytes`}
+	}
+	return name, nil
+}
+
+// Returns the id EncodeFileStoreId encoded as name.
+func DecodeFileStoreId(name string) (string, error) {
+	id, err := fileIdEncoding.DecodeString(name)
+	if err != nil {
+		return ``, err
+	}
+	return string(id), nil
+}
+
+// Fails with an *InvalidIdError if id can not be used as a file name as it is, because it is empty, too long, is "."
+// or "..", starts with "." like the store's own files, such as ".lock", ".tmp.*", ".2pc" and ".lease.*", or contains a
+// path separator, NUL or a character Windows does not allow in file names.
+func ValidateRawFileStoreId(id string) error {
+	if id == `` {
+		return &InvalidIdError{id, `it is empty`}
+	}
+	if id == `.` || id == `..` {
+		return &InvalidIdError{id, `it is a relative directory name`}
+	}
+	if err := validateRawFileName(id); err != nil {
+		return err
+	}
+	if strings.HasPrefix(id, `.`) {
+		return &InvalidIdError{id, `it starts with ".", which is reserved for the store's own files`}
+	}
+	return nil
+}
+
+// Fails with an *InvalidIdError if id, a user's id or one of the reserved ids stores keep their own records under, is
+// too long for a file name or contains a character that is not allowed in one.
+func validateRawFileName(id string) error {
+	if strings.ContainsAny(id, "/\\\x00") {
+		return &InvalidIdError{id, `it contains a path separator or NUL`}
+	}
+	if strings.ContainsAny(id, `:*?"<>|`) {
+		return &InvalidIdError{id, `it contains one of :*?"<>|`}
+	}
+	if len(id) > maxFileNameLen {
+		return &InvalidIdError{id, `it is longer than `+strconv.Itoa(maxFileNameLen)+` bytes`}
+	}
+	return nil
+}
+
+// Moves every entity file directly within storeDir, on opts.FileSystem, into the sub directories a store opened with
+// opts, and so opts.FanOutLevels, expects. It holds the store's lock throughout so running stores wait for it, but
+// stores opened with the old layout must not be used afterwards. Files already fanned out are left alone so an
+// interrupted migration can simply be run again.
+func MigrateFileStoreFanOut(storeDir string, fileExt string, opts FileStoreOptions) error {
+	fanOutLevels := opts.FanOutLevels
+	if fanOutLevels < 0 || fanOutLevels > maxFanOutLevels {
+		return &invalidFanOutLevelsError{fanOutLevels}
+	}
+
+	fs := opts.fileSystem()
+
+	lock, err := fs.OpenLock(filepath.Join(storeDir, fileLockName))
+
+	if err != nil {
+		return err
+	}
+
+	defer lock.Close()
+
+	lockTimeout := opts.LockTimeout
+	if lockTimeout <= 0 {
+		lockTimeout = defaultFileLockTimeout
+	}
+
+	if err := lock.Lock(lockTimeout); err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	infos, err := fs.ReadDir(storeDir)
+
+	if err != nil {
+		return err
+	}
+
+	suffix := `.` + fileExt
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || name == fileLockName || strings.HasPrefix(name, fileTempPrefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		dst := fanOutFileName(storeDir, strings.TrimSuffix(name, suffix), fileExt, fanOutLevels)
+		if err := fs.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := fs.Rename(filepath.Join(storeDir, name), dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the ids of every entity in the file store in storeDir opened with opts.
+func ListFileStoreIds(storeDir string, fileExt string, opts FileStoreOptions) ([]string, error) {
+	ids := []string{}
+	err := walkFileStore(opts.fileSystem(), storeDir, `.`+fileExt, opts, opts.FanOutLevels, func(path string, id string) error {
+		if id != `` {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Calls visit with the path of every file in the store's entity directories below dir, other than its lock file and
+// the files of reserved ids, and the id of the entity it holds, which is empty for temp files and files the store did
+// not write.
+func walkFileStore(fs FileSystem, dir string, suffix string, opts FileStoreOptions, levels int, visit func(path string, id string) error) error {
+	infos, err := fs.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		if info.IsDir() {
+			if levels > 0 && name != fileQuarantineDir {
+				if err := walkFileStore(fs, path, suffix, opts, levels-1, visit); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if name == fileLockName && levels == opts.FanOutLevels {
+			continue
+		}
+		id := ``
+		if levels == 0 && !strings.HasPrefix(name, fileTempPrefix) && strings.HasSuffix(name, suffix) {
+			id = strings.TrimSuffix(name, suffix)
+			if opts.EncodeIds {
+				if id, err = DecodeFileStoreId(id); err != nil {
+					id = ``
+				}
+			}
+			if isReservedId(id) {
+				continue
+			}
+		}
+		if err := visit(path, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Creates storeDir and returns functions that keep each id's []byte data in its own file within it, named and fanned
+// out across sub directories according to opts.
+func fileByteFuncs(storeDir string, fileExt string, opts FileStoreOptions) (ByteGetter, BytePutter, Deleter, error) {
+	fanOutLevels := opts.FanOutLevels
+	if fanOutLevels < 0 || fanOutLevels > maxFanOutLevels {
+		return nil, nil, nil, &invalidFanOutLevelsError{fanOutLevels}
+	}
+
+	fs := opts.fileSystem()
+
+	err := fs.MkdirAll(storeDir, os.ModeDir)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	getFileName := func(id string) (string, error) {
+		name := id
+		var err error
+		if opts.EncodeIds {
+			name, err = EncodeFileStoreId(id)
+		} else if isReservedId(id) {
+			err = validateRawFileName(id)
+		} else {
+			err = ValidateRawFileStoreId(id)
+		}
+		if err != nil {
+			return ``, err
+		}
+		return fanOutFileName(storeDir, name, fileExt, fanOutLevels), nil
+	}
+
+	get := func(id string) ([]byte, error) {
+		fn, err := getFileName(id)
+		if err != nil {
 			return nil, err
 		}
-		return ioutil.ReadFile(fn)
+		d, err := fs.ReadFile(fn)
+		if os.IsNotExist(err) {
+			err = localEntityDoesNotExistError{id}
+		}
+		return d, err
 	}
 
 	put := func(id string, d []byte) error {
-		return ioutil.WriteFile(getFileName(id), d, os.ModeAppend)
+		fn, err := getFileName(id)
+		if err != nil {
+			return err
+		}
+		if fanOutLevels > 0 {
+			if err := fs.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+				return err
+			}
+		}
+		// written aside and renamed into place so a failed write never leaves a partial entity behind.
+		tmp := filepath.Join(filepath.Dir(fn), fileTempPrefix+filepath.Base(fn))
+		if err := fs.WriteFile(tmp, d, os.ModeAppend); err != nil {
+			fs.Remove(tmp)
+			return err
+		}
+		return fs.Rename(tmp, fn)
 	}
 
 	del := func(id string) error {
-		return os.Remove(getFileName(id))
+		fn, err := getFileName(id)
+		if err != nil {
+			return err
+		}
+		return fs.Remove(fn)
+	}
+
+	checkedGet, checkedPut := NewChecksummedByteFuncs(get, put)
+	if !opts.DisableChecksums {
+		put = checkedPut
 	}
 
-	isNonExtantError := func(err error) bool {
-		_, ok := err.(localEntityDoesNotExistError)
-		return ok
+	get = func(id string) ([]byte, error) {
+		d, err := checkedGet(id)
+		if _, corrupt := err.(*CorruptionError); corrupt && opts.QuarantineCorrupt {
+			fn, _ := getFileName(id)
+			if qErr := quarantineFile(fs, storeDir, fn); qErr != nil {
+				return nil, qErr
+			}
+		}
+		return d, err
 	}
 
-	return NewMutexByteStore(get, put, del, m, un, idf, vf, ei, isNonExtantError), nil
-}
\ No newline at end of file
+	return get, put, del, nil
+}
+
+// Moves the file fn into the quarantine directory in storeDir.
+func quarantineFile(fs FileSystem, storeDir string, fn string) error {
+	dir := filepath.Join(storeDir, fileQuarantineDir)
+	if err := fs.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// stamped so repeated corruption of the same id keeps every copy.
+	name := filepath.Base(fn) + `.` + strconv.FormatInt(time.Now().UnixNano(), 10)
+	return fs.Rename(fn, filepath.Join(dir, name))
+}
+
+func fanOutFileName(storeDir string, name string, fileExt string, fanOutLevels int) string {
+	if fanOutLevels == 0 {
+		return storeDir + `/` + name + `.` + fileExt
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])
+	path := storeDir
+	for i := 0; i < fanOutLevels; i++ {
+		path += `/` + hash[i*2:i*2+2]
+	}
+	return path + `/` + name + `.` + fileExt
+}
+
+// Returned when an id can not be safely turned into a file name.
+type InvalidIdError struct{
+	Id		string
+	Reason	string
+}
+
+func (e *InvalidIdError) Error() string { return `invalid id "`+e.Id+`": `+e.Reason }
+
+type fileLockTimeoutError struct{
+	timeout	time.Duration
+}
+
+func (e *fileLockTimeoutError) Error() string { return `timed out after `+e.timeout.String()+` waiting for the file store lock` }
+
+type invalidFanOutLevelsError struct{
+	levels	int
+}
+
+func (e *invalidFanOutLevelsError) Error() string { return `fan out levels must be between 0 and 32, got `+strconv.Itoa(e.levels) }
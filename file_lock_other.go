@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package sus
+
+import(
+	`os`
+	`time`
+)
+
+// flock is not available here so file stores are only safe within a single process.
+func lockFile(f *os.File, timeout time.Duration) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
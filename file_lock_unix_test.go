@@ -0,0 +1,89 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package sus
+
+import(
+	`os`
+	`fmt`
+	`time`
+	`strconv`
+	`strings`
+	`syscall`
+	`os/exec`
+	`io/ioutil`
+	`path/filepath`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+const(
+	lockHelperDirEnv	= `SUS_LOCK_HELPER_DIR`
+	lockHelperIdEnv		= `SUS_LOCK_HELPER_ID`
+	lockHelperUpdates	= 50
+)
+
+func Test_FileStore_no_lost_updates_across_processes(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	fs, _ := NewJsonFileStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, _, _ := fs.Create()
+
+	cmds := make([]*exec.Cmd, 3, 3)
+	outs := make([]*strings.Builder, 3, 3)
+	for i := range cmds {
+		cmds[i] = exec.Command(os.Args[0], `-test.run=^Test_FileStore_lock_helper$`)
+		cmds[i].Env = append(os.Environ(), lockHelperDirEnv+`=`+dir, lockHelperIdEnv+`=`+id)
+		outs[i] = &strings.Builder{}
+		cmds[i].Stdout = outs[i]
+		cmds[i].Start()
+	}
+	succeeded := 0
+	for i, cmd := range cmds {
+		err := cmd.Wait()
+		assert.Nil(t, err, `helper %d should exit cleanly`, i)
+		var n int
+		fmt.Sscanf(outs[i].String(), `succeeded %d`, &n)
+		succeeded += n
+	}
+	v, _ := fs.Read(id)
+
+	assert.True(t, succeeded > 0, `some updates should have succeeded`)
+	assert.Equal(t, succeeded, v.GetVersion(), `every successful update should be reflected in the version`)
+}
+
+// Not a real test, run as a subprocess by Test_FileStore_no_lost_updates_across_processes.
+func Test_FileStore_lock_helper(t *testing.T){
+	dir := os.Getenv(lockHelperDirEnv)
+	if dir == `` {
+		return
+	}
+	fs, _ := NewJsonFileStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id := os.Getenv(lockHelperIdEnv)
+	succeeded := 0
+	for i := 0; i < lockHelperUpdates; i++ {
+		v, err := fs.Read(id)
+		if err == nil && fs.Update(id, v) == nil {
+			succeeded++
+		}
+	}
+	fmt.Println(`succeeded ` + strconv.Itoa(succeeded))
+}
+
+func Test_FileStore_lock_timeout(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	fs, _ := NewFileStoreWithOptions(dir, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{LockTimeout: 20 * time.Millisecond})
+	id, f, _ := fs.Create()
+	other, _ := os.OpenFile(filepath.Join(dir, fileLockName), os.O_RDWR, 0600)
+	defer other.Close()
+	syscall.Flock(int(other.Fd()), syscall.LOCK_EX)
+
+	err := fs.Update(id, f)
+	syscall.Flock(int(other.Fd()), syscall.LOCK_UN)
+	unlockedErr := fs.Update(id, f)
+
+	assert.Equal(t, `timed out after 20ms waiting for the file store lock`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, 1, f.GetVersion(), `only the second update should have been applied`)
+	assert.Nil(t, unlockedErr, `unlockedErr should be nil`)
+}
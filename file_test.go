@@ -3,6 +3,11 @@ package sus
 import(
 	`os`
 	`fmt`
+	`sort`
+	`time`
+	`errors`
+	`io/ioutil`
+	`path/filepath`
 	`testing`
 	`github.com/stretchr/testify/assert`
 )
@@ -13,6 +18,8 @@ const(
 
 func Test_NewFileStore_failure(t *testing.T){
 	ffs, err := newFooFileStore(`F:\sdf.*$>?/\/\!"£$%^&)(_`, ``, nil, nil)
+	// where the directory can be created, as it can for root, remove it again.
+	defer os.RemoveAll(`F:\sdf.*$>?`)
 
 	assert.Nil(t, ffs, `ffs should be nil`)
 	assert.NotNil(t, err, `err should not be nil`)
@@ -180,6 +187,299 @@ func Test_FileStore_Read_with_unmarshaler_error(t *testing.T){
 	os.RemoveAll(_TEST_DIR)
 }
 
+func Test_FileStore_fan_out(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	fs, _ := NewFileStoreWithOptions(dir, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FanOutLevels: 2})
+
+	id, f, createErr := fs.Create()
+	updateErr := fs.Update(id, f)
+	v, readErr := fs.Read(id)
+	fanned := fanOutFileName(dir, id, `json`, 2)
+	_, statErr := os.Stat(fanned)
+	_, flatErr := os.Stat(filepath.Join(dir, id+`.json`))
+	deleteErr := fs.Delete(id)
+	_, deletedErr := fs.Read(id)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Equal(t, dir, filepath.Dir(filepath.Dir(filepath.Dir(fanned))), `the file should be two directories below dir`)
+	assert.Nil(t, statErr, `the file should be in its fanned out directory`)
+	assert.True(t, os.IsNotExist(flatErr), `the file should not be directly in dir`)
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+id+`" does not exist`, deletedErr.Error(), `deletedErr should contain expected msg`)
+}
+
+func Test_NewFileStoreWithOptions_invalid_fan_out(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStoreWithOptions(dir, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FanOutLevels: 33})
+
+	assert.Nil(t, fs, `fs should be nil`)
+	assert.Equal(t, `fan out levels must be between 0 and 32, got 33`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_MigrateFileStoreFanOut(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	flat, _ := NewJsonFileStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, fs, _ := flat.CreateMulti(3)
+	flat.Update(ids[0], fs[0])
+
+	err := MigrateFileStoreFanOut(dir, `json`, FileStoreOptions{FanOutLevels: 1})
+	againErr := MigrateFileStoreFanOut(dir, `json`, FileStoreOptions{FanOutLevels: 1})
+	fanned, _ := NewFileStoreWithOptions(dir, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FanOutLevels: 1})
+	vs, readErr := fanned.ReadMulti(ids)
+	infos, _ := ioutil.ReadDir(dir)
+	flatFiles := 0
+	for _, info := range infos {
+		if !info.IsDir() && info.Name() != fileLockName {
+			flatFiles++
+		}
+	}
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, againErr, `migrating again should do nothing`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, vs[0].GetVersion(), `vs[0]'s version should be 1`)
+	assert.Equal(t, 0, vs[2].GetVersion(), `vs[2]'s version should be 0`)
+	assert.Equal(t, 0, flatFiles, `no entity files should be left directly in dir`)
+	assert.Equal(t, `fan out levels must be between 0 and 32, got -1`, MigrateFileStoreFanOut(dir, `json`, FileStoreOptions{FanOutLevels: -1}).Error(), `invalid levels should be rejected`)
+}
+
+func Test_MigrateFileStoreFanOut_memory_file_system(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	flat, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: mfs})
+	ids, _, _ := flat.CreateMulti(2)
+	opts := FileStoreOptions{FileSystem: mfs, FanOutLevels: 1}
+
+	err := MigrateFileStoreFanOut(`store`, `json`, opts)
+	fanned, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	_, readErr := fanned.ReadMulti(ids)
+	_, flatErr := mfs.ReadFile(`store/`+ids[0]+`.json`)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.True(t, os.IsNotExist(flatErr), `the file should have been moved on the memory file system`)
+}
+
+func Test_memory_file_system_locks_exclude_each_other(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs, LockTimeout: 20 * time.Millisecond}
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	id, f, _ := fs.Create()
+	lock, _ := mfs.OpenLock(`store/`+fileLockName)
+	lock.Lock(time.Second)
+
+	err := fs.Update(id, f)
+	lock.Unlock()
+	unlockedErr := fs.Update(id, f)
+
+	assert.Equal(t, `timed out after 20ms waiting for the file store lock`, err.Error(), `err should contain expected msg`)
+	assert.Nil(t, unlockedErr, `unlockedErr should be nil`)
+}
+
+func Test_FileStore_encodes_ids(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, `store`)
+	idSrc := []string{`../../escaped`, `Case`, `case`}
+	idf := func() string {
+		id := idSrc[0]
+		idSrc = idSrc[1:]
+		return id
+	}
+	fs, _ := NewFileStoreWithOptions(store, `json`, JsonMarshaler, JsonUnmarshaler, idf, fooVersionFactory, fooEntityInitializer, FileStoreOptions{EncodeIds: true})
+
+	ids, vs, err := fs.CreateMulti(3)
+	fs.Update(ids[1], vs[1])
+	read, readErr := fs.ReadMulti(ids)
+	_, escapedErr := os.Stat(filepath.Join(dir, `escaped.json`))
+	infos, _ := ioutil.ReadDir(store)
+	decoded := map[string]bool{}
+	for _, info := range infos {
+		if info.Name() == fileLockName {
+			continue
+		}
+		if id, err := DecodeFileStoreId(info.Name()[:len(info.Name())-len(`.json`)]); err == nil {
+			decoded[id] = true
+		}
+	}
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, read[1].GetVersion(), `read[1]'s version should be 1`)
+	assert.Equal(t, 0, read[2].GetVersion(), `ids differing only in case should not collide`)
+	assert.True(t, os.IsNotExist(escapedErr), `no file should be written outside the store dir`)
+	assert.Equal(t, map[string]bool{`../../escaped`: true, `Case`: true, `case`: true}, decoded, `listing the store dir should recover the ids`)
+}
+
+func Test_FileStore_reads_stores_written_before_ids_were_encoded(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, `1.json`), []byte(`{"version":2}`), 0600)
+	fs, _ := NewJsonFileStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	v, err := fs.Read(`1`)
+	updateErr := fs.Update(`1`, v)
+	_, statErr := os.Stat(filepath.Join(dir, `1.json`))
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 3, v.GetVersion(), `the existing entity should have been read and updated`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, statErr, `the entity should still be kept in its original file`)
+}
+
+func Test_FileStore_rejects_unsafe_raw_ids(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	idf := func() string { return `../escaped` }
+	fs, _ := NewJsonFileStore(dir, idf, fooVersionFactory, fooEntityInitializer)
+
+	_, _, createErr := fs.Create()
+	_, readErr := fs.Read(`..`)
+	deleteErr := fs.Delete(``)
+	_, reservedErr := fs.Read(`.lock`)
+	_, windowsErr := fs.Read(`a:b`)
+
+	assert.Equal(t, `invalid id "../escaped": it contains a path separator or NUL`, createErr.Error(), `createErr should contain expected msg`)
+	assert.Equal(t, &InvalidIdError{`..`, `it is a relative directory name`}, readErr, `readErr should be an *InvalidIdError`)
+	assert.Equal(t, `invalid id "": it is empty`, deleteErr.Error(), `deleteErr should contain expected msg`)
+	assert.Equal(t, `invalid id ".lock": it starts with ".", which is reserved for the store's own files`, reservedErr.Error(), `reservedErr should contain expected msg`)
+	assert.Equal(t, `invalid id "a:b": it contains one of :*?"<>|`, windowsErr.Error(), `windowsErr should contain expected msg`)
+}
+
+func Test_EncodeFileStoreId_errors(t *testing.T){
+	_, emptyErr := EncodeFileStoreId(``)
+	_, longErr := EncodeFileStoreId(string(make([]byte, 160)))
+	_, decodeErr := DecodeFileStoreId(`not base32!`)
+
+	assert.Equal(t, `invalid id "": it is empty`, emptyErr.Error(), `emptyErr should contain expected msg`)
+	assert.Contains(t, longErr.Error(), `its encoding is longer than 255 bytes`, `longErr should contain expected msg`)
+	assert.NotNil(t, decodeErr, `decodeErr should not be nil`)
+}
+
+func Test_FileStore_with_memory_file_system(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	fs, err := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: mfs, FanOutLevels: 1})
+
+	id, f, createErr := fs.Create()
+	updateErr := fs.Update(id, f)
+	v, readErr := fs.Read(id)
+	deleteErr := fs.Delete(id)
+	_, deletedErr := fs.Read(id)
+	_, osErr := os.Stat(`store`)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+id+`" does not exist`, deletedErr.Error(), `deletedErr should contain expected msg`)
+	assert.True(t, os.IsNotExist(osErr), `nothing should be written to the local file system`)
+}
+
+func Test_FileStore_failed_write_leaves_entity_intact(t *testing.T){
+	ffs := &faultyFileSystem{FileSystem: NewMemoryFileSystem()}
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: ffs})
+	id, f, _ := fs.Create()
+	ffs.writeErr = diskFullErr
+
+	updateErr := fs.Update(id, f)
+	ffs.writeErr = nil
+	v, readErr := fs.Read(id)
+	infos, _ := ffs.ReadDir(`store`)
+
+	assert.Equal(t, diskFullErr, updateErr, `updateErr should be diskFullErr`)
+	assert.Equal(t, 0, f.GetVersion(), `f's version should be rolled back`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 0, v.GetVersion(), `the stored entity should be unchanged`)
+	assert.Equal(t, 1, len(infos), `no partially written file should be left behind`)
+}
+
+func Test_FileStore_file_system_errors(t *testing.T){
+	ffs := &faultyFileSystem{FileSystem: NewMemoryFileSystem()}
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: ffs})
+	id, _, _ := fs.Create()
+	ffs.readErr = os.ErrPermission
+
+	_, readErr := fs.Read(id)
+	ffs.mkdirErr = os.ErrPermission
+	_, newErr := NewFileStoreWithOptions(`other`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: ffs})
+
+	assert.Equal(t, os.ErrPermission, readErr, `readErr should be os.ErrPermission`)
+	assert.Equal(t, os.ErrPermission, newErr, `newErr should be os.ErrPermission`)
+}
+
+func Test_ListFileStoreIds(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs, FanOutLevels: 2}
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	ids, _, _ := fs.CreateMulti(3)
+	fs.Delete(ids[1])
+	mfs.WriteFile(`store/not-an-entity.json`, nil, 0600)
+
+	listed, err := ListFileStoreIds(`store`, `json`, opts)
+	_, missingErr := ListFileStoreIds(`missing`, `json`, opts)
+
+	assert.Nil(t, err, `err should be nil`)
+	expected := []string{ids[0], ids[2]}
+	sort.Strings(expected)
+	sort.Strings(listed)
+	assert.Equal(t, expected, listed, `listed should hold the remaining ids`)
+	assert.True(t, os.IsNotExist(missingErr), `listing a missing store should fail`)
+}
+
+func Test_FileStore_detects_corruption(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: mfs})
+	id, _, _ := fs.Create()
+	d, _ := mfs.ReadFile(`store/`+id+`.json`)
+	d[len(d)-2] = '9'
+	mfs.WriteFile(`store/`+id+`.json`, d, 0600)
+
+	_, err := fs.Read(id)
+	_, againErr := fs.Read(id)
+
+	assert.Equal(t, &CorruptionError{id, `checksum mismatch`}, err, `err should be a *CorruptionError`)
+	assert.Equal(t, err, againErr, `without quarantine every read should fail`)
+}
+
+func Test_FileStore_quarantines_corrupt_files(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs, FanOutLevels: 1, QuarantineCorrupt: true}
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	ids, _, _ := fs.CreateMulti(2)
+	fn := fanOutFileName(`store`, ids[0], `json`, 1)
+	mfs.WriteFile(fn, []byte(checksummedMagic), 0600)
+
+	_, err := fs.Read(ids[0])
+	_, againErr := fs.Read(ids[0])
+	quarantined, _ := mfs.ReadDir(`store/`+fileQuarantineDir)
+	listed, _ := ListFileStoreIds(`store`, `json`, opts)
+	otherErr := fs.Update(ids[1], &foo{})
+
+	assert.Equal(t, &CorruptionError{ids[0], `record is truncated`}, err, `err should be a *CorruptionError`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+ids[0]+`" does not exist`, againErr.Error(), `the corrupt file should have been moved aside`)
+	assert.Equal(t, 1, len(quarantined), `the corrupt file should be in the quarantine dir`)
+	assert.Equal(t, []string{ids[1]}, listed, `quarantined files should not be listed`)
+	assert.Nil(t, otherErr, `other entities should be unaffected`)
+}
+
+func Test_FileStore_DisableChecksums(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	fs, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: mfs, DisableChecksums: true})
+
+	id, _, _ := fs.Create()
+	d, _ := mfs.ReadFile(`store/`+id+`.json`)
+
+	assert.Equal(t, `{"version":0}`, string(d), `the record should be stored without a checksum`)
+}
+
 func newFooFileStore(dir string, fileExt string, m Marshaler, un Unmarshaler) (*fooFileStore, error) {
 	idSrc := 0
 	var err error
@@ -207,6 +507,23 @@ func newFooFileStore(dir string, fileExt string, m Marshaler, un Unmarshaler) (*
 	}, nil
 }
 
+func Test_FileStore_opens_its_lock_lazily_and_tools_close_theirs(t *testing.T){
+	lfs := &lockCountingFileSystem{FileSystem: NewMemoryFileSystem()}
+	opts := FileStoreOptions{FileSystem: lfs}
+	s, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	openAfterNew := lfs.open
+	s.Create()
+	openAfterCreate := lfs.open
+
+	VerifyFileStore(`store`, `json`, JsonUnmarshaler, fooVersionFactory, opts, false)
+	ReEncryptFileStore(`store`, `json`, opts, NewStaticKeyProvider(`k1`, map[string][]byte{`k1`: testKey1}))
+	MigrateFileStore(`store`, `json`, JsonMarshaler, JsonUnmarshaler, fooVersionFactory, opts)
+
+	assert.Equal(t, 0, openAfterNew, `the lock should not be opened until the first transaction`)
+	assert.Equal(t, 1, openAfterCreate, `the store should hold its lock open`)
+	assert.Equal(t, 1, lfs.open, `the tools should close the locks they open`)
+}
+
 type fooFileStore struct {
 	inner Store
 }
@@ -273,4 +590,60 @@ func (ffs *fooFileStore) Delete(id string) (err error) {
 
 func (ffs *fooFileStore) DeleteMulti(ids []string) (err error) {
 	return ffs.inner.DeleteMulti(ids)
-}
\ No newline at end of file
+}
+
+var diskFullErr = errors.New(`disk full`)
+
+type faultyFileSystem struct{
+	FileSystem
+	mkdirErr	error
+	readErr		error
+	writeErr	error
+}
+
+func (fs *faultyFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	if fs.mkdirErr != nil {
+		return fs.mkdirErr
+	}
+	return fs.FileSystem.MkdirAll(path, perm)
+}
+
+func (fs *faultyFileSystem) ReadFile(name string) ([]byte, error) {
+	if fs.readErr != nil {
+		return nil, fs.readErr
+	}
+	return fs.FileSystem.ReadFile(name)
+}
+
+// Writes half the data before failing, like a write hitting a full disk.
+func (fs *faultyFileSystem) WriteFile(name string, d []byte, perm os.FileMode) error {
+	if fs.writeErr != nil {
+		fs.FileSystem.WriteFile(name, d[:len(d)/2], perm)
+		return fs.writeErr
+	}
+	return fs.FileSystem.WriteFile(name, d, perm)
+}
+// Counts the locks opened and not yet closed.
+type lockCountingFileSystem struct{
+	FileSystem
+	open	int
+}
+
+func (fs *lockCountingFileSystem) OpenLock(name string) (FileLock, error) {
+	lock, err := fs.FileSystem.OpenLock(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.open++
+	return &countedFileLock{lock, fs}, nil
+}
+
+type countedFileLock struct{
+	FileLock
+	fs	*lockCountingFileSystem
+}
+
+func (l *countedFileLock) Close() error {
+	l.fs.open--
+	return l.FileLock.Close()
+}
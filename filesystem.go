@@ -0,0 +1,236 @@
+package sus
+
+import(
+	`os`
+	`sort`
+	`sync`
+	`time`
+	`io/ioutil`
+	`path/filepath`
+)
+
+// The file operations the file store needs, so it can be run against something other than the local file system or
+// have faults injected. Missing files must be reported with errors os.IsNotExist recognises.
+type FileSystem interface{
+	MkdirAll(path string, perm os.FileMode) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, d []byte, perm os.FileMode) error
+	Remove(name string) error
+	// Replaces newName with oldName, the file store relies on this being atomic to avoid leaving partially written
+	// entities behind.
+	Rename(oldName string, newName string) error
+	// Returns the entries directly within dir sorted by name.
+	ReadDir(dir string) ([]os.FileInfo, error)
+	// Opens the lock named name, creating it if need be, which the file store holds while running each transaction.
+	// Holders of the same name must exclude each other, including other processes if the file system is shared with
+	// them.
+	OpenLock(name string) (FileLock, error)
+}
+
+// An exclusive lock opened with FileSystem.OpenLock.
+type FileLock interface{
+	// Takes the lock, failing if it is not released within timeout.
+	Lock(timeout time.Duration) error
+	Unlock() error
+	Close() error
+}
+
+// Returns a FileSystem backed by the local file system.
+func NewOSFileSystem() FileSystem {
+	return osFileSystem{}
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) { return ioutil.ReadFile(name) }
+
+func (osFileSystem) WriteFile(name string, d []byte, perm os.FileMode) error { return ioutil.WriteFile(name, d, perm) }
+
+func (osFileSystem) Remove(name string) error { return os.Remove(name) }
+
+func (osFileSystem) Rename(oldName string, newName string) error { return os.Rename(oldName, newName) }
+
+func (osFileSystem) ReadDir(dir string) ([]os.FileInfo, error) { return ioutil.ReadDir(dir) }
+
+// Opens the file name as an flock, on platforms without flock the lock only excludes holders within this process.
+func (osFileSystem) OpenLock(name string) (FileLock, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &osFileLock{f}, nil
+}
+
+type osFileLock struct{
+	f	*os.File
+}
+
+func (l *osFileLock) Lock(timeout time.Duration) error { return lockFile(l.f, timeout) }
+
+func (l *osFileLock) Unlock() error { return unlockFile(l.f) }
+
+func (l *osFileLock) Close() error { return l.f.Close() }
+
+// Returns a FileSystem that keeps everything in the local system memory, paths are cleaned so "a/../b" and "b" name
+// the same file.
+func NewMemoryFileSystem() FileSystem {
+	return &memoryFileSystem{files: map[string][]byte{}, dirs: map[string]bool{`.`: true, `/`: true}, locks: map[string]chan struct{}{}}
+}
+
+type memoryFileSystem struct{
+	mtx		sync.RWMutex
+	files	map[string][]byte
+	dirs	map[string]bool
+	locks	map[string]chan struct{}
+}
+
+func (fs *memoryFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	path = filepath.Clean(path)
+	for p := path; !fs.dirs[p]; p = filepath.Dir(p) {
+		if _, isFile := fs.files[p]; isFile {
+			return &os.PathError{Op: `mkdir`, Path: path, Err: os.ErrExist}
+		}
+		fs.dirs[p] = true
+	}
+	return nil
+}
+
+func (fs *memoryFileSystem) ReadFile(name string) ([]byte, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+	d, exists := fs.files[filepath.Clean(name)]
+	if !exists {
+		return nil, &os.PathError{Op: `open`, Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte{}, d...), nil
+}
+
+func (fs *memoryFileSystem) WriteFile(name string, d []byte, perm os.FileMode) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	name = filepath.Clean(name)
+	if !fs.dirs[filepath.Dir(name)] {
+		return &os.PathError{Op: `open`, Path: name, Err: os.ErrNotExist}
+	}
+	if fs.dirs[name] {
+		return &os.PathError{Op: `open`, Path: name, Err: os.ErrExist}
+	}
+	fs.files[name] = append([]byte{}, d...)
+	return nil
+}
+
+func (fs *memoryFileSystem) Remove(name string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	name = filepath.Clean(name)
+	if _, exists := fs.files[name]; exists {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		if len(fs.children(name)) > 0 {
+			return &os.PathError{Op: `remove`, Path: name, Err: os.ErrExist}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: `remove`, Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memoryFileSystem) Rename(oldName string, newName string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	d, exists := fs.files[oldName]
+	if !exists || !fs.dirs[filepath.Dir(newName)] {
+		return &os.LinkError{Op: `rename`, Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldName)
+	fs.files[newName] = d
+	return nil
+}
+
+func (fs *memoryFileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	fs.mtx.RLock()
+	defer fs.mtx.RUnlock()
+	dir = filepath.Clean(dir)
+	if !fs.dirs[dir] {
+		return nil, &os.PathError{Op: `open`, Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.children(dir), nil
+}
+
+// Returns a lock shared by everything using fs, locks are not files so they are never listed by ReadDir.
+func (fs *memoryFileSystem) OpenLock(name string) (FileLock, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	name = filepath.Clean(name)
+	if fs.locks[name] == nil {
+		fs.locks[name] = make(chan struct{}, 1)
+	}
+	return memoryFileLock(fs.locks[name]), nil
+}
+
+// Held while it holds a value.
+type memoryFileLock chan struct{}
+
+func (l memoryFileLock) Lock(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return &fileLockTimeoutError{timeout}
+	}
+}
+
+func (l memoryFileLock) Unlock() error {
+	<-l
+	return nil
+}
+
+func (l memoryFileLock) Close() error { return nil }
+
+func (fs *memoryFileSystem) children(dir string) []os.FileInfo {
+	infos := []os.FileInfo{}
+	for name, d := range fs.files {
+		if filepath.Dir(name) == dir {
+			infos = append(infos, &memoryFileInfo{filepath.Base(name), int64(len(d)), false})
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			infos = append(infos, &memoryFileInfo{filepath.Base(name), 0, true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos
+}
+
+type memoryFileInfo struct{
+	name	string
+	size	int64
+	isDir	bool
+}
+
+func (fi *memoryFileInfo) Name() string { return fi.name }
+
+func (fi *memoryFileInfo) Size() int64 { return fi.size }
+
+func (fi *memoryFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+func (fi *memoryFileInfo) ModTime() time.Time { return time.Time{} }
+
+func (fi *memoryFileInfo) IsDir() bool { return fi.isDir }
+
+func (fi *memoryFileInfo) Sys() interface{} { return nil }
@@ -0,0 +1,53 @@
+package sus
+
+import(
+	`os`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MemoryFileSystem(t *testing.T){
+	fs := NewMemoryFileSystem()
+
+	mkdirErr := fs.MkdirAll(`store/a/b`, 0700)
+	writeErr := fs.WriteFile(`store/a/f`, []byte(`data`), 0600)
+	noDirErr := fs.WriteFile(`store/missing/f`, []byte(`data`), 0600)
+	renameErr := fs.Rename(`store/a/f`, `store/a/../g`)
+	d, readErr := fs.ReadFile(`store/g`)
+	_, renamedErr := fs.ReadFile(`store/a/f`)
+	infos, readDirErr := fs.ReadDir(`store`)
+	notEmptyErr := fs.Remove(`store/a`)
+	removeErr := fs.Remove(`store/g`)
+	_, removedErr := fs.ReadFile(`store/g`)
+	missingErr := fs.Remove(`store/g`)
+
+	assert.Nil(t, mkdirErr, `mkdirErr should be nil`)
+	assert.Nil(t, writeErr, `writeErr should be nil`)
+	assert.True(t, os.IsNotExist(noDirErr), `writing into a missing dir should fail`)
+	assert.Nil(t, renameErr, `renameErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []byte(`data`), d, `d should be the written data`)
+	assert.True(t, os.IsNotExist(renamedErr), `the renamed file should be gone`)
+	assert.Nil(t, readDirErr, `readDirErr should be nil`)
+	assert.Equal(t, 2, len(infos), `store should hold a and g`)
+	assert.Equal(t, `a`, infos[0].Name(), `infos should be sorted by name`)
+	assert.True(t, infos[0].IsDir(), `a should be a dir`)
+	assert.Equal(t, int64(4), infos[1].Size(), `g should hold 4 bytes`)
+	assert.NotNil(t, notEmptyErr, `removing a non empty dir should fail`)
+	assert.Nil(t, removeErr, `removeErr should be nil`)
+	assert.True(t, os.IsNotExist(removedErr), `the removed file should be gone`)
+	assert.True(t, os.IsNotExist(missingErr), `removing a missing file should fail`)
+}
+
+func Test_MemoryFileSystem_ReadFile_returns_a_copy(t *testing.T){
+	fs := NewMemoryFileSystem()
+	src := []byte(`data`)
+	fs.WriteFile(`f`, src, 0600)
+	src[0] = 'x'
+
+	d, _ := fs.ReadFile(`f`)
+	d[1] = 'x'
+	again, _ := fs.ReadFile(`f`)
+
+	assert.Equal(t, []byte(`data`), again, `the stored data should not be changed through either slice`)
+}
@@ -0,0 +1,533 @@
+package sus
+
+import(
+	`sort`
+	`strings`
+	`net/url`
+)
+
+const(
+	kindSeparator		= `:`
+	ancestorSeparator	= `/`
+	groupJournalName	= `.journal`
+)
+
+// Returns the ids of every entity a backend holds.
+type IdLister func() ([]string, error)
+
+// How the entities of one kind in a KindStore are created and stored.
+type EntityKind struct{
+	Marshaler			Marshaler
+	Unmarshaler			Unmarshaler
+	IdFactory			IdFactory
+	VersionFactory		VersionFactory
+	EntityInitializer	EntityInitializer
+}
+
+// Identifies an entity in a KindStore. An entity with a Parent belongs to the same entity group as it, the group of a
+// key without one, its root.
+type Key struct{
+	Kind	string
+	Id		string
+	Parent	*Key
+}
+
+// Returns the key at the top of k's parent chain.
+func (k Key) Root() Key {
+	for k.Parent != nil {
+		k = *k.Parent
+	}
+	return k
+}
+
+// Returns the id k is stored under, the kind and id of each key from the root down, joined by ":" and separated by
+// "/", with ids escaped so they can not contain "/".
+func (k Key) String() string {
+	s := k.Kind + kindSeparator + url.PathEscape(k.Id)
+	if k.Parent != nil {
+		return k.Parent.String() + ancestorSeparator + s
+	}
+	return s
+}
+
+// A store holding entities of several kinds in one backend. Ids only need to be unique among the entities of a kind
+// with the same parent. Multi operations can mix kinds and run as a single transaction, their writes to each entity
+// group are atomic on every backend whose puts are, as they are first written to a journal for the group that is
+// replayed by the next operation on the group if they are interrupted. A write that fails part way through a group's
+// journal is treated as interrupted, it fails with an error saying so and is completed by the next operation on the
+// group. Writes spanning several groups are only atomic within each one.
+type KindStore interface{
+	// Returns the Store for the root entities of kind, sharing the KindStore's backend and transactions, or nil if
+	// kind was not registered.
+	Kind(kind string) Store
+	Create(kind string) (id string, v Version, err error)
+	CreateMulti(kind string, count uint) (ids []string, vs []Version, err error)
+	// Creates new entities of kind as children of parent, all in one write to parent's group.
+	CreateChild(parent Key, kind string) (key Key, v Version, err error)
+	CreateChildMulti(parent Key, kind string, count uint) (keys []Key, vs []Version, err error)
+	Read(key Key) (v Version, err error)
+	ReadMulti(keys []Key) (vs []Version, err error)
+	Update(key Key, v Version) error
+	UpdateMulti(keys []Key, vs []Version) error
+	Delete(key Key) error
+	DeleteMulti(keys []Key) error
+	// Returns the keys of every entity below ancestor in its parent chain, in the order of their stored ids. Every id
+	// in the store is listed and sorted to find them, so it costs O(N log N) in the size of the whole store however few
+	// descendants ancestor has.
+	Descendants(ancestor Key) ([]Key, error)
+}
+
+// Creates and configures a KindStore holding the kinds of entity in kinds, keyed by name, which must be non empty and
+// not contain ":" or "/". Entities are converted to and from []byte with their kind's codec and kept with bg, bp and d
+// under the ids returned by Key.String, relying on rit to ensure versioning correctness. Each transaction checks an
+// entity group for an interrupted write the first time it touches it, which costs one extra backend read per group
+// rather than per entity. ls may be nil, in which case Descendants is not supported.
+func NewKindStore(bg ByteGetter, bp BytePutter, d Deleter, ls IdLister, kinds map[string]*EntityKind, inee IsNonExtantError, rit RunInTransaction) (KindStore, error) {
+	ks := &kindStore{
+		get: bg,
+		put: bp,
+		del: d,
+		list: ls,
+		isNonExtantError: inee,
+		kinds: make(map[string]*store, len(kinds)),
+		roots: make(map[string]Store, len(kinds)),
+		idFactories: make(map[string]IdFactory, len(kinds)),
+	}
+	// another process may have left a journal behind since the last transaction, so what was checked is forgotten at
+	// the end of each one.
+	ks.runInTransaction = func(tran Transaction) error {
+		return rit(func() error {
+			ks.checked = map[string]bool{}
+			defer func() {
+				ks.checked = nil
+			}()
+			return tran()
+		})
+	}
+	for name, k := range kinds {
+		if name == `` || strings.Contains(name, kindSeparator) || strings.Contains(name, ancestorSeparator) {
+			return nil, &invalidKindError{name}
+		}
+		name := name
+		ks.kinds[name] = NewByteStore(ks.getRecord, ks.putRecord, ks.delRecord, k.Marshaler, k.Unmarshaler, k.IdFactory, k.VersionFactory, k.EntityInitializer, inee, ks.runInTransaction).(*store)
+		root := func(id string) string { return Key{name, id, nil}.String() }
+		get := func(id string) ([]byte, error) { return ks.getRecord(root(id)) }
+		put := func(id string, data []byte) error { return ks.putRecord(root(id), data) }
+		del := func(id string) error { return ks.delRecord(root(id)) }
+		ks.roots[name] = NewByteStore(get, put, del, k.Marshaler, k.Unmarshaler, k.IdFactory, k.VersionFactory, k.EntityInitializer, inee, ks.runInTransaction)
+		ks.idFactories[name] = k.IdFactory
+	}
+	// the cross kind store is only used through ReadMulti, UpdateMulti and DeleteMulti, so never needs factories.
+	ks.mixed = NewStore(ks.getMulti, ks.putMulti, ks.deleteMulti, nil, nil, nil, inee, ks.runInTransaction).(*store)
+	return ks, nil
+}
+
+// Creates and configures a KindStore that keeps its entities in the local system memory.
+func NewMemoryKindStore(kinds map[string]*EntityKind) (KindStore, error) {
+	data := map[string][]byte{}
+	get, put, del := memoryMapByteFuncs(data)
+	list := func() ([]string, error) {
+		ids := make([]string, 0, len(data))
+		for id := range data {
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	return NewKindStore(get, put, del, list, kinds, isLocalEntityDoesNotExistError, mutexRunInTransaction())
+}
+
+// Creates and configures a KindStore that keeps its entities in storeDir, as NewFileStoreWithOptions does. Stored ids
+// contain ":" and "/" so are never used as raw file names, opts.EncodeIds is always set.
+func NewFileKindStore(storeDir string, fileExt string, kinds map[string]*EntityKind, opts FileStoreOptions) (KindStore, error) {
+	opts.EncodeIds = true
+	get, put, del, err := fileByteFuncs(storeDir, fileExt, opts)
+	if err != nil {
+		return nil, err
+	}
+	rit, _ := fileStoreRunInTransaction(storeDir, opts)
+	list := func() ([]string, error) {
+		return ListFileStoreIds(storeDir, fileExt, opts)
+	}
+	return NewKindStore(get, put, del, list, kinds, isLocalEntityDoesNotExistError, rit)
+}
+
+type kindStore struct{
+	get					ByteGetter
+	put					BytePutter
+	del					Deleter
+	list				IdLister
+	isNonExtantError	IsNonExtantError
+	runInTransaction	RunInTransaction
+	// the stores used by multi operations, which are given stored ids, and by Kind, which are given root ids.
+	kinds				map[string]*store
+	roots				map[string]Store
+	mixed				*store
+	idFactories			map[string]IdFactory
+	// while staging, writes are collected here rather than made, see journaled.
+	staging				bool
+	staged				[]*logOp
+	// the groups the current transaction has found no interrupted write in, see replayJournal.
+	checked				map[string]bool
+}
+
+func (ks *kindStore) Kind(kind string) Store {
+	return ks.roots[kind]
+}
+
+// Creates a new versioned root entity of kind.
+func (ks *kindStore) Create(kind string) (string, Version, error) {
+	if _, err := ks.store(kind); err != nil {
+		return ``, nil, err
+	}
+	return ks.roots[kind].Create()
+}
+
+// Creates a set of new versioned root entities of kind.
+func (ks *kindStore) CreateMulti(kind string, count uint) ([]string, []Version, error) {
+	if _, err := ks.store(kind); err != nil {
+		return nil, nil, err
+	}
+	return ks.roots[kind].CreateMulti(count)
+}
+
+// Creates a new versioned entity of kind as a child of parent.
+func (ks *kindStore) CreateChild(parent Key, kind string) (Key, Version, error) {
+	keys, vs, err := ks.CreateChildMulti(parent, kind, 1)
+	if len(keys) == 1 && len(vs) == 1 {
+		return keys[0], vs[0], err
+	}
+	return Key{}, nil, err
+}
+
+// Creates a set of new versioned entities of kind as children of parent.
+func (ks *kindStore) CreateChildMulti(parent Key, kind string, count uint) (keys []Key, vs []Version, err error) {
+	s, err := ks.store(kind)
+	if err != nil || count == 0 {
+		return
+	}
+	if _, err = ks.ids([]Key{parent}); err != nil {
+		return
+	}
+	err = ks.runInTransaction(func() error {
+		keys = make([]Key, count)
+		vs = make([]Version, count)
+		ids := make([]string, count)
+		for i := range keys {
+			keys[i] = Key{kind, ks.idFactories[kind](), &parent}
+			vs[i] = s.entityInitializer(s.versionFactory())
+			ids[i] = keys[i].String()
+		}
+		return ks.putMulti(ids, vs)
+	})
+	if err != nil {
+		keys, vs = nil, nil
+	}
+	return
+}
+
+// Fetches the versioned entity with key.
+func (ks *kindStore) Read(key Key) (Version, error) {
+	vs, err := ks.ReadMulti([]Key{key})
+	if len(vs) == 1 {
+		return vs[0], err
+	}
+	return nil, err
+}
+
+// Fetches the versioned entities with keys.
+func (ks *kindStore) ReadMulti(keys []Key) ([]Version, error) {
+	ids, err := ks.ids(keys)
+	if err != nil {
+		return nil, err
+	}
+	return ks.mixed.ReadMulti(ids)
+}
+
+// Updates the versioned entity with key.
+func (ks *kindStore) Update(key Key, v Version) error {
+	return ks.UpdateMulti([]Key{key}, []Version{v})
+}
+
+// Updates the versioned entities with keys.
+func (ks *kindStore) UpdateMulti(keys []Key, vs []Version) error {
+	ids, err := ks.ids(keys)
+	if err != nil {
+		return err
+	}
+	return ks.mixed.UpdateMulti(ids, vs)
+}
+
+// Deletes the versioned entity with key.
+func (ks *kindStore) Delete(key Key) error {
+	return ks.DeleteMulti([]Key{key})
+}
+
+// Deletes the versioned entities with keys.
+func (ks *kindStore) DeleteMulti(keys []Key) error {
+	ids, err := ks.ids(keys)
+	if err != nil {
+		return err
+	}
+	return ks.mixed.DeleteMulti(ids)
+}
+
+// Returns the keys of every entity below ancestor.
+func (ks *kindStore) Descendants(ancestor Key) (keys []Key, err error) {
+	if ks.list == nil {
+		return nil, &descendantsNotSupportedError{}
+	}
+	if _, err = ks.ids([]Key{ancestor}); err != nil {
+		return
+	}
+	prefix := ancestor.String() + ancestorSeparator
+	err = ks.runInTransaction(func() error {
+		if err := ks.replayJournal(groupOf(prefix)); err != nil {
+			return err
+		}
+		all, err := ks.list()
+		if err != nil {
+			return err
+		}
+		sort.Strings(all)
+		keys = []Key{}
+		for _, id := range all {
+			if !strings.HasPrefix(id, prefix) {
+				continue
+			}
+			// journals and records the store did not write do not parse.
+			if key, ok := parseKey(id); ok {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		keys = nil
+	}
+	return
+}
+
+func (ks *kindStore) store(kind string) (*store, error) {
+	s, exists := ks.kinds[kind]
+	if !exists {
+		return nil, &unknownKindError{kind}
+	}
+	return s, nil
+}
+
+// Returns the stored ids of keys, checking the kinds in their parent chains are registered.
+func (ks *kindStore) ids(keys []Key) ([]string, error) {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		for k := &key; k != nil; k = k.Parent {
+			if _, err := ks.store(k.Kind); err != nil {
+				return nil, err
+			}
+		}
+		ids[i] = key.String()
+	}
+	return ids, nil
+}
+
+func (ks *kindStore) getMulti(ids []string) ([]Version, error) {
+	vs := make([]Version, len(ids))
+	for i, id := range ids {
+		got, err := ks.storeOf(id).getMulti([]string{id})
+		if err != nil {
+			return nil, err
+		}
+		vs[i] = got[0]
+	}
+	return vs, nil
+}
+
+func (ks *kindStore) putMulti(ids []string, vs []Version) error {
+	return ks.journaled(func() error {
+		for i, id := range ids {
+			if err := ks.storeOf(id).putMulti([]string{id}, []Version{vs[i]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ks *kindStore) deleteMulti(ids []string) error {
+	return ks.journaled(func() error {
+		for _, id := range ids {
+			if err := ks.storeOf(id).deleteMulti([]string{id}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the store for the kind of the entity with the stored id.
+func (ks *kindStore) storeOf(id string) *store {
+	last := id[strings.LastIndex(id, ancestorSeparator)+1:]
+	return ks.kinds[last[:strings.Index(last, kindSeparator)]]
+}
+
+// Runs write collecting the writes it makes and then makes them, those to each entity group through the group's
+// journal if there is more than one. Once a group's journal is written its writes are not rolled back, if making them
+// fails the journal is left for the next operation on the group to complete and an *incompleteGroupWriteError is
+// returned.
+func (ks *kindStore) journaled(write func() error) error {
+	ks.staging = true
+	err := write()
+	ops := ks.staged
+	ks.staging, ks.staged = false, nil
+	if err != nil {
+		return err
+	}
+	groups := []string{}
+	byGroup := map[string][]*logOp{}
+	for _, op := range ops {
+		group := groupOf(op.id)
+		if _, exists := byGroup[group]; !exists {
+			groups = append(groups, group)
+		}
+		byGroup[group] = append(byGroup[group], op)
+	}
+	for _, group := range groups {
+		ops := byGroup[group]
+		if len(ops) == 1 {
+			if err := ks.apply(ops); err != nil {
+				return err
+			}
+			continue
+		}
+		journalId := group + ancestorSeparator + groupJournalName
+		delete(ks.checked, group)
+		if err := ks.put(journalId, encodeRecord(ops)); err != nil {
+			return err
+		}
+		if err := ks.apply(ops); err != nil {
+			return &incompleteGroupWriteError{group, err}
+		}
+		if err := ks.del(journalId); err != nil {
+			return err
+		}
+		ks.checked[group] = true
+	}
+	return nil
+}
+
+// Finishes the journaled write to group that was interrupted, if there is one and the current transaction has not
+// already checked.
+func (ks *kindStore) replayJournal(group string) error {
+	if ks.checked[group] {
+		return nil
+	}
+	journalId := group + ancestorSeparator + groupJournalName
+	d, err := ks.get(journalId)
+	if err != nil {
+		if ks.isNonExtantError(err) {
+			ks.checked[group] = true
+			return nil
+		}
+		return err
+	}
+	// a journal that does not decode was never fully written, so none of its writes were made either.
+	if ops, n := decodeRecord(d); n > 0 {
+		if err := ks.apply(ops); err != nil {
+			return err
+		}
+	}
+	if err := ks.del(journalId); err != nil {
+		return err
+	}
+	ks.checked[group] = true
+	return nil
+}
+
+func (ks *kindStore) apply(ops []*logOp) error {
+	for _, op := range ops {
+		if op.kind == deleteOp {
+			if err := ks.del(op.id); err != nil && !ks.isNonExtantError(err) {
+				return err
+			}
+		} else if err := ks.put(op.id, op.d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ks *kindStore) getRecord(id string) ([]byte, error) {
+	if err := ks.replayJournal(groupOf(id)); err != nil {
+		return nil, err
+	}
+	return ks.get(id)
+}
+
+func (ks *kindStore) putRecord(id string, d []byte) error {
+	if ks.staging {
+		ks.staged = append(ks.staged, &logOp{putOp, id, d})
+		return nil
+	}
+	if err := ks.replayJournal(groupOf(id)); err != nil {
+		return err
+	}
+	return ks.put(id, d)
+}
+
+func (ks *kindStore) delRecord(id string) error {
+	if ks.staging {
+		ks.staged = append(ks.staged, &logOp{deleteOp, id, nil})
+		return nil
+	}
+	if err := ks.replayJournal(groupOf(id)); err != nil {
+		return err
+	}
+	return ks.del(id)
+}
+
+// Returns the stored id of the root of the entity group the stored id is in.
+func groupOf(id string) string {
+	if i := strings.Index(id, ancestorSeparator); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// Parses a stored id back into a key.
+func parseKey(id string) (Key, bool) {
+	var parent *Key
+	for _, s := range strings.Split(id, ancestorSeparator) {
+		i := strings.Index(s, kindSeparator)
+		if i <= 0 {
+			return Key{}, false
+		}
+		kid, err := url.PathUnescape(s[i+len(kindSeparator):])
+		if err != nil {
+			return Key{}, false
+		}
+		parent = &Key{s[:i], kid, parent}
+	}
+	return *parent, true
+}
+
+type invalidKindError struct{
+	kind	string
+}
+
+func (e *invalidKindError) Error() string { return `invalid kind name "`+e.kind+`", it must be non empty and not contain ":" or "/"` }
+
+type unknownKindError struct{
+	kind	string
+}
+
+func (e *unknownKindError) Error() string { return `no kind is registered under "`+e.kind+`"` }
+
+type incompleteGroupWriteError struct{
+	group	string
+	inner	error
+}
+
+func (e *incompleteGroupWriteError) Error() string { return `write to entity group "`+e.group+`" failed part way and will be completed by the next operation on the group: `+e.inner.Error() }
+
+type descendantsNotSupportedError struct{}
+
+func (e *descendantsNotSupportedError) Error() string { return `store can not list its ids so does not support Descendants` }
@@ -0,0 +1,204 @@
+package sus
+
+import(
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func newTestKinds() map[string]*EntityKind {
+	return map[string]*EntityKind{
+		`foo`: {JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer},
+		`person`: {GobMarshaler, GobUnmarshaler, newFooIdFactory(), personVersionFactory, func(v Version) Version {
+			v.(*person).FullName = `new`
+			return v
+		}},
+	}
+}
+
+func Test_KindStore_namespaces_ids(t *testing.T){
+	data := map[string][]byte{}
+	get, put, del := memoryMapByteFuncs(data)
+	ks, _ := NewKindStore(get, put, del, nil, newTestKinds(), isLocalEntityDoesNotExistError, mutexRunInTransaction())
+
+	fooId, f, fooErr := ks.Create(`foo`)
+	personId, p, personErr := ks.Create(`person`)
+	readP, readErr := ks.Kind(`person`).Read(personId)
+
+	assert.Nil(t, fooErr, `fooErr should be nil`)
+	assert.Nil(t, personErr, `personErr should be nil`)
+	assert.Equal(t, `1`, fooId, `each kind should have its own ids`)
+	assert.Equal(t, `1`, personId, `each kind should have its own ids`)
+	assert.Equal(t, &foo{}, f, `f should come from the foo version factory`)
+	assert.Equal(t, &person{FullName: `new`}, p, `p should have been initialized by the person entity initializer`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, p, readP, `the kind's store should read the entity`)
+	assert.Equal(t, 2, len(data), `both entities should be stored`)
+	assert.NotNil(t, data[`foo:1`], `foo should be stored under its kind`)
+	assert.NotNil(t, data[`person:1`], `person should be stored under its kind`)
+	assert.Nil(t, ks.Kind(`missing`), `an unknown kind should have no store`)
+}
+
+func Test_KindStore_multi_operations_span_kinds(t *testing.T){
+	ks, _ := NewMemoryKindStore(newTestKinds())
+	fooId, f, _ := ks.Create(`foo`)
+	personId, p, _ := ks.Create(`person`)
+	keys := []Key{{`foo`, fooId, nil}, {`person`, personId, nil}}
+
+	updateErr := ks.UpdateMulti(keys, []Version{f, p})
+	vs, readErr := ks.ReadMulti(keys)
+	staleErr := ks.UpdateMulti(keys, []Version{&foo{Version: 1}, &person{}})
+	afterStale, _ := ks.ReadMulti(keys)
+	deleteErr := ks.DeleteMulti(keys)
+	_, readDeletedErr := ks.Read(keys[1])
+
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []Version{&foo{Version: 1}, &person{1, `new`, ``}}, vs, `both kinds should have been updated`)
+	assert.Equal(t, `nonsequential update for entity with id "person:1"`, staleErr.Error(), `staleErr should contain expected msg`)
+	assert.Equal(t, vs, afterStale, `nothing should have been written by the stale update`)
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "person:1" does not exist`, readDeletedErr.Error(), `readDeletedErr should contain expected msg`)
+}
+
+func Test_KindStore_errors(t *testing.T){
+	_, emptyErr := NewMemoryKindStore(map[string]*EntityKind{``: {}})
+	_, separatorErr := NewMemoryKindStore(map[string]*EntityKind{`a:b`: {}})
+	ks, _ := NewMemoryKindStore(newTestKinds())
+	_, _, createErr := ks.Create(`missing`)
+	_, readErr := ks.Read(Key{`missing`, `1`, nil})
+
+	assert.Equal(t, `invalid kind name "", it must be non empty and not contain ":" or "/"`, emptyErr.Error(), `emptyErr should contain expected msg`)
+	assert.Equal(t, `invalid kind name "a:b", it must be non empty and not contain ":" or "/"`, separatorErr.Error(), `separatorErr should contain expected msg`)
+	assert.Equal(t, `no kind is registered under "missing"`, createErr.Error(), `createErr should contain expected msg`)
+	assert.Equal(t, `no kind is registered under "missing"`, readErr.Error(), `readErr should contain expected msg`)
+}
+
+func Test_NewFileKindStore(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs}
+	ks, _ := NewFileKindStore(`store`, `dat`, newTestKinds(), opts)
+	personId, _, _ := ks.Create(`person`)
+	fooId, _, _ := ks.Create(`foo`)
+	_, rawErr := mfs.ReadFile(`store/person:` + personId + `.dat`)
+	name, _ := EncodeFileStoreId(`person:` + personId)
+	_, encodedErr := mfs.ReadFile(`store/` + name + `.dat`)
+
+	again, err := NewFileKindStore(`store`, `dat`, newTestKinds(), opts)
+	vs, readErr := again.ReadMulti([]Key{{`person`, personId, nil}, {`foo`, fooId, nil}})
+	ids, _ := ListFileStoreIds(`store`, `dat`, opts)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []Version{&person{FullName: `new`}, &foo{}}, vs, `the entities should be read back`)
+	assert.Equal(t, 2, len(ids), `both entities should be in the one store`)
+	assert.NotNil(t, rawErr, `stored ids should never be used as raw file names`)
+	assert.Nil(t, encodedErr, `files should be named with the encoded stored ids`)
+}
+
+func Test_Key(t *testing.T){
+	parent := &Key{`foo`, `a/b%`, nil}
+	key := Key{`person`, `1`, parent}
+
+	parsed, ok := parseKey(key.String())
+	_, journalOk := parseKey(`foo:1/` + groupJournalName)
+
+	assert.Equal(t, `foo:a%2Fb%25/person:1`, key.String(), `the key should be stored under its escaped parent chain`)
+	assert.Equal(t, *parent, key.Root(), `the root should be the top of the parent chain`)
+	assert.True(t, ok, `the stored id should parse`)
+	assert.Equal(t, key, parsed, `the stored id should parse back into the key`)
+	assert.False(t, journalOk, `a journal id should not parse`)
+}
+
+func Test_KindStore_Descendants(t *testing.T){
+	ks, _ := NewMemoryKindStore(newTestKinds())
+	parentId, _, _ := ks.Create(`foo`)
+	otherId, _, _ := ks.Create(`foo`)
+	parent := Key{`foo`, parentId, nil}
+	children, _, createErr := ks.CreateChildMulti(parent, `person`, 2)
+	grandchild, _, _ := ks.CreateChild(children[1], `foo`)
+	ks.CreateChild(Key{`foo`, otherId, nil}, `person`)
+
+	descendants, err := ks.Descendants(parent)
+	childDescendants, _ := ks.Descendants(children[1])
+	vs, readErr := ks.ReadMulti(append(descendants, parent))
+	_, unsupportedErr := (&kindStore{}).Descendants(parent)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Equal(t, &parent, children[0].Parent, `the children should have parent as their parent`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, []Key{children[0], children[1], grandchild}, descendants, `every entity below parent should be found`)
+	assert.Equal(t, []Key{grandchild}, childDescendants, `only the grandchild should be below the second child`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []Version{&person{FullName: `new`}, &person{FullName: `new`}, &foo{}, &foo{}}, vs, `the descendants should be readable`)
+	assert.Equal(t, `store can not list its ids so does not support Descendants`, unsupportedErr.Error(), `unsupportedErr should contain expected msg`)
+}
+
+func Test_KindStore_group_writes_are_atomic(t *testing.T){
+	data := map[string][]byte{}
+	get, put, del := memoryMapByteFuncs(data)
+	failAt := -1
+	flakyPut := func(id string, d []byte) error {
+		if failAt--; failAt == 0 {
+			return diskFullErr
+		}
+		return put(id, d)
+	}
+	ks, _ := NewKindStore(get, flakyPut, del, nil, newTestKinds(), isLocalEntityDoesNotExistError, mutexRunInTransaction())
+	parentId, parentV, _ := ks.Create(`foo`)
+	parent := Key{`foo`, parentId, nil}
+	child, childV, _ := ks.CreateChild(parent, `person`)
+
+	// the journal and the parent are written, then the child's write fails.
+	failAt = 3
+	updateErr := ks.UpdateMulti([]Key{parent, child}, []Version{parentV, childV})
+	_, journalled := data[`foo:1/`+groupJournalName]
+	vs, readErr := ks.ReadMulti([]Key{parent, child})
+	_, replayed := data[`foo:1/`+groupJournalName]
+	data[`foo:1/`+groupJournalName] = []byte(`torn`)
+	_, tornErr := ks.Read(child)
+	_, dropped := data[`foo:1/`+groupJournalName]
+
+	assert.Equal(t, `write to entity group "foo:1" failed part way and will be completed by the next operation on the group: `+diskFullErr.Error(), updateErr.Error(), `updateErr should say the write will be completed`)
+	assert.True(t, journalled, `the journal should be left behind`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []Version{&foo{Version: 1}, &person{1, `new`, ``}}, vs, `the next operation on the group should have finished the write`)
+	assert.False(t, replayed, `the journal should be removed once replayed`)
+	assert.Nil(t, tornErr, `tornErr should be nil`)
+	assert.False(t, dropped, `a torn journal should be dropped`)
+}
+
+func Test_KindStore_checks_each_group_for_a_journal_once_per_transaction(t *testing.T){
+	get, put, del := memoryByteFuncs()
+	reads := 0
+	countingGet := func(id string) ([]byte, error) {
+		reads++
+		return get(id)
+	}
+	ks, _ := NewKindStore(countingGet, put, del, nil, newTestKinds(), isLocalEntityDoesNotExistError, mutexRunInTransaction())
+	parentId, _, _ := ks.Create(`foo`)
+	parent := Key{`foo`, parentId, nil}
+	child, _, _ := ks.CreateChild(parent, `person`)
+
+	reads = 0
+	_, err := ks.ReadMulti([]Key{parent, child})
+	groupReads := reads
+	reads = 0
+	ks.Read(parent)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 3, groupReads, `the group's journal should be read once along with both entities`)
+	assert.Equal(t, 2, reads, `the next transaction should check the group again`)
+}
+
+func Test_NewFileKindStore_Descendants(t *testing.T){
+	opts := FileStoreOptions{FileSystem: NewMemoryFileSystem(), FanOutLevels: 1}
+	ks, _ := NewFileKindStore(`store`, `dat`, newTestKinds(), opts)
+	parentId, _, _ := ks.Create(`foo`)
+	parent := Key{`foo`, parentId, nil}
+	children, _, _ := ks.CreateChildMulti(parent, `person`, 2)
+
+	descendants, err := ks.Descendants(parent)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, children, descendants, `the children should be found`)
+}
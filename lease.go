@@ -0,0 +1,252 @@
+package sus
+
+import(
+	`time`
+	`crypto/rand`
+	`encoding/hex`
+	`encoding/binary`
+)
+
+const(
+	leaseKeyPrefix		= `.lease.`
+	leaseTokenIdLen		= 32
+)
+
+// Returns the current time, injectable so lease expiry can be tested.
+type Clock func() time.Time
+
+// A store whose entities can be checked out for exclusive use.
+type LeaseStore interface{
+	Store
+	// Takes an exclusive lease on the entity with id for the duration d, returning the token that identifies it.
+	// Fails if anyone else holds an unexpired lease on it.
+	Checkout(id string, d time.Duration) (token string, err error)
+	// Extends the lease identified by token to expire d from now, provided nobody else has since taken it.
+	Renew(token string, d time.Duration) error
+	// Gives up the lease identified by token.
+	Release(token string) error
+	// Returns a view of the store that updates and deletes as the holder of the lease identified by token, writes
+	// through the LeaseStore itself act as nobody's and are rejected for any entity under an unexpired lease.
+	WithLease(token string) Store
+}
+
+// Creates and configures a lease store that stores entities by converting them to and from json []byte data and keeps
+// them in the local system memory.
+func NewJsonMemoryLeaseStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) LeaseStore {
+	return NewMemoryLeaseStore(JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a lease store that stores entities by converting them to and from []byte and keeps them in
+// the local system memory.
+func NewMemoryLeaseStore(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) LeaseStore {
+	get, put, del := memoryByteFuncs()
+	return NewLeaseStore(get, put, del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, time.Now, mutexRunInTransaction())
+}
+
+// Creates and configures a lease store that stores entities by converting them to and from json []byte data and keeps
+// them in the local file system.
+func NewJsonFileLeaseStore(storeDir string, idf IdFactory, vf VersionFactory, ei EntityInitializer) (LeaseStore, error) {
+	return NewFileLeaseStore(storeDir, `json`, JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a lease store that stores entities by converting them to and from []byte and keeps them in
+// the local file system, locked with the store's lock file so leases exclude other processes using the same storeDir.
+func NewFileLeaseStore(storeDir string, fileExt string, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) (LeaseStore, error) {
+	return NewFileLeaseStoreWithOptions(storeDir, fileExt, m, un, idf, vf, ei, FileStoreOptions{})
+}
+
+// Creates and configures a lease store as NewFileLeaseStore does, keeping its files as a file store opened with opts
+// would, see NewFileStoreWithOptions.
+func NewFileLeaseStoreWithOptions(storeDir string, fileExt string, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, opts FileStoreOptions) (LeaseStore, error) {
+	get, put, del, err := fileByteFuncs(storeDir, fileExt, opts)
+	if err != nil {
+		return nil, err
+	}
+	rit, _ := fileStoreRunInTransaction(storeDir, opts)
+	return NewLeaseStoreWithOptions(get, put, del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, time.Now, rit, ByteStoreOptions{opts.Registry}), nil
+}
+
+// Creates and configures a lease store that stores entities by converting them to and from []byte. Leases are kept
+// alongside the entities under the reserved ids ".lease.<id>" so they are exactly as durable as the entities
+// themselves, ids from idf must not start with ".lease.", and are removed along with them. Leases expire according to
+// clock. Every operation runs in rit, leases only exclude the users of the store that rit excludes.
+func NewLeaseStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, clock Clock, rit RunInTransaction) LeaseStore {
+	return NewLeaseStoreWithOptions(bg, bp, d, m, un, idf, vf, ei, inee, clock, rit, ByteStoreOptions{})
+}
+
+// Creates and configures a lease store as NewLeaseStore does, decoding enveloped records with the codecs and types in
+// opts.Registry, see NewByteStoreWithOptions.
+func NewLeaseStoreWithOptions(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, clock Clock, rit RunInTransaction, opts ByteStoreOptions) LeaseStore {
+	s := &leaseStore{
+		get: bg,
+		put: bp,
+		del: d,
+		marshaler: m,
+		unmarshaler: un,
+		idFactory: idf,
+		versionFactory: vf,
+		entityInitializer: ei,
+		isNonExtantError: inee,
+		clock: clock,
+		runInTransaction: rit,
+		options: opts,
+	}
+	s.Store = s.view(``)
+	return s
+}
+
+type leaseStore struct{
+	Store
+	get					ByteGetter
+	put					BytePutter
+	del					Deleter
+	marshaler			Marshaler
+	unmarshaler			Unmarshaler
+	idFactory			IdFactory
+	versionFactory		VersionFactory
+	entityInitializer	EntityInitializer
+	isNonExtantError	IsNonExtantError
+	clock				Clock
+	runInTransaction	RunInTransaction
+	options				ByteStoreOptions
+}
+
+// Takes an exclusive lease on the entity with id for the duration d.
+func (s *leaseStore) Checkout(id string, d time.Duration) (string, error) {
+	token := ``
+	err := s.runInTransaction(func() error {
+		if _, err := s.get(id); err != nil {
+			if s.isNonExtantError(err) {
+				err = &nonExtantError{err}
+			}
+			return err
+		}
+		if _, err := s.heldBy(id, ``); err != nil {
+			return err
+		}
+		b := make([]byte, leaseTokenIdLen/2)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		token = hex.EncodeToString(b) + `.` + id
+		return s.writeLease(id, token, d)
+	})
+	if err != nil {
+		return ``, err
+	}
+	return token, nil
+}
+
+// Extends the lease identified by token to expire d from now.
+func (s *leaseStore) Renew(token string, d time.Duration) error {
+	return s.runInTransaction(func() error {
+		id, err := s.checkToken(token)
+		if err != nil {
+			return err
+		}
+		return s.writeLease(id, token, d)
+	})
+}
+
+// Gives up the lease identified by token.
+func (s *leaseStore) Release(token string) error {
+	return s.runInTransaction(func() error {
+		id, err := s.checkToken(token)
+		if err != nil {
+			return err
+		}
+		return s.del(leaseKeyPrefix + id)
+	})
+}
+
+// Returns a view of the store that updates and deletes as the holder of the lease identified by token.
+func (s *leaseStore) WithLease(token string) Store {
+	return s.view(token)
+}
+
+// Runs fn as an interactive transaction that holds no lease, so its writes to leased entities are rejected.
+func (s *leaseStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+// Builds a store whose writes are checked against the leases as the holder of token.
+func (s *leaseStore) view(token string) Store {
+	check := func(ids []string) error {
+		for _, id := range ids {
+			if _, err := s.heldBy(id, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	del := func(id string) error {
+		if err := s.del(id); err != nil {
+			return err
+		}
+		// the lease goes with its entity, so a later entity reusing the id starts out free.
+		if _, err := s.get(leaseKeyPrefix + id); err != nil {
+			if s.isNonExtantError(err) {
+				return nil
+			}
+			return err
+		}
+		return s.del(leaseKeyPrefix + id)
+	}
+	return newCheckedByteStore(s.get, s.put, del, s.marshaler, s.unmarshaler, s.idFactory, s.versionFactory, s.entityInitializer, s.isNonExtantError, s.runInTransaction, s.options, check)
+}
+
+// Fails if the entity with id is under an unexpired lease other than the one identified by token, otherwise returns
+// the token of the lease on it, if any.
+func (s *leaseStore) heldBy(id string, token string) (string, error) {
+	d, err := s.get(leaseKeyPrefix + id)
+	if err != nil {
+		if s.isNonExtantError(err) {
+			return ``, nil
+		}
+		return ``, err
+	}
+	if len(d) < 8 {
+		return ``, &corruptLeaseError{id}
+	}
+	holder := string(d[8:])
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(d[:8])))
+	if holder != token && s.clock().Before(expires) {
+		return ``, &leasedEntityError{id}
+	}
+	return holder, nil
+}
+
+// Returns the id token leases if the lease on it is still identified by token.
+func (s *leaseStore) checkToken(token string) (string, error) {
+	if len(token) <= leaseTokenIdLen || token[leaseTokenIdLen] != '.' {
+		return ``, &leaseNotHeldError{}
+	}
+	id := token[leaseTokenIdLen+1:]
+	holder, err := s.heldBy(id, token)
+	if _, leased := err.(*leasedEntityError); leased || (err == nil && holder != token) {
+		return ``, &leaseNotHeldError{}
+	}
+	return id, err
+}
+
+func (s *leaseStore) writeLease(id string, token string, d time.Duration) error {
+	b := make([]byte, 8, 8+len(token))
+	binary.BigEndian.PutUint64(b, uint64(s.clock().Add(d).UnixNano()))
+	return s.put(leaseKeyPrefix + id, append(b, token...))
+}
+
+type leasedEntityError struct{
+	id	string
+}
+
+func (e *leasedEntityError) Error() string { return `entity with id "`+e.id+`" is checked out under another lease` }
+
+type leaseNotHeldError struct{}
+
+func (e *leaseNotHeldError) Error() string { return `lease is not held` }
+
+type corruptLeaseError struct{
+	id	string
+}
+
+func (e *corruptLeaseError) Error() string { return `lease record for entity with id "`+e.id+`" is corrupt` }
@@ -0,0 +1,173 @@
+package sus
+
+import(
+	`os`
+	`sync`
+	`time`
+	`io/ioutil`
+	`path/filepath`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_LeaseStore_Checkout_blocks_other_writers(t *testing.T){
+	s, _ := newFooLeaseStore()
+	id, f, _ := s.Create()
+
+	token, err := s.Checkout(id, time.Minute)
+	updateErr := s.Update(id, f)
+	staleErr := s.Update(id, &foo{Version: 5})
+	deleteErr := s.Delete(id)
+	_, checkoutErr := s.Checkout(id, time.Minute)
+	v, readErr := s.Read(id)
+	holderErr := s.WithLease(token).Update(id, v)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, updateErr.Error(), `updateErr should contain expected msg`)
+	assert.Equal(t, 0, f.GetVersion(), `f's version should be unchanged`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, staleErr.Error(), `leases should be checked before versions`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, deleteErr.Error(), `deleteErr should contain expected msg`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, checkoutErr.Error(), `checkoutErr should contain expected msg`)
+	assert.Nil(t, readErr, `reads should not be blocked`)
+	assert.Nil(t, holderErr, `the lease holder should be able to update`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+}
+
+func Test_LeaseStore_Release(t *testing.T){
+	s, _ := newFooLeaseStore()
+	id, f, _ := s.Create()
+	token, _ := s.Checkout(id, time.Minute)
+
+	err := s.Release(token)
+	updateErr := s.Update(id, f)
+	releaseAgainErr := s.Release(token)
+	otherToken, checkoutErr := s.Checkout(id, time.Minute)
+	staleHolderErr := s.WithLease(token).Delete(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Equal(t, `lease is not held`, releaseAgainErr.Error(), `releaseAgainErr should contain expected msg`)
+	assert.Nil(t, checkoutErr, `checkoutErr should be nil`)
+	assert.NotEqual(t, token, otherToken, `tokens should be unique`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, staleHolderErr.Error(), `staleHolderErr should contain expected msg`)
+}
+
+func Test_LeaseStore_expiry_and_Renew(t *testing.T){
+	s, clock := newFooLeaseStore()
+	id, f, _ := s.Create()
+	token, _ := s.Checkout(id, time.Minute)
+
+	*clock = clock.Add(30 * time.Second)
+	renewErr := s.Renew(token, time.Minute)
+	*clock = clock.Add(45 * time.Second)
+	stillLeasedErr := s.Update(id, f)
+	*clock = clock.Add(30 * time.Second)
+	expiredErr := s.Update(id, f)
+	otherToken, _ := s.Checkout(id, time.Minute)
+	lostRenewErr := s.Renew(token, time.Minute)
+	lostReleaseErr := s.Release(token)
+
+	assert.Nil(t, renewErr, `renewErr should be nil`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, stillLeasedErr.Error(), `the renewed lease should not have expired yet`)
+	assert.Nil(t, expiredErr, `an expired lease should not block writes`)
+	assert.NotEqual(t, ``, otherToken, `an expired lease can be taken over`)
+	assert.Equal(t, `lease is not held`, lostRenewErr.Error(), `lostRenewErr should contain expected msg`)
+	assert.Equal(t, `lease is not held`, lostReleaseErr.Error(), `lostReleaseErr should contain expected msg`)
+}
+
+func Test_LeaseStore_errors(t *testing.T){
+	s, _ := newFooLeaseStore()
+
+	_, checkoutErr := s.Checkout(`a_fake_id`, time.Minute)
+	badTokenErr := s.Renew(`nonsense`, time.Minute)
+
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, checkoutErr.Error(), `checkoutErr should contain expected msg`)
+	assert.Equal(t, `lease is not held`, badTokenErr.Error(), `badTokenErr should contain expected msg`)
+}
+
+func Test_FileLeaseStore_leases_survive_restarts(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	s, _ := NewJsonFileLeaseStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	token, _ := s.Checkout(id, time.Minute)
+
+	reopened, err := NewJsonFileLeaseStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	updateErr := reopened.Update(id, f)
+	holderErr := reopened.WithLease(token).Update(id, f)
+	releaseErr := reopened.Release(token)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, `entity with id "`+id+`" is checked out under another lease`, updateErr.Error(), `updateErr should contain expected msg`)
+	assert.Nil(t, holderErr, `holderErr should be nil`)
+	assert.Nil(t, releaseErr, `releaseErr should be nil`)
+}
+
+func Test_FileLeaseStore_concurrent_checkouts_across_stores(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	s, _ := NewJsonFileLeaseStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, _, _ := s.Create()
+	wg := sync.WaitGroup{}
+	mtx := sync.Mutex{}
+	acquired := 0
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each store opens its own lock file handle, as another process would.
+			other, _ := NewJsonFileLeaseStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+			if _, err := other.Checkout(id, time.Minute); err == nil {
+				mtx.Lock()
+				acquired++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, acquired, `exactly one store should have acquired the lease`)
+}
+
+func Test_FileLeaseStore_uses_its_options(t *testing.T){
+	fs := NewMemoryFileSystem()
+	s, _ := NewFileLeaseStoreWithOptions(`leases`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: fs, EncodeIds: true})
+	id, _, _ := s.Create()
+
+	_, err := s.Checkout(id, time.Minute)
+	name, _ := EncodeFileStoreId(leaseKeyPrefix + id)
+	_, readErr := fs.ReadFile(filepath.Join(`leases`, name+`.json`))
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `the lease should be kept on the given file system under its encoded id`)
+}
+
+func Test_LeaseStore_Delete_removes_the_lease(t *testing.T){
+	s, _ := newFooLeaseStore()
+	id, _, _ := s.Create()
+	token, _ := s.Checkout(id, time.Minute)
+
+	err := s.WithLease(token).Delete(id)
+	_, leaseErr := s.(*leaseStore).get(leaseKeyPrefix + id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.True(t, isLocalEntityDoesNotExistError(leaseErr), `the lease record should have been removed with its entity`)
+}
+
+func Test_MemoryLeaseStore(t *testing.T){
+	s := NewJsonMemoryLeaseStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	token, _ := s.Checkout(id, time.Minute)
+
+	err := s.WithLease(token).Update(id, f)
+
+	assert.Nil(t, err, `err should be nil`)
+}
+
+func newFooLeaseStore() (LeaseStore, *time.Time) {
+	now := time.Unix(1000, 0)
+	get, put, del := memoryByteFuncs()
+	s := NewLeaseStore(get, put, del, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, func() time.Time { return now }, mutexRunInTransaction())
+	return s, &now
+}
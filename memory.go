@@ -1,25 +1,51 @@
 package sus
 
-import(
-	`encoding/json`
-)
+// Creates and configures a store that stores entities by converting them to and from json []byte data and keeps them in the local system memory.
+func NewJsonMemoryStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) Store {
+	return NewMemoryStore(JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
 
-func jsonMarshaler(v Version)([]byte, error){
-	return json.Marshal(v)
+// Creates and configures a store that stores entities by converting them to and from gob []byte data and keeps them in the local system memory.
+func NewGobMemoryStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) Store {
+	return NewMemoryStore(GobMarshaler, GobUnmarshaler, idf, vf, ei)
 }
 
-func jsonUnmarshaler(d []byte, v Version) error{
-	return json.Unmarshal(d, v)
+// Creates and configures a store that stores entities by converting them to and from xml []byte data and keeps them in the local system memory.
+func NewXmlMemoryStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) Store {
+	return NewMemoryStore(XmlMarshaler, XmlUnmarshaler, idf, vf, ei)
 }
 
-// Creates and configures a store that stores entities by converting them to and from json []byte data and keeps them in the local system memory.
-func NewJsonMemoryStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) Store {
-	return NewMemoryStore(jsonMarshaler, jsonUnmarshaler, idf, vf, ei)
+// Creates and configures a store that stores entities by converting them to and from compact binary []byte data, see BinaryMarshaler, and keeps them in the local system memory.
+func NewBinaryMemoryStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) Store {
+	return NewMemoryStore(BinaryMarshaler, BinaryUnmarshaler, idf, vf, ei)
 }
 
 // Creates and configures a store that stores entities by converting them to and from []byte and keeps them in the local system memory.
 func NewMemoryStore(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) Store {
-	store := map[string][]byte{}
+	return NewMemoryStoreWithOptions(m, un, idf, vf, ei, ByteStoreOptions{})
+}
+
+// Creates and configures a store as NewMemoryStore does, decoding enveloped records as NewByteStoreWithOptions does.
+func NewMemoryStoreWithOptions(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, opts ByteStoreOptions) Store {
+	data := map[string][]byte{}
+	get, put, del := memoryMapByteFuncs(data)
+	rit := mutexRunInTransaction()
+
+	return &verifiableStore{
+		Store: NewByteStoreWithOptions(get, put, del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, rit, opts),
+		verifyFn: func(repair bool) (*VerifyReport, error) {
+			return verifyMemoryStore(data, un, vf, opts.Registry, rit)
+		},
+	}
+}
+
+// Returns functions that keep []byte data in a map, callers must serialize access to them.
+func memoryByteFuncs() (ByteGetter, BytePutter, Deleter) {
+	return memoryMapByteFuncs(map[string][]byte{})
+}
+
+// Returns functions that keep []byte data in store, callers must serialize access to them.
+func memoryMapByteFuncs(store map[string][]byte) (ByteGetter, BytePutter, Deleter) {
 
 	get := func(id string) ([]byte, error) {
 		var err error
@@ -40,10 +66,77 @@ func NewMemoryStore(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactor
 		return nil
 	}
 
-	isNonExtantError := func(err error) bool {
-		_, ok := err.(localEntityDoesNotExistError)
-		return ok
+	return get, put, del
+}
+
+// A map of []byte data whose puts and deletes are staged during a transaction and only applied once it commits.
+type stagedMap struct{
+	data		map[string][]byte
+	pending		[]*logOp
+	pendingIdx	map[string]*logOp
+}
+
+func newStagedMap() *stagedMap {
+	return &stagedMap{data: map[string][]byte{}}
+}
+
+func (m *stagedMap) get(id string) ([]byte, error) {
+	if op, exists := m.pendingIdx[id]; exists {
+		if op.kind == deleteOp {
+			return nil, localEntityDoesNotExistError{id}
+		}
+		return op.d, nil
+	}
+	d, exists := m.data[id]
+	if !exists {
+		return nil, localEntityDoesNotExistError{id}
+	}
+	return d, nil
+}
+
+func (m *stagedMap) put(id string, d []byte) error {
+	m.stage(&logOp{putOp, id, d})
+	return nil
+}
+
+func (m *stagedMap) del(id string) error {
+	m.stage(&logOp{deleteOp, id, nil})
+	return nil
+}
+
+func (m *stagedMap) stage(op *logOp) {
+	if m.pendingIdx == nil {
+		m.pendingIdx = map[string]*logOp{}
 	}
+	m.pending = append(m.pending, op)
+	m.pendingIdx[op.id] = op
+}
 
-	return NewMutexByteStore(get, put, del, m, un, idf, vf, ei, isNonExtantError)
-}
\ No newline at end of file
+// Applies and clears the staged ops, returning them.
+func (m *stagedMap) commit() []*logOp {
+	ops := m.pending
+	applyOps(m.data, ops)
+	m.rollback()
+	return ops
+}
+
+// Discards the staged ops.
+func (m *stagedMap) rollback() {
+	m.pending = nil
+	m.pendingIdx = nil
+}
+
+func applyOps(data map[string][]byte, ops []*logOp) {
+	for _, op := range ops {
+		if op.kind == deleteOp {
+			delete(data, op.id)
+		} else {
+			data[op.id] = op.d
+		}
+	}
+}
+
+func isLocalEntityDoesNotExistError(err error) bool {
+	_, ok := err.(localEntityDoesNotExistError)
+	return ok
+}
@@ -0,0 +1,118 @@
+package sus
+
+import(
+	`strconv`
+)
+
+type schemaMigrations struct{
+	writeBack	bool
+	steps		[]Migration
+}
+
+// Brings dst, just decoded from a record written at an older schema version, up to the next version. payload is the
+// record's payload as it was stored, so values the older schema kept under other names or types can be read from it,
+// every migration of a record is given the same payload.
+type Migration func(payload []byte, dst Version) error
+
+// Returns an Unmarshaler that decodes records written without an envelope, from before schema was versioned, with un
+// and then applies every migration of schema registered in r to them, as records at version 0. Enveloped records are
+// decoded as usual, with r.
+func NewUnversionedUnmarshaler(r *Registry, un Unmarshaler, schema string) Unmarshaler {
+	return func(data []byte, dst Version) error {
+		if IsEnvelope(data) {
+			return unmarshalRecord(r, un, data, dst)
+		}
+		if err := un(data, dst); err != nil {
+			return err
+		}
+		return r.migrate(schema, 0, data, dst)
+	}
+}
+
+// Rewrites the records with ids that are not enveloped at the current version of their schema with m after decoding,
+// and so migrating, them with un and the codecs, migrations and types in r, each in its own run of rit, returning how many
+// were rewritten. m should write envelopes at the current schema version, un is usually a NewUnversionedUnmarshaler so
+// records from before schemas were versioned are upgraded too. Versions are unchanged and ids that no longer exist are
+// skipped, as are the ids stores reserve for their own records.
+func Migrate(r *Registry, ids []string, bg ByteGetter, bp BytePutter, m Marshaler, un Unmarshaler, vf VersionFactory, inee IsNonExtantError, rit RunInTransaction) (int, error) {
+	rewritten := 0
+	for _, id := range ids {
+		if isReservedId(id) {
+			continue
+		}
+		err := rit(func() error {
+			data, err := bg(id)
+			if err != nil {
+				if inee(err) {
+					return nil
+				}
+				return err
+			}
+			if IsEnvelope(data) && !r.hasPendingMigrations(data, false) {
+				return nil
+			}
+			v := newRecordVersion(r, vf, data)
+			if err := unmarshalRecord(r, un, data, v); err != nil {
+				return err
+			}
+			d, err := m(v)
+			if err != nil {
+				return err
+			}
+			rewritten++
+			return bp(id, keepEnvelopeCreated(data, d))
+		})
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+// Runs Migrate over every entity in the file store in storeDir opened with opts, with opts.Registry, taking the store's
+// lock for each one.
+func MigrateFileStore(storeDir string, fileExt string, m Marshaler, un Unmarshaler, vf VersionFactory, opts FileStoreOptions) (int, error) {
+	ids, err := ListFileStoreIds(storeDir, fileExt, opts)
+	if err != nil {
+		return 0, err
+	}
+	get, put, _, err := fileByteFuncs(storeDir, fileExt, opts)
+	if err != nil {
+		return 0, err
+	}
+	rit, closeLock := fileStoreRunInTransaction(storeDir, opts)
+	defer closeLock()
+	return Migrate(opts.Registry, ids, get, put, m, un, vf, isLocalEntityDoesNotExistError, rit)
+}
+
+// Applies the migrations of schema from version onwards to dst, decoded from payload.
+func (r *Registry) migrate(schema string, version uint64, payload []byte, dst Version) error {
+	sm := r.schemaMigrations(schema)
+	for v := version; v < uint64(len(sm.steps)); v++ {
+		if err := sm.steps[v](payload, dst); err != nil {
+			return &migrationError{schema, v, err}
+		}
+	}
+	return nil
+}
+
+// Whether d is an envelope whose schema has migrations past its version, registered with write back if writeBack.
+func (r *Registry) hasPendingMigrations(d []byte, writeBack bool) bool {
+	if !IsEnvelope(d) {
+		return false
+	}
+	e, err := DecodeEnvelope(d)
+	if err != nil {
+		return false
+	}
+	sm := r.schemaMigrations(e.Schema)
+	return (sm.writeBack || !writeBack) && e.SchemaVersion < uint64(len(sm.steps))
+}
+
+type migrationError struct{
+	schema	string
+	from	uint64
+	inner	error
+}
+
+func (e *migrationError) Error() string { return `migrating schema "`+e.schema+`" from version `+strconv.FormatUint(e.from, 10)+` failed: `+e.inner.Error() }
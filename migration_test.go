@@ -0,0 +1,151 @@
+package sus
+
+import(
+	`time`
+	`errors`
+	`strings`
+	`encoding/json`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+type person struct{
+	Version		int
+	FullName	string
+	Initials	string
+}
+
+func (p *person) GetVersion() int {
+	return p.Version
+}
+
+func (p *person) IncrementVersion() {
+	p.Version++
+}
+
+func (p *person) DecrementVersion() {
+	p.Version--
+}
+
+func personVersionFactory() Version {
+	return &person{}
+}
+
+// Version 0 of the person schema called FullName Name.
+func renameName(payload []byte, dst Version) error {
+	old := struct{ Name string }{}
+	if err := json.Unmarshal(payload, &old); err != nil {
+		return err
+	}
+	dst.(*person).FullName = old.Name
+	return nil
+}
+
+// Version 1 had no Initials.
+func addInitials(payload []byte, dst Version) error {
+	for _, name := range strings.Fields(dst.(*person).FullName) {
+		dst.(*person).Initials += name[:1]
+	}
+	return nil
+}
+
+func personEnvelope(schema string, schemaVersion uint64, payload string) []byte {
+	created := time.Unix(1, 0).UTC()
+	return EncodeEnvelope(&Envelope{`json`, schema, schemaVersion, 0, created, created, []byte(payload)})
+}
+
+func Test_ByteStore_migrates_on_read(t *testing.T){
+	reg := NewRegistry()
+	reg.RegisterMigrations(`person_read`, false, renameName, addInitials)
+	get, put, del := memoryByteFuncs()
+	s := NewByteStoreWithOptions(get, put, del, NewEnvelopeMarshaler(reg, `json`, `person_read`, 2), JsonUnmarshaler, newFooIdFactory(), personVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, mutexRunInTransaction(), ByteStoreOptions{reg})
+	old := personEnvelope(`person_read`, 0, `{"Version":0,"Name":"ann lee"}`)
+	put(`0`, old)
+	put(`1`, personEnvelope(`person_read`, 1, `{"Version":0,"FullName":"bo day"}`))
+	put(`2`, personEnvelope(`person_read`, 2, `{"Version":0,"FullName":"cy","Initials":"x"}`))
+
+	vs, err := s.ReadMulti([]string{`0`, `1`, `2`})
+	stored, _ := get(`0`)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, &person{0, `ann lee`, `al`}, vs[0], `the version 0 record should have had both migrations applied`)
+	assert.Equal(t, &person{0, `bo day`, `bd`}, vs[1], `the version 1 record should have had the second migration applied`)
+	assert.Equal(t, &person{0, `cy`, `x`}, vs[2], `the current record should be untouched`)
+	assert.Equal(t, old, stored, `the record should not have been written back`)
+}
+
+func Test_ByteStore_migrates_on_read_with_write_back(t *testing.T){
+	reg := NewRegistry()
+	reg.RegisterMigrations(`person_write_back`, true, renameName)
+	get, put, del := memoryByteFuncs()
+	s := NewByteStoreWithOptions(get, put, del, NewEnvelopeMarshaler(reg, `json`, `person_write_back`, 1), JsonUnmarshaler, newFooIdFactory(), personVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, mutexRunInTransaction(), ByteStoreOptions{reg})
+	put(`0`, personEnvelope(`person_write_back`, 0, `{"Version":3,"Name":"ann"}`))
+
+	v, err := s.Read(`0`)
+	stored, _ := get(`0`)
+	e, _ := DecodeEnvelope(stored)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, &person{3, `ann`, ``}, v, `v should have been migrated`)
+	assert.Equal(t, uint64(1), e.SchemaVersion, `the record should have been written back at the current schema version`)
+	assert.Equal(t, 3, e.Version, `the entity version should be unchanged`)
+	assert.Equal(t, time.Unix(1, 0).UTC(), e.Created, `the created time should be kept`)
+	assert.Equal(t, `{"Version":3,"FullName":"ann","Initials":""}`, string(e.Payload), `the payload should be in the current schema`)
+}
+
+func Test_NewUnversionedUnmarshaler(t *testing.T){
+	reg := NewRegistry()
+	reg.RegisterMigrations(`person_unversioned`, false, renameName, addInitials)
+	un := NewUnversionedUnmarshaler(reg, JsonUnmarshaler, `person_unversioned`)
+	raw := &person{}
+	enveloped := &person{}
+
+	rawErr := un([]byte(`{"Version":2,"Name":"ann lee"}`), raw)
+	envelopedErr := un(personEnvelope(`person_unversioned`, 1, `{"Version":0,"FullName":"bo"}`), enveloped)
+
+	assert.Nil(t, rawErr, `rawErr should be nil`)
+	assert.Equal(t, &person{2, `ann lee`, `al`}, raw, `the raw record should be migrated from version 0`)
+	assert.Nil(t, envelopedErr, `envelopedErr should be nil`)
+	assert.Equal(t, &person{0, `bo`, `b`}, enveloped, `the enveloped record should be migrated from its own version`)
+}
+
+func Test_MigrateFileStore(t *testing.T){
+	reg := NewRegistry()
+	reg.RegisterMigrations(`person_bulk`, false, renameName, addInitials)
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs, Registry: reg}
+	m := NewEnvelopeMarshaler(reg, `json`, `person_bulk`, 2)
+	un := NewUnversionedUnmarshaler(reg, JsonUnmarshaler, `person_bulk`)
+	s, _ := NewFileStoreWithOptions(`store`, `json`, m, un, newFooIdFactory(), personVersionFactory, fooEntityInitializer, opts)
+	_, put, _, _ := fileByteFuncs(`store`, `json`, opts)
+	put(`0`, []byte(`{"Version":1,"Name":"ann lee"}`))
+	put(`.2pc`, []byte(`not json`))
+	put(`.lease.0`, []byte(`not json`))
+	put(`1`, personEnvelope(`person_bulk`, 1, `{"Version":0,"FullName":"bo day"}`))
+	s.(*verifiableStore).Store.(*store).putMulti([]string{`2`}, []Version{&person{0, `cy`, `c`}})
+
+	count, err := MigrateFileStore(`store`, `json`, m, un, personVersionFactory, opts)
+	again, _ := MigrateFileStore(`store`, `json`, m, un, personVersionFactory, opts)
+	get, _, _, _ := fileByteFuncs(`store`, `json`, opts)
+	stored, _ := get(`0`)
+	e, _ := DecodeEnvelope(stored)
+	twoPhase, _ := get(`.2pc`)
+	vs, _ := s.ReadMulti([]string{`0`, `1`, `2`})
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, count, `the two out of date records should have been rewritten`)
+	assert.Equal(t, 0, again, `nothing should be left to migrate`)
+	assert.Equal(t, uint64(2), e.SchemaVersion, `the raw record should now be enveloped at the current schema version`)
+	assert.Equal(t, []byte(`not json`), twoPhase, `reserved records should be left as they are`)
+	assert.Equal(t, []Version{&person{1, `ann lee`, `al`}, &person{0, `bo day`, `bd`}, &person{0, `cy`, `c`}}, vs, `every entity should be current`)
+}
+
+func Test_migration_error(t *testing.T){
+	reg := NewRegistry()
+	reg.RegisterMigrations(`person_error`, false, func(payload []byte, dst Version) error { return nil }, func(payload []byte, dst Version) error { return errors.New(`boom`) })
+	dst := &person{}
+
+	err := unmarshalRecord(reg, JsonUnmarshaler, personEnvelope(`person_error`, 0, `{}`), dst)
+
+	assert.Equal(t, `migrating schema "person_error" from version 1 failed: boom`, err.Error(), `err should contain expected msg`)
+}
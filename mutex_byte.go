@@ -12,8 +12,42 @@ type Deleter func(id string) error
 
 // Creates and configures a store that stores entities by converting them to and from []byte and ensures versioning correctness with mutex locks.
 func NewMutexByteStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError) Store {
+	return NewByteStore(bg, bp, d, m, un, idf, vf, ei, inee, mutexRunInTransaction())
+}
+
+// Returns a RunInTransaction that runs one transaction at a time.
+func mutexRunInTransaction() RunInTransaction {
 	mtx := sync.Mutex{}
 
+	return func(tran Transaction) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return tran()
+	}
+}
+
+// Creates and configures a store that stores entities by converting them to and from []byte and relies on rit to ensure versioning correctness.
+// Records wrapped in an Envelope are decoded with the built in codec it names rather than un, see NewByteStoreWithOptions.
+func NewByteStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, rit RunInTransaction) Store {
+	return NewByteStoreWithOptions(bg, bp, d, m, un, idf, vf, ei, inee, rit, ByteStoreOptions{})
+}
+
+// Options for NewByteStoreWithOptions and the stores that decode records themselves, zero values are replaced with
+// defaults.
+type ByteStoreOptions struct{
+	// Where the codecs named by enveloped records are looked up. Defaults to the built in codecs, see NewRegistry.
+	Registry	*Registry
+}
+
+// Creates and configures a store as NewByteStore does. Records wrapped in an Envelope are decoded with the codec it
+// names in opts.Registry rather than un, into an entity of the type registered there for their schema if there is one,
+// and migrated if their schema has moved on there, see Registry.
+func NewByteStoreWithOptions(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, rit RunInTransaction, opts ByteStoreOptions) Store {
+	return newCheckedByteStore(bg, bp, d, m, un, idf, vf, ei, inee, rit, opts, nil)
+}
+
+// Creates a store as NewByteStoreWithOptions does that runs cw over the ids of every update and delete first.
+func newCheckedByteStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, rit RunInTransaction, opts ByteStoreOptions, cw writeCheck) Store {
 	getMulti := func(ids []string) ([]Version, error) {
 		var err error
 		var d []byte
@@ -24,11 +58,17 @@ func NewMutexByteStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un
 			if err != nil {
 				break
 			}
-			vs[i] = vf()
-			err = un(d, vs[i])
+			vs[i] = newRecordVersion(opts.Registry, vf, d)
+			err = unmarshalRecord(opts.Registry, un, d, vs[i])
 			if err != nil {
 				break
 			}
+			if opts.Registry.hasPendingMigrations(d, true) {
+				// a failed write back is not the reader's problem, the record is migrated again next time.
+				if nd, mErr := m(vs[i]); mErr == nil {
+					bp(ids[i], keepEnvelopeCreated(d, nd))
+				}
+			}
 		}
 		if err != nil {
 			vs = nil
@@ -45,6 +85,11 @@ func NewMutexByteStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un
 			if err != nil {
 				break
 			}
+			if IsEnvelope(d) {
+				if prev, getErr := bg(ids[i]); getErr == nil {
+					d = keepEnvelopeCreated(prev, d)
+				}
+			}
 			err = bp(ids[i], d)
 		}
 		return err
@@ -61,13 +106,7 @@ func NewMutexByteStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un
 		return
 	}
 
-	rit := func(tran Transaction) error {
-		mtx.Lock()
-		defer mtx.Unlock()
-		return tran()
-	}
-
-	return NewStore(getMulti, putMulti, delMulti, idf, vf, ei, inee, rit)
+	return &store{getMulti, putMulti, delMulti, idf, vf, ei, inee, rit, cw}
 }
 
 type localEntityDoesNotExistError struct{
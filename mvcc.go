@@ -0,0 +1,325 @@
+package sus
+
+import(
+	`sync`
+	`runtime`
+	`sync/atomic`
+)
+
+const(
+	mvccGCInterval = 64
+)
+
+// A memory store whose readers never lock, each read sees the store as of a single point in time.
+type MVCCStore interface{
+	Store
+	// Returns a consistent read only view of the store as it is now, it must be released once finished with.
+	Snapshot() Snapshot
+	// Discards every version that no current or future read can see, this also happens periodically on writes.
+	GC()
+}
+
+// A consistent read only view of an MVCCStore at a point in time.
+type Snapshot interface{
+	Read(id string) (v Version, err error)
+	ReadMulti(ids []string) (vs []Version, err error)
+	// Lets the versions this snapshot can see be garbage collected, the snapshot can not be used afterwards.
+	Release()
+}
+
+// Creates and configures a multi version store that stores entities by converting them to and from json []byte data
+// and keeps them in the local system memory.
+func NewJsonMVCCMemoryStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) MVCCStore {
+	return NewMVCCMemoryStore(JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a multi version store that stores entities by converting them to and from []byte and keeps
+// them in the local system memory. Every committed write adds a new version of its entity stamped with the commit's
+// timestamp, reads and snapshots pick the newest version no later than the timestamp they started at without taking
+// any locks. Writers are serialized and check entity versions against the latest commit so the first of two
+// conflicting updates wins. Adding or removing ids copies the id index so stores with many creates and deletes pay
+// for it on those writes.
+func NewMVCCMemoryStore(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) MVCCStore {
+	return NewMVCCMemoryStoreWithOptions(m, un, idf, vf, ei, ByteStoreOptions{})
+}
+
+// Creates and configures a multi version store as NewMVCCMemoryStore does, decoding enveloped records with the codecs
+// and types in opts.Registry, see NewByteStoreWithOptions.
+func NewMVCCMemoryStoreWithOptions(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, opts ByteStoreOptions) MVCCStore {
+	s := &mvccStore{
+		staged: newStagedMap(),
+		snapshots: map[uint64]int{},
+		unmarshaler: un,
+		versionFactory: vf,
+		registry: opts.Registry,
+	}
+	s.chains.Store(map[string]*mvccChain{})
+	get := func(id string) ([]byte, error) {
+		if _, staged := s.staged.pendingIdx[id]; staged {
+			return s.staged.get(id)
+		}
+		if chain := s.loadChains()[id]; chain != nil {
+			if node := chain.load(); node.d != nil {
+				return node.d, nil
+			}
+		}
+		return nil, localEntityDoesNotExistError{id}
+	}
+	s.Store = NewByteStoreWithOptions(get, s.staged.put, s.staged.del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, s.runInTransaction, opts)
+	return s
+}
+
+// One committed version of an entity, d is nil for a delete. Nodes are immutable once published apart from GC
+// cutting prev off below the oldest version any reader can need.
+type mvccNode struct{
+	ts		uint64
+	d		[]byte
+	prev	*mvccNode
+}
+
+type mvccChain struct{
+	head	atomic.Value
+}
+
+func (c *mvccChain) load() *mvccNode {
+	return c.head.Load().(*mvccNode)
+}
+
+// Returns the newest version committed at or before ts, nil if there is none.
+func (c *mvccChain) at(ts uint64) *mvccNode {
+	node := c.load()
+	for node != nil && node.ts > ts {
+		node = node.prev
+	}
+	return node
+}
+
+type mvccStore struct{
+	Store
+	writeMtx		sync.Mutex
+	staged			*stagedMap
+	chains			atomic.Value
+	clock			uint64
+	commits			int
+	epoch			uint32
+	readers			[2]int64
+	snapshotMtx		sync.Mutex
+	snapshots		map[uint64]int
+	unmarshaler		Unmarshaler
+	versionFactory	VersionFactory
+	registry		*Registry
+}
+
+// Fetches the versioned entity with id without locking.
+func (s *mvccStore) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the versioned entities with id's as of a single point in time without locking.
+func (s *mvccStore) ReadMulti(ids []string) ([]Version, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ts, epoch := s.beginRead()
+	defer s.endRead(epoch)
+	return s.readAt(ts, ids)
+}
+
+// Returns a consistent read only view of the store as it is now.
+func (s *mvccStore) Snapshot() Snapshot {
+	s.snapshotMtx.Lock()
+	defer s.snapshotMtx.Unlock()
+	ts := atomic.LoadUint64(&s.clock)
+	s.snapshots[ts]++
+	return &mvccSnapshot{store: s, ts: ts}
+}
+
+// Discards every version that no current or future read can see.
+func (s *mvccStore) GC() {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	s.gc()
+}
+
+// Runs fn as an interactive transaction whose writes are published under a single commit timestamp.
+func (s *mvccStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+func (s *mvccStore) gc() {
+	s.snapshotMtx.Lock()
+	oldest := atomic.LoadUint64(&s.clock)
+	for ts := range s.snapshots {
+		if ts < oldest {
+			oldest = ts
+		}
+	}
+	s.snapshotMtx.Unlock()
+	// readers that might have started before oldest was worked out are in the current epoch, once they have all
+	// finished every reader left started at oldest or later and never looks past the version visible at oldest.
+	epoch := atomic.AddUint32(&s.epoch, 1) - 1
+	for atomic.LoadInt64(&s.readers[epoch&1]) > 0 {
+		runtime.Gosched()
+	}
+	chains := s.loadChains()
+	var removed []string
+	for id, chain := range chains {
+		node := chain.at(oldest)
+		if node == nil {
+			continue
+		}
+		node.prev = nil
+		if node.d == nil && chain.load() == node {
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		pruned := make(map[string]*mvccChain, len(chains)-len(removed))
+		for id, chain := range chains {
+			pruned[id] = chain
+		}
+		for _, id := range removed {
+			delete(pruned, id)
+		}
+		s.chains.Store(pruned)
+	}
+}
+
+// Runs tran with its writes staged and publishes them all as new versions under a single commit timestamp.
+func (s *mvccStore) runInTransaction(tran Transaction) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	if err := tran(); err != nil {
+		s.staged.rollback()
+		return err
+	}
+	ops := s.staged.pending
+	s.staged.rollback()
+	if len(ops) == 0 {
+		return nil
+	}
+	ts := s.clock + 1
+	chains := s.loadChains()
+	var added map[string]*mvccChain
+	for _, op := range ops {
+		var d []byte
+		if op.kind == putOp {
+			// a put of empty data must still read as present.
+			d = append([]byte{}, op.d...)
+		}
+		if chain := chains[op.id]; chain != nil {
+			chain.head.Store(&mvccNode{ts, d, chain.load()})
+		} else if chain = added[op.id]; chain != nil {
+			chain.head.Store(&mvccNode{ts, d, chain.load()})
+		} else if d != nil {
+			if added == nil {
+				added = map[string]*mvccChain{}
+			}
+			chain = &mvccChain{}
+			chain.head.Store(&mvccNode{ts, d, nil})
+			added[op.id] = chain
+		}
+	}
+	if len(added) > 0 {
+		grown := make(map[string]*mvccChain, len(chains)+len(added))
+		for id, chain := range chains {
+			grown[id] = chain
+		}
+		for id, chain := range added {
+			grown[id] = chain
+		}
+		s.chains.Store(grown)
+	}
+	// readers only see the new versions once the clock moves past them.
+	atomic.StoreUint64(&s.clock, ts)
+	s.commits++
+	if s.commits%mvccGCInterval == 0 {
+		s.gc()
+	}
+	return nil
+}
+
+func (s *mvccStore) readAt(ts uint64, ids []string) ([]Version, error) {
+	chains := s.loadChains()
+	vs := make([]Version, len(ids), len(ids))
+	for i, id := range ids {
+		var node *mvccNode
+		if chain := chains[id]; chain != nil {
+			node = chain.at(ts)
+		}
+		if node == nil || node.d == nil {
+			return nil, &nonExtantError{localEntityDoesNotExistError{id}}
+		}
+		vs[i] = newRecordVersion(s.registry, s.versionFactory, node.d)
+		if err := unmarshalRecord(s.registry, s.unmarshaler, node.d, vs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return vs, nil
+}
+
+// Registers a reader in the current epoch and returns the timestamp it reads at.
+func (s *mvccStore) beginRead() (uint64, uint32) {
+	for {
+		epoch := atomic.LoadUint32(&s.epoch)
+		atomic.AddInt64(&s.readers[epoch&1], 1)
+		if atomic.LoadUint32(&s.epoch) == epoch {
+			return atomic.LoadUint64(&s.clock), epoch
+		}
+		atomic.AddInt64(&s.readers[epoch&1], -1)
+	}
+}
+
+func (s *mvccStore) endRead(epoch uint32) {
+	atomic.AddInt64(&s.readers[epoch&1], -1)
+}
+
+func (s *mvccStore) loadChains() map[string]*mvccChain {
+	return s.chains.Load().(map[string]*mvccChain)
+}
+
+type mvccSnapshot struct{
+	store		*mvccStore
+	ts			uint64
+	released	int32
+}
+
+// Fetches the versioned entity with id as it was when the snapshot was taken.
+func (s *mvccSnapshot) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the versioned entities with id's as they were when the snapshot was taken.
+func (s *mvccSnapshot) ReadMulti(ids []string) ([]Version, error) {
+	if atomic.LoadInt32(&s.released) != 0 {
+		return nil, &releasedSnapshotError{}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return s.store.readAt(s.ts, ids)
+}
+
+// Lets the versions this snapshot can see be garbage collected.
+func (s *mvccSnapshot) Release() {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return
+	}
+	s.store.snapshotMtx.Lock()
+	defer s.store.snapshotMtx.Unlock()
+	if s.store.snapshots[s.ts]--; s.store.snapshots[s.ts] == 0 {
+		delete(s.store.snapshots, s.ts)
+	}
+}
+
+type releasedSnapshotError struct{}
+
+func (e *releasedSnapshotError) Error() string { return `snapshot has been released` }
@@ -0,0 +1,138 @@
+package sus
+
+import(
+	`sync`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_MVCCStore_Create_Read_Update_Delete(t *testing.T){
+	s := NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	id, f, createErr := s.Create()
+	updateErr := s.Update(id, f)
+	v, readErr := s.Read(id)
+	deleteErr := s.Delete(id)
+	_, goneErr := s.Read(id)
+	none, noneErr := s.ReadMulti([]string{})
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+id+`" does not exist`, goneErr.Error(), `goneErr should contain expected msg`)
+	assert.Nil(t, none, `none should be nil`)
+	assert.Nil(t, noneErr, `noneErr should be nil`)
+}
+
+func Test_MVCCStore_Snapshot_is_isolated_from_later_writes(t *testing.T){
+	s := NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, fs, _ := s.CreateMulti(2)
+	snap := s.Snapshot()
+
+	s.Update(ids[0], fs[0])
+	s.Delete(ids[1])
+	newId, _, _ := s.Create()
+	old, oldErr := snap.ReadMulti(ids)
+	_, newErr := snap.Read(newId)
+	current, _ := s.Read(ids[0])
+	snap.Release()
+	snap.Release()
+	_, releasedErr := snap.Read(ids[0])
+
+	assert.Nil(t, oldErr, `oldErr should be nil`)
+	assert.Equal(t, 0, old[0].GetVersion(), `the snapshot should see version 0`)
+	assert.Equal(t, 0, old[1].GetVersion(), `the snapshot should still see the deleted entity`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+newId+`" does not exist`, newErr.Error(), `newErr should contain expected msg`)
+	assert.Equal(t, 1, current.GetVersion(), `current's version should be 1`)
+	assert.Equal(t, `snapshot has been released`, releasedErr.Error(), `releasedErr should contain expected msg`)
+}
+
+func Test_MVCCStore_first_committer_wins(t *testing.T){
+	s := NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, _, _ := s.Create()
+	a, _ := s.Read(id)
+	b, _ := s.Read(id)
+
+	firstErr := s.Update(id, a)
+	secondErr := s.Update(id, b)
+
+	assert.Nil(t, firstErr, `firstErr should be nil`)
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, secondErr.Error(), `secondErr should contain expected msg`)
+	assert.Equal(t, 0, b.GetVersion(), `b's version should be unchanged`)
+}
+
+func Test_MVCCStore_GC_keeps_versions_snapshots_can_see(t *testing.T){
+	s := NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	deletedId, _, _ := s.Create()
+	snap := s.Snapshot()
+	s.Update(id, f)
+	s.Update(id, f)
+	s.Delete(deletedId)
+
+	s.GC()
+	kept := chainLength(s, id)
+	old, oldErr := snap.Read(id)
+	_, deletedErr := snap.Read(deletedId)
+	snap.Release()
+	s.GC()
+	_, stillIndexed := s.(*mvccStore).loadChains()[deletedId]
+
+	assert.Equal(t, 3, kept, `every version since the snapshot should be kept`)
+	assert.Nil(t, oldErr, `oldErr should be nil`)
+	assert.Equal(t, 0, old.GetVersion(), `the snapshot should still see version 0`)
+	assert.Nil(t, deletedErr, `the snapshot should still see the deleted entity`)
+	assert.Equal(t, 1, chainLength(s, id), `only the latest version should be left`)
+	assert.False(t, stillIndexed, `the deleted entity should have been dropped`)
+}
+
+func Test_MVCCStore_GC_runs_periodically(t *testing.T){
+	s := NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+
+	for i := 1; i < mvccGCInterval; i++ {
+		s.Update(id, f)
+	}
+
+	assert.Equal(t, 1, chainLength(s, id), `old versions should have been collected`)
+}
+
+func Test_MVCCStore_concurrent_readers_see_consistent_state(t *testing.T){
+	s := NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, fs, _ := s.CreateMulti(2)
+	wg := sync.WaitGroup{}
+	inconsistent := 0
+	mtx := sync.Mutex{}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				vs, err := s.ReadMulti(ids)
+				if err != nil || vs[0].GetVersion() != vs[1].GetVersion() {
+					mtx.Lock()
+					inconsistent++
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		s.UpdateMulti(ids, fs)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, inconsistent, `every read should see both entities at the same version`)
+	assert.Equal(t, 200, fs[0].GetVersion(), `fs[0]'s version should be 200`)
+}
+
+func chainLength(s MVCCStore, id string) int {
+	length := 0
+	for node := s.(*mvccStore).loadChains()[id].load(); node != nil; node = node.prev {
+		length++
+	}
+	return length
+}
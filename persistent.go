@@ -0,0 +1,344 @@
+package sus
+
+import(
+	`io`
+	`os`
+	`sync`
+	`time`
+	`errors`
+	`io/ioutil`
+	`hash/crc32`
+	`path/filepath`
+	`encoding/binary`
+)
+
+const(
+	persistentSnapshotFile	= `snapshot`
+	persistentLogFile		= `log`
+	recordHeaderLen			= 8
+	putOp					= byte(0)
+	deleteOp				= byte(1)
+)
+
+// A memory store whose contents survive restarts by way of snapshots and an append-only operation log.
+type PersistentStore interface{
+	Store
+	// Writes a point-in-time snapshot of every entity and truncates the operation log.
+	Snapshot() error
+	// Stops periodic snapshotting and closes the operation log.
+	Close() error
+}
+
+// Creates and configures a store that stores entities by converting them to and from json []byte data and keeps them
+// in the local system memory, persisting them to dir.
+func NewJsonPersistentMemoryStore(dir string, snapshotInterval time.Duration, idf IdFactory, vf VersionFactory, ei EntityInitializer) (PersistentStore, error) {
+	return NewPersistentMemoryStore(dir, snapshotInterval, JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a store that stores entities by converting them to and from []byte and keeps them in the
+// local system memory. Every committed batch of puts and deletes is appended to an operation log in dir before it is
+// applied, and the whole map is snapshotted every snapshotInterval (never if snapshotInterval is 0). On start the
+// latest snapshot is loaded and the log replayed over it, a torn record at the tail of the log is truncated away.
+func NewPersistentMemoryStore(dir string, snapshotInterval time.Duration, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) (PersistentStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &persistentStore{
+		dir: dir,
+		data: newStagedMap(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.Store = NewByteStore(s.data.get, s.data.put, s.data.del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, s.runInTransaction)
+	if snapshotInterval > 0 {
+		go s.snapshotLoop(snapshotInterval)
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+type logOp struct{
+	kind	byte
+	id		string
+	d		[]byte
+}
+
+type persistentStore struct{
+	Store
+	dir			string
+	mtx			sync.Mutex
+	data		*stagedMap
+	log			appendableLog
+	stop		chan struct{}
+	done		chan struct{}
+	closeOnce	sync.Once
+}
+
+// Writes a point-in-time snapshot of every entity and truncates the operation log.
+func (s *persistentStore) Snapshot() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ops := make([]*logOp, 0, len(s.data.data))
+	for id, d := range s.data.data {
+		ops = append(ops, &logOp{putOp, id, d})
+	}
+	tmp := filepath.Join(s.dir, persistentSnapshotFile+`.tmp`)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(encodeRecord(ops))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, persistentSnapshotFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// replaying the old log over the new snapshot is harmless so a crash before this point loses nothing.
+	if err = s.log.Truncate(0); err != nil {
+		return err
+	}
+	_, err = s.log.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// Stops periodic snapshotting and closes the operation log.
+func (s *persistentStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.log.Close()
+}
+
+// Runs fn as an interactive transaction whose writes are logged as a single record.
+func (s *persistentStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+// Buffers the transaction's writes and, if it succeeds, logs them as one record before applying them to the map.
+func (s *persistentStore) runInTransaction(tran Transaction) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := tran(); err != nil {
+		s.data.rollback()
+		return err
+	}
+	if len(s.data.pending) > 0 {
+		if err := s.appendLog(s.data.pending); err != nil {
+			s.data.rollback()
+			return err
+		}
+	}
+	s.data.commit()
+	return nil
+}
+
+func (s *persistentStore) appendLog(ops []*logOp) error {
+	return appendRecord(s.log, ops)
+}
+
+// A log file records are appended to, see appendRecord.
+type appendableLog interface{
+	io.WriteSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// Appends ops to log as one record and syncs it. If either fails log is truncated back to where the record began, so
+// later records never follow torn bytes that would stop replay and a record whose append was reported as failed is
+// never replayed.
+func appendRecord(log appendableLog, ops []*logOp) error {
+	info, err := log.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = log.Write(encodeRecord(ops)); err == nil {
+		if err = log.Sync(); err == nil {
+			return nil
+		}
+	}
+	log.Truncate(info.Size())
+	return err
+}
+
+func (s *persistentStore) load() error {
+	snapshot, err := ioutil.ReadFile(filepath.Join(s.dir, persistentSnapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(snapshot) > 0 {
+		ops, n := decodeRecord(snapshot)
+		if n != len(snapshot) {
+			return &corruptSnapshotError{s.dir}
+		}
+		applyOps(s.data.data, ops)
+	}
+	logPath := filepath.Join(s.dir, persistentLogFile)
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	offset := 0
+	for offset < len(log) {
+		ops, n := decodeRecord(log[offset:])
+		if n == 0 {
+			break
+		}
+		applyOps(s.data.data, ops)
+		offset += n
+	}
+	if offset < len(log) {
+		if err = os.Truncate(logPath, int64(offset)); err != nil {
+			return err
+		}
+	}
+	s.log, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (s *persistentStore) snapshotLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Snapshot()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Encodes ops as a record of a 4 byte payload length, a 4 byte crc32 of the payload and then the payload itself.
+func encodeRecord(ops []*logOp) []byte {
+	payload := make([]byte, 0, 64)
+	payload = appendUvarint(payload, uint64(len(ops)))
+	for _, op := range ops {
+		payload = append(payload, op.kind)
+		payload = appendUvarint(payload, uint64(len(op.id)))
+		payload = append(payload, op.id...)
+		if op.kind == putOp {
+			payload = appendUvarint(payload, uint64(len(op.d)))
+			payload = append(payload, op.d...)
+		}
+	}
+	record := make([]byte, recordHeaderLen, recordHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+// Decodes the record at the start of b returning its ops and length, a length of 0 means the record is torn or corrupt.
+func decodeRecord(b []byte) ([]*logOp, int) {
+	if len(b) < recordHeaderLen {
+		return nil, 0
+	}
+	n := recordHeaderLen + int(binary.BigEndian.Uint32(b[0:4]))
+	if n < recordHeaderLen || n > len(b) {
+		return nil, 0
+	}
+	payload := b[recordHeaderLen:n]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(b[4:8]) {
+		return nil, 0
+	}
+	r := &byteReader{b: payload}
+	count := r.uvarint()
+	if count > uint64(len(payload)) {
+		return nil, 0
+	}
+	ops := make([]*logOp, 0, int(count))
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		op := &logOp{kind: r.byte()}
+		op.id = string(r.bytes(r.uvarint()))
+		if op.kind == putOp {
+			op.d = r.bytes(r.uvarint())
+		}
+		ops = append(ops, op)
+	}
+	if r.err != nil {
+		return nil, 0
+	}
+	return ops, n
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+var errShortBuffer = errors.New(`short buffer`)
+
+type byteReader struct{
+	b	[]byte
+	err	error
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *byteReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *byteReader) byte() byte {
+	b := r.bytes(1)
+	if len(b) == 0 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.b)) {
+		r.err = errShortBuffer
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+type corruptSnapshotError struct{
+	dir	string
+}
+
+func (e *corruptSnapshotError) Error() string { return `corrupt snapshot in "`+e.dir+`"` }
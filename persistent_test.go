@@ -0,0 +1,201 @@
+package sus
+
+import(
+	`os`
+	`time`
+	`io/ioutil`
+	`path/filepath`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_PersistentMemoryStore_survives_restart(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	idf := newFooIdFactory()
+	ps1, _ := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	ids, fs, _ := ps1.CreateMulti(2)
+	ps1.Update(ids[0], fs[0])
+	ps1.Delete(ids[1])
+	ps1.Close()
+
+	ps2, err := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	f, readErr := ps2.Read(ids[0])
+	_, deletedErr := ps2.Read(ids[1])
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, f.GetVersion(), `f's version should be 1`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+ids[1]+`" does not exist`, deletedErr.Error(), `deletedErr should contain expected msg`)
+	ps2.Close()
+}
+
+func Test_PersistentMemoryStore_Snapshot_truncates_log(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	idf := newFooIdFactory()
+	ps1, _ := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	id, f, _ := ps1.Create()
+	ps1.Update(id, f)
+
+	err := ps1.Snapshot()
+	logInfo, _ := os.Stat(filepath.Join(dir, persistentLogFile))
+	ps1.Update(id, f)
+	ps1.Close()
+	ps2, _ := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	f2, _ := ps2.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, int64(0), logInfo.Size(), `log should be empty after a snapshot`)
+	assert.Equal(t, 2, f2.GetVersion(), `f2's version should be 2`)
+	ps2.Close()
+}
+
+func Test_PersistentMemoryStore_snapshots_on_interval(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	ps, _ := NewJsonPersistentMemoryStore(dir, time.Millisecond, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ps.Create()
+
+	time.Sleep(50 * time.Millisecond)
+	ps.Close()
+	_, err := os.Stat(filepath.Join(dir, persistentSnapshotFile))
+
+	assert.Nil(t, err, `snapshot file should exist`)
+}
+
+func Test_PersistentMemoryStore_truncates_torn_log_tail(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	idf := newFooIdFactory()
+	ps1, _ := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	id, f, _ := ps1.Create()
+	ps1.Close()
+	logPath := filepath.Join(dir, persistentLogFile)
+	goodInfo, _ := os.Stat(logPath)
+	torn := encodeRecord([]*logOp{{putOp, id, []byte(`{"version":9}`)}})
+	logFile, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	logFile.Write(torn[:len(torn)-3])
+	logFile.Close()
+
+	ps2, err := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	f2, _ := ps2.Read(id)
+	tornInfo, _ := os.Stat(logPath)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, f, f2, `f2 should be f`)
+	assert.Equal(t, goodInfo.Size(), tornInfo.Size(), `torn tail should have been truncated`)
+	ps2.Close()
+}
+
+func Test_PersistentMemoryStore_corrupt_snapshot_failure(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, persistentSnapshotFile), []byte(`not a snapshot`), 0600)
+
+	ps, err := NewJsonPersistentMemoryStore(dir, 0, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	assert.Nil(t, ps, `ps should be nil`)
+	assert.Equal(t, `corrupt snapshot in "`+dir+`"`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_PersistentMemoryStore_failed_transaction_is_not_applied(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	marshalCount := 0
+	m := func(v Version) ([]byte, error) {
+		marshalCount++
+		if marshalCount > 3 {
+			return nil, marshalerErr
+		}
+		return JsonMarshaler(v)
+	}
+	ps, _ := NewPersistentMemoryStore(dir, 0, m, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, fs, _ := ps.CreateMulti(2)
+
+	err := ps.UpdateMulti(ids, fs)
+	vs, _ := ps.ReadMulti(ids)
+
+	assert.Equal(t, marshalerErr, err, `err should be marshalerErr`)
+	assert.Equal(t, 0, fs[0].GetVersion(), `fs[0]'s version should have been restored`)
+	assert.Equal(t, 0, vs[0].GetVersion(), `the first entity should not have been partially updated`)
+	ps.Close()
+}
+
+func Test_PersistentMemoryStore_log_failure(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	ps, _ := NewJsonPersistentMemoryStore(dir, 0, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := ps.Create()
+	ps.Close()
+
+	err := ps.Update(id, f)
+	v, _ := ps.Read(id)
+
+	assert.NotNil(t, err, `err should not be nil`)
+	assert.Equal(t, 0, f.GetVersion(), `f's version should have been restored`)
+	assert.Equal(t, 0, v.GetVersion(), `the stored version should be unchanged`)
+}
+
+func Test_PersistentMemoryStore_failed_appends_are_truncated(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	idf := newFooIdFactory()
+	ps, _ := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	id, f, _ := ps.Create()
+	log := &faultyLog{appendableLog: ps.(*persistentStore).log, writeErr: diskFullErr}
+	ps.(*persistentStore).log = log
+
+	tornErr := ps.Update(id, f)
+	log.writeErr, log.syncErr = nil, diskFullErr
+	unsyncedErr := ps.Update(id, f)
+	log.syncErr = nil
+	createdId, _, createErr := ps.Create()
+	ps.Close()
+	reopened, _ := NewJsonPersistentMemoryStore(dir, 0, idf, fooVersionFactory, fooEntityInitializer)
+	vs, readErr := reopened.ReadMulti([]string{id, createdId})
+
+	assert.Equal(t, diskFullErr, tornErr, `tornErr should be diskFullErr`)
+	assert.Equal(t, diskFullErr, unsyncedErr, `unsyncedErr should be diskFullErr`)
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, readErr, `the create after the failed appends should survive a restart`)
+	assert.Equal(t, 0, vs[0].GetVersion(), `neither failed update should come back after a restart`)
+	reopened.Close()
+}
+
+// Writes half of each record before failing with writeErr, or fails Sync with syncErr after a full write.
+type faultyLog struct{
+	appendableLog
+	writeErr	error
+	syncErr		error
+}
+
+func (l *faultyLog) Write(b []byte) (int, error) {
+	if l.writeErr != nil {
+		n, _ := l.appendableLog.Write(b[:len(b)/2])
+		return n, l.writeErr
+	}
+	return l.appendableLog.Write(b)
+}
+
+func (l *faultyLog) Sync() error {
+	if l.syncErr != nil {
+		return l.syncErr
+	}
+	return l.appendableLog.Sync()
+}
+
+func Test_decodeRecord_rejects_bad_records(t *testing.T){
+	record := encodeRecord([]*logOp{{deleteOp, `a`, nil}})
+	flipped := append([]byte{}, record...)
+	flipped[len(flipped)-1]++
+
+	ops, n := decodeRecord(record)
+	_, flippedN := decodeRecord(flipped)
+	_, shortN := decodeRecord(record[:4])
+
+	assert.Equal(t, len(record), n, `n should be the record length`)
+	assert.Equal(t, `a`, ops[0].id, `the op id should be a`)
+	assert.Equal(t, 0, flippedN, `a record with a bad checksum should be rejected`)
+	assert.Equal(t, 0, shortN, `a short record should be rejected`)
+}
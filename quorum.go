@@ -0,0 +1,387 @@
+package sus
+
+import(
+	`fmt`
+	`sync`
+)
+
+// Builds one replica of a quorum store, the replica must create entities using the given IdFactory and EntityInitializer.
+type ReplicaFactory func(idf IdFactory, ei EntityInitializer) (Store, error)
+
+// Creates and configures a store that keeps n replicas built by newReplica. Writes succeed once writeQuorum replicas
+// accept them, reads consult at least readQuorum replicas and return the highest version found, repairing any
+// replica that answered with an older version or none at all. writeQuorum + readQuorum must be greater than n so
+// that every read sees the latest write. Deletes are not tombstoned so they must reach every replica to succeed, one
+// that fails puts the entities back on the replicas it did reach so a later read can not half undo it.
+func NewQuorumStore(n, writeQuorum, readQuorum int, newReplica ReplicaFactory, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) (Store, error) {
+	return NewQuorumStoreWithOptions(n, writeQuorum, readQuorum, newReplica, m, un, idf, vf, ei, ByteStoreOptions{})
+}
+
+// Creates and configures a quorum store as NewQuorumStore does, copying enveloped entities between replicas with the
+// codecs and types in opts.Registry, which should be the one the replicas decode them with.
+func NewQuorumStoreWithOptions(n, writeQuorum, readQuorum int, newReplica ReplicaFactory, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, opts ByteStoreOptions) (Store, error) {
+	if n < 1 || writeQuorum < 1 || writeQuorum > n || readQuorum < 1 || readQuorum > n || writeQuorum+readQuorum <= n {
+		return nil, &invalidQuorumError{n, writeQuorum, readQuorum}
+	}
+	s := &quorumStore{
+		replicas: make([]Store, n, n),
+		seeds: make([]*seeder, n, n),
+		writeQuorum: writeQuorum,
+		readQuorum: readQuorum,
+		marshaler: m,
+		unmarshaler: un,
+		idFactory: idf,
+		versionFactory: vf,
+		entityInitializer: ei,
+		registry: opts.Registry,
+	}
+	for i := 0; i < n; i++ {
+		s.seeds[i] = &seeder{}
+		replica, err := newReplica(s.seeds[i].idFactory, s.seeds[i].entityInitializer)
+		if err != nil {
+			return nil, err
+		}
+		s.replicas[i] = replica
+	}
+	return s, nil
+}
+
+type quorumStore struct{
+	mtx					sync.Mutex
+	replicas			[]Store
+	seeds				[]*seeder
+	writeQuorum			int
+	readQuorum			int
+	marshaler			Marshaler
+	unmarshaler			Unmarshaler
+	idFactory			IdFactory
+	versionFactory		VersionFactory
+	entityInitializer	EntityInitializer
+	registry			*Registry
+}
+
+// What one replica holds for a batch of ids, a nil entry means the replica does not have that id.
+type replicaRead struct{
+	vs	[]Version
+	err	error
+}
+
+// Creates a new versioned entity.
+func (s *quorumStore) Create() (id string, v Version, err error) {
+	ids, vs, err := s.CreateMulti(1)
+	if len(ids) == 1 && len(vs) == 1 {
+		id = ids[0]
+		v = vs[0]
+	}
+	return
+}
+
+// Creates a set of new versioned entities on every replica.
+func (s *quorumStore) CreateMulti(count uint) (ids []string, vs []Version, err error) {
+	if count == 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	icount := int(count)
+	ids = make([]string, count, count)
+	vs = make([]Version, count, count)
+	for i := 0; i < icount; i++ {
+		ids[i] = s.idFactory()
+		vs[i] = s.entityInitializer(s.versionFactory())
+	}
+	err = s.write(`create`, func(i int, replica Store) error {
+		copies, err := s.copyAll(vs)
+		if err != nil {
+			return err
+		}
+		return s.seeds[i].seed(replica, ids, copies)
+	})
+	if err != nil {
+		ids, vs = nil, nil
+	}
+	return
+}
+
+// Fetches the versioned entity with id.
+func (s *quorumStore) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the highest version of each entity from a read quorum, repairing stale replicas along the way.
+func (s *quorumStore) ReadMulti(ids []string) (vs []Version, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	reads, latest, err := s.readLatest(ids)
+	if err != nil {
+		return
+	}
+	for i, read := range reads {
+		if read.err == nil {
+			for j, id := range ids {
+				if read.vs[j] == nil || read.vs[j].GetVersion() < latest[j].GetVersion() {
+					// repair is best effort, the replica will be repaired again on the next read if it fails.
+					s.repair(i, id, latest[j])
+				}
+			}
+		}
+	}
+	return latest, nil
+}
+
+// Updates the versioned entity with id.
+func (s *quorumStore) Update(id string, v Version) error {
+	return s.UpdateMulti([]string{id}, []Version{v})
+}
+
+// Updates the versioned entities with id's on a write quorum, stale replicas have the new versions written over them.
+func (s *quorumStore) UpdateMulti(ids []string, vs []Version) error {
+	count := len(ids)
+	if count != len(vs) {
+		return &idCountNotEqualToEntityCountError{count, len(vs)}
+	}
+	if count == 0 {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	reads, latest, err := s.readLatest(ids)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if latest[i].GetVersion() != vs[i].GetVersion() {
+			return &nonsequentialUpdateError{id}
+		}
+	}
+	err = s.write(`update`, func(i int, replica Store) error {
+		copies, err := s.copyAll(vs)
+		if err != nil {
+			return err
+		}
+		read := reads[i]
+		if read.err != nil {
+			return replica.UpdateMulti(ids, copies)
+		}
+		freshIds := make([]string, 0, count)
+		freshVs := make([]Version, 0, count)
+		for j, id := range ids {
+			if read.vs[j] != nil && read.vs[j].GetVersion() == vs[j].GetVersion() {
+				freshIds = append(freshIds, id)
+				freshVs = append(freshVs, copies[j])
+			} else {
+				copies[j].IncrementVersion()
+				if err := s.repair(i, id, copies[j]); err != nil {
+					return err
+				}
+			}
+		}
+		if len(freshIds) == 0 {
+			return nil
+		}
+		return replica.UpdateMulti(freshIds, freshVs)
+	})
+	if err == nil {
+		for _, v := range vs {
+			v.IncrementVersion()
+		}
+	}
+	return err
+}
+
+// Deletes the versioned entity with id.
+func (s *quorumStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+// Deletes the versioned entities with id's from every replica.
+func (s *quorumStore) DeleteMulti(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	reads := make([]*replicaRead, len(s.replicas), len(s.replicas))
+	err := s.writeN(`delete`, len(s.replicas), func(i int, replica Store) error {
+		reads[i] = s.readReplica(replica, ids)
+		return reads[i].err
+	})
+	if err != nil {
+		return err
+	}
+	errs := s.each(func(i int, replica Store) error {
+		return replica.DeleteMulti(ids)
+	})
+	if err = quorumReached(`delete`, len(s.replicas), errs); err != nil {
+		// without tombstones the replicas still holding the entities would repair them back onto the others, so
+		// put back what every replica held and let the delete be retried as a whole.
+		for i, read := range reads {
+			for j, id := range ids {
+				if read.vs[j] != nil {
+					if _, readErr := s.replicas[i].Read(id); readErr != nil {
+						s.repair(i, id, read.vs[j])
+					}
+				}
+			}
+		}
+	}
+	return err
+}
+
+// Reads ids from every replica and works out the latest version of each, failing if fewer than a read quorum answer.
+func (s *quorumStore) readLatest(ids []string) ([]*replicaRead, []Version, error) {
+	reads := make([]*replicaRead, len(s.replicas), len(s.replicas))
+	s.each(func(i int, replica Store) error {
+		reads[i] = s.readReplica(replica, ids)
+		return reads[i].err
+	})
+	answered := 0
+	var firstErr error
+	latest := make([]Version, len(ids), len(ids))
+	for _, read := range reads {
+		if read.err != nil {
+			if firstErr == nil {
+				firstErr = read.err
+			}
+			continue
+		}
+		answered++
+		for j, v := range read.vs {
+			if v != nil && (latest[j] == nil || v.GetVersion() > latest[j].GetVersion()) {
+				latest[j] = v
+			}
+		}
+	}
+	if answered < s.readQuorum {
+		return nil, nil, &quorumNotReachedError{`read`, answered, s.readQuorum, firstErr}
+	}
+	for j, id := range ids {
+		if latest[j] == nil {
+			return nil, nil, &nonExtantError{localEntityDoesNotExistError{id}}
+		}
+	}
+	return reads, latest, nil
+}
+
+// Reads ids from one replica, falling back to reading them one at a time if some of them are missing.
+func (s *quorumStore) readReplica(replica Store, ids []string) *replicaRead {
+	vs, err := replica.ReadMulti(ids)
+	if err == nil {
+		return &replicaRead{vs: vs}
+	}
+	if _, ok := err.(*nonExtantError); !ok {
+		return &replicaRead{err: err}
+	}
+	vs = make([]Version, len(ids), len(ids))
+	for i, id := range ids {
+		v, err := replica.Read(id)
+		if err != nil {
+			if _, ok := err.(*nonExtantError); !ok {
+				return &replicaRead{err: err}
+			}
+		}
+		vs[i] = v
+	}
+	return &replicaRead{vs: vs}
+}
+
+// Overwrites the replica's copy of id with v, whatever version it had before.
+func (s *quorumStore) repair(i int, id string, v Version) error {
+	replica := s.replicas[i]
+	if _, err := replica.Read(id); err == nil {
+		if err = replica.Delete(id); err != nil {
+			return err
+		}
+	}
+	copies, err := s.copyAll([]Version{v})
+	if err != nil {
+		return err
+	}
+	return s.seeds[i].seed(replica, []string{id}, copies)
+}
+
+func (s *quorumStore) write(op string, fn func(i int, replica Store) error) error {
+	return s.writeN(op, s.writeQuorum, fn)
+}
+
+func (s *quorumStore) writeN(op string, required int, fn func(i int, replica Store) error) error {
+	return quorumReached(op, required, s.each(fn))
+}
+
+// Fails with a *quorumNotReachedError if fewer than required of errs are nil.
+func quorumReached(op string, required int, errs []error) error {
+	succeeded := 0
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if succeeded < required {
+		return &quorumNotReachedError{op, succeeded, required, firstErr}
+	}
+	return nil
+}
+
+// Runs fn against every replica concurrently.
+func (s *quorumStore) each(fn func(i int, replica Store) error) []error {
+	errs := make([]error, len(s.replicas), len(s.replicas))
+	wg := sync.WaitGroup{}
+	for i, replica := range s.replicas {
+		wg.Add(1)
+		go func(i int, replica Store) {
+			defer wg.Done()
+			errs[i] = fn(i, replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Deep copies vs via the marshaler so that no two replicas share an entity.
+func (s *quorumStore) copyAll(vs []Version) ([]Version, error) {
+	copies := make([]Version, len(vs), len(vs))
+	for i, v := range vs {
+		d, err := s.marshaler(v)
+		if err != nil {
+			return nil, err
+		}
+		copies[i] = newRecordVersion(s.registry, s.versionFactory, d)
+		if err = unmarshalRecord(s.registry, s.unmarshaler, d, copies[i]); err != nil {
+			return nil, err
+		}
+	}
+	return copies, nil
+}
+
+type invalidQuorumError struct{
+	n			int
+	writeQuorum	int
+	readQuorum	int
+}
+
+func (e *invalidQuorumError) Error() string { return fmt.Sprintf(`invalid quorum, write quorum (%d) and read quorum (%d) must each be between 1 and the replica count (%d) and sum to more than it`, e.writeQuorum, e.readQuorum, e.n) }
+
+type quorumNotReachedError struct{
+	op			string
+	succeeded	int
+	required	int
+	inner		error
+}
+
+func (e *quorumNotReachedError) Error() string {
+	msg := fmt.Sprintf(`%s reached %d of the %d replicas required`, e.op, e.succeeded, e.required)
+	if e.inner != nil {
+		msg += `, first replica error: ` + e.inner.Error()
+	}
+	return msg
+}
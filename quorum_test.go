@@ -0,0 +1,239 @@
+package sus
+
+import(
+	`os`
+	`errors`
+	`io/ioutil`
+	`path/filepath`
+	`strconv`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+var replicaDownErr = errors.New(`replica down`)
+
+func Test_NewQuorumStore_failure(t *testing.T){
+	_, err := NewQuorumStore(3, 1, 1, nil, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	factoryErr := errors.New(`factory error`)
+	_, err2 := NewQuorumStore(1, 1, 1, func(idf IdFactory, ei EntityInitializer) (Store, error) { return nil, factoryErr }, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	assert.Equal(t, `invalid quorum, write quorum (1) and read quorum (1) must each be between 1 and the replica count (3) and sum to more than it`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, factoryErr, err2, `err2 should be factoryErr`)
+}
+
+func Test_QuorumStore_Create_and_Read(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+
+	id, f, err := qs.Create()
+	v, readErr := qs.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, f, v, `v should equal f`)
+	for _, replica := range replicas {
+		_, err := replica.Read(id)
+		assert.Nil(t, err, `every replica should have the entity`)
+	}
+}
+
+func Test_QuorumStore_with_zero_counts(t *testing.T){
+	_, qs := newFooQuorumStore()
+
+	ids, vs, createErr := qs.CreateMulti(0)
+	readVs, readErr := qs.ReadMulti([]string{})
+
+	assert.Nil(t, ids, `ids should be nil`)
+	assert.Nil(t, vs, `vs should be nil`)
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, readVs, `readVs should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Nil(t, qs.UpdateMulti([]string{}, []Version{}), `updating zero ids should succeed`)
+	assert.Nil(t, qs.DeleteMulti([]string{}), `deleting zero ids should succeed`)
+}
+
+func Test_QuorumStore_survives_a_failed_replica(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+	replicas[2].down = true
+
+	id, f, createErr := qs.Create()
+	updateErr := qs.Update(id, f)
+	v, readErr := qs.Read(id)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+}
+
+func Test_QuorumStore_fails_without_a_quorum(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+	id, f, _ := qs.Create()
+	replicas[1].down = true
+	replicas[2].down = true
+
+	_, _, createErr := qs.Create()
+	_, readErr := qs.Read(id)
+	updateErr := qs.Update(id, f)
+
+	assert.Equal(t, `create reached 1 of the 2 replicas required, first replica error: replica down`, createErr.Error(), `createErr should contain expected msg`)
+	assert.Equal(t, `read reached 1 of the 2 replicas required, first replica error: replica down`, readErr.Error(), `readErr should contain expected msg`)
+	assert.Equal(t, `read reached 1 of the 2 replicas required, first replica error: replica down`, updateErr.Error(), `updateErr should contain expected msg`)
+	assert.Equal(t, 0, f.GetVersion(), `f's version should be unchanged`)
+}
+
+func Test_QuorumStore_read_repairs_a_lagging_replica(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+	id, f, _ := qs.Create()
+	replicas[0].down = true
+	qs.Update(id, f)
+	replicas[0].down = false
+	stale, _ := replicas[0].Read(id)
+
+	v, err := qs.Read(id)
+	repaired, _ := replicas[0].Read(id)
+
+	assert.Equal(t, 0, stale.GetVersion(), `replica 0 should have been lagging`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `the highest version should win`)
+	assert.Equal(t, 1, repaired.GetVersion(), `replica 0 should have been repaired`)
+}
+
+func Test_QuorumStore_Update_overwrites_lagging_and_missing_replicas(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+	ids, fs, _ := qs.CreateMulti(2)
+	replicas[0].down = true
+	qs.Update(ids[0], fs[0])
+	replicas[0].down = false
+	replicas[1].Delete(ids[1])
+
+	err := qs.UpdateMulti(ids, fs)
+	vs0, _ := replicas[0].ReadMulti(ids)
+	vs1, _ := replicas[1].ReadMulti(ids)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, vs0[0].GetVersion(), `replica 0 should be at version 2 for ids[0]`)
+	assert.Equal(t, 1, vs1[1].GetVersion(), `replica 1 should be at version 1 for ids[1]`)
+}
+
+func Test_QuorumStore_Update_errors(t *testing.T){
+	_, qs := newFooQuorumStore()
+	id, f, _ := qs.Create()
+	f.IncrementVersion()
+
+	seqErr := qs.Update(id, f)
+	countErr := qs.UpdateMulti([]string{``}, []Version{})
+	nonExtantErr := qs.Update(`a_fake_id`, f)
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, seqErr.Error(), `seqErr should contain expected msg`)
+	assert.Equal(t, `id count (1) not equal to entity count (0)`, countErr.Error(), `countErr should contain expected msg`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, nonExtantErr.Error(), `nonExtantErr should contain expected msg`)
+}
+
+func Test_QuorumStore_Delete_requires_every_replica(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+	id, _, _ := qs.Create()
+	replicas[2].down = true
+
+	failedErr := qs.Delete(id)
+	replicas[2].down = false
+	err := qs.Delete(id)
+	_, readErr := qs.Read(id)
+
+	assert.Equal(t, `delete reached 2 of the 3 replicas required, first replica error: replica down`, failedErr.Error(), `failedErr should contain expected msg`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+id+`" does not exist`, readErr.Error(), `readErr should contain expected msg`)
+}
+
+func Test_QuorumStore_failed_Delete_is_rolled_back(t *testing.T){
+	replicas, qs := newFooQuorumStore()
+	id, f, _ := qs.Create()
+	qs.Update(id, f)
+	replicas[2].deletesFail = true
+
+	err := qs.Delete(id)
+	vs := make([]Version, 3, 3)
+	for i, replica := range replicas {
+		vs[i], _ = replica.Read(id)
+	}
+	v, readErr := qs.Read(id)
+
+	assert.Equal(t, `delete reached 2 of the 3 replicas required, first replica error: replica down`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, []Version{&foo{1}, &foo{1}, &foo{1}}, vs, `every replica should hold the entity again`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `the entity should be read at its version before the delete`)
+}
+
+func Test_QuorumStore_with_file_store_replicas(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	replicaCount := 0
+	newReplica := func(idf IdFactory, ei EntityInitializer) (Store, error) {
+		replicaCount++
+		return NewJsonFileStore(filepath.Join(dir, strconv.Itoa(replicaCount)), idf, fooVersionFactory, ei)
+	}
+	qs, _ := NewQuorumStore(3, 2, 2, newReplica, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := qs.Create()
+
+	err := qs.Update(id, f)
+	v, readErr := qs.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+}
+
+type faultyStore struct{
+	Store
+	down			bool
+	deletesFail		bool
+}
+
+func (s *faultyStore) CreateMulti(count uint) ([]string, []Version, error) {
+	if s.down {
+		return nil, nil, replicaDownErr
+	}
+	return s.Store.CreateMulti(count)
+}
+
+func (s *faultyStore) Read(id string) (Version, error) {
+	if s.down {
+		return nil, replicaDownErr
+	}
+	return s.Store.Read(id)
+}
+
+func (s *faultyStore) ReadMulti(ids []string) ([]Version, error) {
+	if s.down {
+		return nil, replicaDownErr
+	}
+	return s.Store.ReadMulti(ids)
+}
+
+func (s *faultyStore) UpdateMulti(ids []string, vs []Version) error {
+	if s.down {
+		return replicaDownErr
+	}
+	return s.Store.UpdateMulti(ids, vs)
+}
+
+func (s *faultyStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+func (s *faultyStore) DeleteMulti(ids []string) error {
+	if s.down || s.deletesFail {
+		return replicaDownErr
+	}
+	return s.Store.DeleteMulti(ids)
+}
+
+func newFooQuorumStore() ([]*faultyStore, Store) {
+	replicas := []*faultyStore{}
+	newReplica := func(idf IdFactory, ei EntityInitializer) (Store, error) {
+		replica := &faultyStore{Store: NewJsonMemoryStore(idf, fooVersionFactory, ei)}
+		replicas = append(replicas, replica)
+		return replica, nil
+	}
+	qs, _ := NewQuorumStore(3, 2, 2, newReplica, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	return replicas, qs
+}
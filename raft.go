@@ -0,0 +1,849 @@
+package sus
+
+import(
+	`sync`
+	`time`
+	`math/rand`
+	`hash/crc32`
+	`crypto/sha256`
+)
+
+type RaftMessageType int
+
+const(
+	RaftVote RaftMessageType = iota
+	RaftVoteResp
+	RaftAppend
+	RaftAppendResp
+	RaftSnapshot
+	RaftPropose
+	RaftProposeResp
+	RaftReadIndex
+	RaftReadIndexResp
+)
+
+const(
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+	raftMaxAppendEntries = 256
+)
+
+// An entry in a raft log.
+type RaftEntry struct{
+	Index	uint64
+	Term	uint64
+	Data	[]byte
+}
+
+// A message between raft nodes. Index and LogTerm carry the previous log position for appends, the last log position
+// for votes, the matched (or hinted) position for append responses and the snapshot position for snapshots. On appends
+// and snapshots RequestId carries the leader's read round, which responses echo back to confirm its leadership.
+type RaftMessage struct{
+	Type		RaftMessageType
+	From		string
+	To			string
+	Term		uint64
+	Index		uint64
+	LogTerm		uint64
+	Entries		[]RaftEntry
+	Commit		uint64
+	Success		bool
+	Snapshot	[]byte
+	RequestId	uint64
+	Data		[]byte
+	Error		string
+}
+
+// Carries messages between raft nodes, delivery is best effort and may reorder or drop messages.
+type RaftTransport interface{
+	Send(msg RaftMessage)
+	// Registers the function that messages addressed to this node are delivered to.
+	Listen(handler func(msg RaftMessage))
+	Close() error
+}
+
+// Configuration for a raft store node, zero values are replaced with defaults.
+type RaftConfig struct{
+	// This node's id, it must be one of Peers.
+	Id					string
+	// The ids of every node in the cluster including this one.
+	Peers				[]string
+	Transport			RaftTransport
+	// Ticks without hearing from a leader before starting an election, randomized up to double. Defaults to 10.
+	ElectionTicks		int
+	// Ticks between leader heartbeats. Defaults to 1.
+	HeartbeatTicks		int
+	// Applied entries kept in the log before it is compacted into a snapshot. Defaults to 1000.
+	SnapshotThreshold	int
+	// How long a transaction waits for the cluster before giving up. Defaults to 5 seconds.
+	ProposalTimeout		time.Duration
+}
+
+// A store replicated across a cluster of nodes by a raft log.
+type RaftStore interface{
+	Store
+	// Advances the node's logical clock, driving elections and heartbeats.
+	Tick()
+	// Calls Tick every tickInterval in the background until Close.
+	Run(tickInterval time.Duration)
+	// Returns the id of the current leader as far as this node knows, empty if unknown.
+	Leader() string
+	IsLeader() bool
+	// Stops the background ticker and closes the transport.
+	Close() error
+}
+
+// Creates and configures a store that stores entities by converting them to and from []byte and keeps them in the
+// local system memory of every node in a raft cluster. Each transaction runs against the node's local copy after
+// catching up to a read index, the leader's commit index once it has committed an entry of its own term and a majority
+// has confirmed it is still the leader, so even read only transactions are linearizable. Its writes along with a
+// digest of everything it read are then committed through the raft log (forwarded to the leader if need be) and only
+// applied on each node if nothing it read has changed since, otherwise it fails with a conflict error. Ids must be
+// unique across the cluster, so idf should not be a plain counter. Raft state, the term, vote and log, is only held in
+// memory and membership is fixed by cfg, so a node that restarts can not rejoin the cluster, doing so could forget a
+// vote it cast and elect two leaders for one term. A cluster stays available only while a majority of its original
+// nodes are still running.
+func NewRaftStore(cfg RaftConfig, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) (RaftStore, error) {
+	if cfg.Transport == nil {
+		return nil, &invalidRaftConfigError{`a transport is required`}
+	}
+	s := &raftStore{
+		id: cfg.Id,
+		transport: cfg.Transport,
+		electionTicks: cfg.ElectionTicks,
+		heartbeatTicks: cfg.HeartbeatTicks,
+		snapshotThreshold: uint64(cfg.SnapshotThreshold),
+		proposalTimeout: cfg.ProposalTimeout,
+		rand: rand.New(rand.NewSource(int64(crc32.ChecksumIEEE([]byte(cfg.Id))))),
+		data: newStagedMap(),
+		nextIndex: map[string]uint64{},
+		matchIndex: map[string]uint64{},
+		proposals: map[uint64]chan error{},
+		readIndexes: map[uint64]chan RaftMessage{},
+		applyWaiters: map[chan struct{}]uint64{},
+		stop: make(chan struct{}),
+	}
+	isPeer := false
+	for _, peer := range cfg.Peers {
+		if peer == cfg.Id {
+			isPeer = true
+		} else {
+			s.peers = append(s.peers, peer)
+		}
+	}
+	if !isPeer {
+		return nil, &invalidRaftConfigError{`id "`+cfg.Id+`" is not one of the peers`}
+	}
+	if s.electionTicks <= 0 {
+		s.electionTicks = 10
+	}
+	if s.heartbeatTicks <= 0 {
+		s.heartbeatTicks = 1
+	}
+	if s.snapshotThreshold == 0 {
+		s.snapshotThreshold = 1000
+	}
+	if s.proposalTimeout <= 0 {
+		s.proposalTimeout = 5 * time.Second
+	}
+	s.resetElectionTimeout()
+	s.Store = NewByteStore(s.get, s.data.put, s.data.del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, s.runInTransaction)
+	s.transport.Listen(s.step)
+	return s, nil
+}
+
+type raftRead struct{
+	exists	bool
+	sum		[sha256.Size]byte
+}
+
+// A read index request the leader is serving for from, it is answered with index once a majority has acknowledged a
+// heartbeat from round, a round of 0 means it is still waiting for an entry of the leader's term to commit.
+type raftReadRequest struct{
+	from	string
+	reqId	uint64
+	index	uint64
+	round	uint64
+	acks	map[string]bool
+}
+
+type raftStore struct{
+	Store
+	id					string
+	peers				[]string
+	transport			RaftTransport
+	electionTicks		int
+	heartbeatTicks		int
+	snapshotThreshold	uint64
+	proposalTimeout		time.Duration
+	rand				*rand.Rand
+	txMtx				sync.Mutex
+	mtx					sync.Mutex
+	state				int
+	term				uint64
+	votedFor			string
+	leader				string
+	votes				map[string]bool
+	entries				[]RaftEntry
+	snapIndex			uint64
+	snapTerm			uint64
+	snapshot			[]byte
+	commitIndex			uint64
+	lastApplied			uint64
+	nextIndex			map[string]uint64
+	matchIndex			map[string]uint64
+	electionElapsed		int
+	electionTimeout		int
+	heartbeatElapsed	int
+	data				*stagedMap
+	reads				map[string]raftRead
+	outbox				[]RaftMessage
+	requestSeq			uint64
+	proposals			map[uint64]chan error
+	readIndexes			map[uint64]chan RaftMessage
+	readRequests		[]*raftReadRequest
+	readRound			uint64
+	applyWaiters		map[chan struct{}]uint64
+	stop				chan struct{}
+	stopOnce			sync.Once
+	running				sync.WaitGroup
+}
+
+// Advances the node's logical clock, driving elections and heartbeats.
+func (s *raftStore) Tick() {
+	s.mtx.Lock()
+	if s.state == raftLeader {
+		s.heartbeatElapsed++
+		if s.heartbeatElapsed >= s.heartbeatTicks {
+			s.heartbeatElapsed = 0
+			s.broadcastAppend()
+		}
+	} else {
+		s.electionElapsed++
+		if s.electionElapsed >= s.electionTimeout {
+			s.campaign()
+		}
+	}
+	s.mtx.Unlock()
+	s.flush()
+}
+
+// Calls Tick every tickInterval in the background until Close.
+func (s *raftStore) Run(tickInterval time.Duration) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Tick()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Returns the id of the current leader as far as this node knows, empty if unknown.
+func (s *raftStore) Leader() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.leader
+}
+
+func (s *raftStore) IsLeader() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.state == raftLeader
+}
+
+// Stops the background ticker and closes the transport.
+func (s *raftStore) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.running.Wait()
+	return s.transport.Close()
+}
+
+// Runs fn as an interactive transaction whose writes are committed through the raft log.
+func (s *raftStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+// Runs tran against the local data once it has caught up with the leader and commits its writes through the log.
+func (s *raftStore) runInTransaction(tran Transaction) error {
+	s.txMtx.Lock()
+	defer s.txMtx.Unlock()
+	deadline := time.Now().Add(s.proposalTimeout)
+	if err := s.readBarrier(deadline); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.reads = map[string]raftRead{}
+	err := tran()
+	ops, reads := s.data.pending, s.reads
+	s.data.rollback()
+	s.reads = nil
+	if err != nil || len(ops) == 0 {
+		s.mtx.Unlock()
+		return err
+	}
+	s.requestSeq++
+	reqId := s.requestSeq
+	result := make(chan error, 1)
+	s.proposals[reqId] = result
+	data := encodeRaftBatch(s.id, reqId, reads, ops)
+	if s.state == raftLeader {
+		s.appendEntry(data)
+	} else if s.leader != `` {
+		s.send(RaftMessage{Type: RaftPropose, To: s.leader, RequestId: reqId, Data: data})
+	} else {
+		delete(s.proposals, reqId)
+		s.mtx.Unlock()
+		return &raftNoLeaderError{}
+	}
+	s.mtx.Unlock()
+	s.flush()
+	select {
+	case err = <-result:
+		return err
+	case <-time.After(deadline.Sub(time.Now())):
+		s.mtx.Lock()
+		delete(s.proposals, reqId)
+		s.mtx.Unlock()
+		return &raftTimeoutError{}
+	}
+}
+
+// Waits until this node has applied everything up to a read index from the leader.
+func (s *raftStore) readBarrier(deadline time.Time) error {
+	for {
+		s.mtx.Lock()
+		if s.leader != `` {
+			break
+		}
+		s.mtx.Unlock()
+		if time.Now().After(deadline) {
+			return &raftNoLeaderError{}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.requestSeq++
+	reqId := s.requestSeq
+	resp := make(chan RaftMessage, 1)
+	s.readIndexes[reqId] = resp
+	if s.state == raftLeader {
+		s.requestReadIndex(s.id, reqId)
+	} else {
+		s.send(RaftMessage{Type: RaftReadIndex, To: s.leader, RequestId: reqId})
+	}
+	s.mtx.Unlock()
+	s.flush()
+	select {
+	case msg := <-resp:
+		if msg.Error != `` {
+			return &raftForwardingError{msg.Error}
+		}
+		return s.waitApplied(msg.Index, deadline)
+	case <-time.After(deadline.Sub(time.Now())):
+		s.mtx.Lock()
+		delete(s.readIndexes, reqId)
+		s.mtx.Unlock()
+		return &raftTimeoutError{}
+	}
+}
+
+func (s *raftStore) waitApplied(index uint64, deadline time.Time) error {
+	s.mtx.Lock()
+	if s.lastApplied >= index {
+		s.mtx.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.applyWaiters[ch] = index
+	s.mtx.Unlock()
+	select {
+	case <-ch:
+		return nil
+	case <-time.After(deadline.Sub(time.Now())):
+		s.mtx.Lock()
+		delete(s.applyWaiters, ch)
+		s.mtx.Unlock()
+		return &raftTimeoutError{}
+	}
+}
+
+// Reads from the local data, recording a digest of anything read from committed state so the write can be validated.
+func (s *raftStore) get(id string) ([]byte, error) {
+	d, err := s.data.get(id)
+	if _, staged := s.data.pendingIdx[id]; !staged && s.reads != nil {
+		if _, seen := s.reads[id]; !seen {
+			s.reads[id] = raftRead{err == nil, sha256.Sum256(d)}
+		}
+	}
+	return d, err
+}
+
+func (s *raftStore) step(msg RaftMessage) {
+	s.mtx.Lock()
+	s.stepLocked(msg)
+	s.mtx.Unlock()
+	s.flush()
+}
+
+func (s *raftStore) stepLocked(msg RaftMessage) {
+	if msg.Term > s.term {
+		s.becomeFollower(msg.Term, ``)
+	}
+	switch msg.Type {
+	case RaftVote:
+		grant := msg.Term == s.term && (s.votedFor == `` || s.votedFor == msg.From) && s.isUpToDate(msg.LogTerm, msg.Index)
+		if grant {
+			s.votedFor = msg.From
+			s.electionElapsed = 0
+		}
+		s.send(RaftMessage{Type: RaftVoteResp, To: msg.From, Success: grant})
+	case RaftVoteResp:
+		if s.state == raftCandidate && msg.Term == s.term && msg.Success {
+			s.votes[msg.From] = true
+			if s.isQuorum(len(s.votes)) {
+				s.becomeLeader()
+			}
+		}
+	case RaftAppend:
+		if msg.Term < s.term {
+			s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: s.lastIndex()})
+			return
+		}
+		s.becomeFollower(msg.Term, msg.From)
+		s.handleAppend(msg)
+	case RaftAppendResp:
+		if s.state != raftLeader || msg.Term != s.term {
+			return
+		}
+		s.ackReads(msg.From, msg.RequestId)
+		if msg.Success {
+			if msg.Index > s.matchIndex[msg.From] {
+				s.matchIndex[msg.From] = msg.Index
+			}
+			s.nextIndex[msg.From] = s.matchIndex[msg.From] + 1
+			s.maybeCommit()
+			if s.nextIndex[msg.From] <= s.lastIndex() {
+				s.sendAppend(msg.From)
+			}
+		} else {
+			if msg.Index+1 < s.nextIndex[msg.From] {
+				s.nextIndex[msg.From] = msg.Index + 1
+			} else if s.nextIndex[msg.From] > 1 {
+				s.nextIndex[msg.From]--
+			}
+			s.sendAppend(msg.From)
+		}
+	case RaftSnapshot:
+		if msg.Term < s.term {
+			s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: s.lastIndex()})
+			return
+		}
+		s.becomeFollower(msg.Term, msg.From)
+		if msg.Index > s.commitIndex {
+			s.installSnapshot(msg.Index, msg.LogTerm, msg.Snapshot)
+		}
+		s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: s.commitIndex, Success: true, RequestId: msg.RequestId})
+	case RaftPropose:
+		if s.state != raftLeader {
+			s.send(RaftMessage{Type: RaftProposeResp, To: msg.From, RequestId: msg.RequestId, Error: `node "`+s.id+`" is not the leader`})
+			return
+		}
+		s.appendEntry(msg.Data)
+	case RaftProposeResp:
+		if result := s.proposals[msg.RequestId]; result != nil {
+			delete(s.proposals, msg.RequestId)
+			result <- &raftForwardingError{msg.Error}
+		}
+	case RaftReadIndex:
+		if s.state != raftLeader {
+			s.send(RaftMessage{Type: RaftReadIndexResp, To: msg.From, RequestId: msg.RequestId, Error: `node "`+s.id+`" is not the leader`})
+			return
+		}
+		s.requestReadIndex(msg.From, msg.RequestId)
+	case RaftReadIndexResp:
+		if resp := s.readIndexes[msg.RequestId]; resp != nil {
+			delete(s.readIndexes, msg.RequestId)
+			resp <- msg
+		}
+	}
+}
+
+func (s *raftStore) handleAppend(msg RaftMessage) {
+	prev, prevTerm, entries := msg.Index, msg.LogTerm, msg.Entries
+	if prev < s.snapIndex {
+		// everything up to the snapshot is already committed here, skip the overlap.
+		skip := s.snapIndex - prev
+		if skip >= uint64(len(entries)) {
+			s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: prev + uint64(len(entries)), Success: true, RequestId: msg.RequestId})
+			return
+		}
+		entries = entries[skip:]
+		prev, prevTerm = s.snapIndex, s.snapTerm
+	}
+	if prev > s.lastIndex() {
+		s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: s.lastIndex(), RequestId: msg.RequestId})
+		return
+	}
+	if s.termAt(prev) != prevTerm {
+		s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: prev - 1, RequestId: msg.RequestId})
+		return
+	}
+	for i, e := range entries {
+		if e.Index <= s.lastIndex() {
+			if s.termAt(e.Index) == e.Term {
+				continue
+			}
+			s.entries = s.entries[:e.Index-s.snapIndex-1]
+		}
+		s.entries = append(s.entries, entries[i:]...)
+		break
+	}
+	lastNew := prev + uint64(len(entries))
+	if msg.Commit > s.commitIndex {
+		s.commitIndex = msg.Commit
+		if lastNew < s.commitIndex {
+			s.commitIndex = lastNew
+		}
+		s.applyCommitted()
+	}
+	s.send(RaftMessage{Type: RaftAppendResp, To: msg.From, Index: lastNew, Success: true, RequestId: msg.RequestId})
+}
+
+func (s *raftStore) campaign() {
+	s.term++
+	s.state = raftCandidate
+	s.votedFor = s.id
+	s.leader = ``
+	s.votes = map[string]bool{s.id: true}
+	s.resetElectionTimeout()
+	if s.isQuorum(1) {
+		s.becomeLeader()
+		return
+	}
+	for _, peer := range s.peers {
+		s.send(RaftMessage{Type: RaftVote, To: peer, Index: s.lastIndex(), LogTerm: s.termAt(s.lastIndex())})
+	}
+}
+
+func (s *raftStore) becomeFollower(term uint64, leader string) {
+	if s.state == raftLeader {
+		for _, req := range s.readRequests {
+			s.answerRead(req, `node "`+s.id+`" is no longer the leader`)
+		}
+		s.readRequests = nil
+	}
+	if term > s.term {
+		s.term = term
+		s.votedFor = ``
+	}
+	s.state = raftFollower
+	s.leader = leader
+	s.electionElapsed = 0
+}
+
+func (s *raftStore) becomeLeader() {
+	s.state = raftLeader
+	s.leader = s.id
+	s.heartbeatElapsed = 0
+	for _, peer := range s.peers {
+		s.nextIndex[peer] = s.lastIndex() + 1
+		s.matchIndex[peer] = 0
+	}
+	// an empty entry from the new term lets entries from earlier terms be committed.
+	s.appendEntry(nil)
+}
+
+func (s *raftStore) appendEntry(data []byte) {
+	s.entries = append(s.entries, RaftEntry{s.lastIndex() + 1, s.term, data})
+	s.maybeCommit()
+	s.broadcastAppend()
+}
+
+func (s *raftStore) broadcastAppend() {
+	for _, peer := range s.peers {
+		s.sendAppend(peer)
+	}
+}
+
+func (s *raftStore) sendAppend(peer string) {
+	next := s.nextIndex[peer]
+	if next <= s.snapIndex {
+		s.send(RaftMessage{Type: RaftSnapshot, To: peer, Index: s.snapIndex, LogTerm: s.snapTerm, Snapshot: s.snapshot, RequestId: s.readRound})
+		return
+	}
+	if next < 1 {
+		next = 1
+	}
+	prev := next - 1
+	entries := s.entries[prev-s.snapIndex:]
+	if len(entries) > raftMaxAppendEntries {
+		entries = entries[:raftMaxAppendEntries]
+	}
+	s.send(RaftMessage{Type: RaftAppend, To: peer, Index: prev, LogTerm: s.termAt(prev), Entries: append([]RaftEntry{}, entries...), Commit: s.commitIndex, RequestId: s.readRound})
+}
+
+func (s *raftStore) maybeCommit() {
+	for n := s.lastIndex(); n > s.commitIndex && s.termAt(n) == s.term; n-- {
+		count := 1
+		for _, peer := range s.peers {
+			if s.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if s.isQuorum(count) {
+			s.commitIndex = n
+			s.applyCommitted()
+			s.startReadRound()
+			return
+		}
+	}
+}
+
+// Queues a read index request from from, the leader's own id for local transactions.
+func (s *raftStore) requestReadIndex(from string, reqId uint64) {
+	s.readRequests = append(s.readRequests, &raftReadRequest{from: from, reqId: reqId})
+	s.startReadRound()
+}
+
+// Once an entry of the current term has committed, takes the commit index as the read index of every request waiting
+// for one and sends a heartbeat round to confirm this node is still the leader.
+func (s *raftStore) startReadRound() {
+	if s.termAt(s.commitIndex) != s.term {
+		return
+	}
+	started := false
+	for _, req := range s.readRequests {
+		if req.round == 0 {
+			if !started {
+				s.readRound++
+				started = true
+			}
+			req.index, req.round, req.acks = s.commitIndex, s.readRound, map[string]bool{s.id: true}
+		}
+	}
+	if started {
+		s.ackReads(s.id, s.readRound)
+		s.broadcastAppend()
+	}
+}
+
+// Records that peer acknowledged this leader in round and answers every request a majority has now confirmed.
+func (s *raftStore) ackReads(peer string, round uint64) {
+	pending := s.readRequests[:0]
+	for _, req := range s.readRequests {
+		if req.round != 0 && req.round <= round {
+			req.acks[peer] = true
+		}
+		if req.round != 0 && s.isQuorum(len(req.acks)) {
+			s.answerRead(req, ``)
+		} else {
+			pending = append(pending, req)
+		}
+	}
+	s.readRequests = pending
+}
+
+func (s *raftStore) answerRead(req *raftReadRequest, errMsg string) {
+	msg := RaftMessage{Type: RaftReadIndexResp, To: req.from, RequestId: req.reqId, Index: req.index, Error: errMsg}
+	if req.from != s.id {
+		s.send(msg)
+	} else if resp := s.readIndexes[req.reqId]; resp != nil {
+		delete(s.readIndexes, req.reqId)
+		resp <- msg
+	}
+}
+
+func (s *raftStore) applyCommitted() {
+	for s.lastApplied < s.commitIndex {
+		s.lastApplied++
+		s.apply(s.entries[s.lastApplied-s.snapIndex-1])
+	}
+	s.notifyApplied()
+	if s.lastApplied-s.snapIndex >= s.snapshotThreshold {
+		s.takeSnapshot()
+	}
+}
+
+// Applies a committed entry's writes if everything its transaction read is unchanged, reporting back to the proposer.
+func (s *raftStore) apply(e RaftEntry) {
+	if len(e.Data) == 0 {
+		return
+	}
+	proposer, reqId, reads, ops, ok := decodeRaftBatch(e.Data)
+	if !ok {
+		return
+	}
+	var err error
+	for id, read := range reads {
+		d, exists := s.data.data[id]
+		if exists != read.exists || (exists && sha256.Sum256(d) != read.sum) {
+			err = &txConflictError{id}
+			break
+		}
+	}
+	if err == nil {
+		applyOps(s.data.data, ops)
+	}
+	if proposer == s.id {
+		if result := s.proposals[reqId]; result != nil {
+			delete(s.proposals, reqId)
+			result <- err
+		}
+	}
+}
+
+func (s *raftStore) takeSnapshot() {
+	ops := make([]*logOp, 0, len(s.data.data))
+	for id, d := range s.data.data {
+		ops = append(ops, &logOp{putOp, id, d})
+	}
+	s.snapshot = encodeRecord(ops)
+	s.snapTerm = s.termAt(s.lastApplied)
+	s.entries = append([]RaftEntry{}, s.entries[s.lastApplied-s.snapIndex:]...)
+	s.snapIndex = s.lastApplied
+}
+
+func (s *raftStore) installSnapshot(index, term uint64, snapshot []byte) {
+	ops, n := decodeRecord(snapshot)
+	if n != len(snapshot) {
+		return
+	}
+	if index < s.lastIndex() && s.termAt(index) == term {
+		s.entries = append([]RaftEntry{}, s.entries[index-s.snapIndex:]...)
+	} else {
+		s.entries = nil
+	}
+	s.data.data = map[string][]byte{}
+	applyOps(s.data.data, ops)
+	s.snapshot = snapshot
+	s.snapIndex, s.snapTerm = index, term
+	s.commitIndex, s.lastApplied = index, index
+	s.notifyApplied()
+}
+
+func (s *raftStore) notifyApplied() {
+	for ch, index := range s.applyWaiters {
+		if s.lastApplied >= index {
+			delete(s.applyWaiters, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *raftStore) lastIndex() uint64 {
+	return s.snapIndex + uint64(len(s.entries))
+}
+
+func (s *raftStore) termAt(index uint64) uint64 {
+	if index == s.snapIndex {
+		return s.snapTerm
+	}
+	if index < s.snapIndex || index > s.lastIndex() {
+		return 0
+	}
+	return s.entries[index-s.snapIndex-1].Term
+}
+
+func (s *raftStore) isUpToDate(lastTerm, lastIndex uint64) bool {
+	ourTerm := s.termAt(s.lastIndex())
+	return lastTerm > ourTerm || (lastTerm == ourTerm && lastIndex >= s.lastIndex())
+}
+
+func (s *raftStore) isQuorum(count int) bool {
+	return count*2 > len(s.peers)+1
+}
+
+func (s *raftStore) resetElectionTimeout() {
+	s.electionElapsed = 0
+	s.electionTimeout = s.electionTicks + s.rand.Intn(s.electionTicks)
+}
+
+func (s *raftStore) send(msg RaftMessage) {
+	msg.From = s.id
+	msg.Term = s.term
+	s.outbox = append(s.outbox, msg)
+}
+
+// Hands queued messages to the transport, outside of s.mtx so a transport may deliver synchronously.
+func (s *raftStore) flush() {
+	s.mtx.Lock()
+	outbox := s.outbox
+	s.outbox = nil
+	s.mtx.Unlock()
+	for _, msg := range outbox {
+		s.transport.Send(msg)
+	}
+}
+
+func encodeRaftBatch(proposer string, reqId uint64, reads map[string]raftRead, ops []*logOp) []byte {
+	b := appendUvarint(nil, uint64(len(proposer)))
+	b = append(b, proposer...)
+	b = appendUvarint(b, reqId)
+	b = appendUvarint(b, uint64(len(reads)))
+	for id, read := range reads {
+		b = appendUvarint(b, uint64(len(id)))
+		b = append(b, id...)
+		if read.exists {
+			b = append(b, 1)
+			b = append(b, read.sum[:]...)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return append(b, encodeRecord(ops)...)
+}
+
+func decodeRaftBatch(b []byte) (proposer string, reqId uint64, reads map[string]raftRead, ops []*logOp, ok bool) {
+	r := &byteReader{b: b}
+	proposer = string(r.bytes(r.uvarint()))
+	reqId = r.uvarint()
+	count := r.uvarint()
+	if count > uint64(len(b)) {
+		return
+	}
+	reads = make(map[string]raftRead, int(count))
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		id := string(r.bytes(r.uvarint()))
+		read := raftRead{exists: r.byte() == 1}
+		if read.exists {
+			copy(read.sum[:], r.bytes(sha256.Size))
+		}
+		reads[id] = read
+	}
+	if r.err != nil {
+		return
+	}
+	ops, n := decodeRecord(r.b)
+	ok = n > 0 && n == len(r.b)
+	return
+}
+
+type invalidRaftConfigError struct{
+	reason	string
+}
+
+func (e *invalidRaftConfigError) Error() string { return `invalid raft config, `+e.reason }
+
+type raftNoLeaderError struct{}
+
+func (e *raftNoLeaderError) Error() string { return `no raft leader is known` }
+
+type raftTimeoutError struct{}
+
+func (e *raftTimeoutError) Error() string { return `timed out waiting for the raft cluster, the outcome of the transaction is unknown` }
+
+type raftForwardingError struct{
+	reason	string
+}
+
+func (e *raftForwardingError) Error() string { return `raft leader rejected forwarded request: `+e.reason }
@@ -0,0 +1,301 @@
+package sus
+
+import(
+	`fmt`
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_NewRaftStore_failure(t *testing.T){
+	network := NewRaftMemoryNetwork()
+
+	_, noTransportErr := NewRaftStore(RaftConfig{Id: `a`, Peers: []string{`a`}}, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	_, notPeerErr := NewRaftStore(RaftConfig{Id: `a`, Peers: []string{`b`}, Transport: network.Transport(`a`)}, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	assert.Equal(t, `invalid raft config, a transport is required`, noTransportErr.Error(), `noTransportErr should contain expected msg`)
+	assert.Equal(t, `invalid raft config, id "a" is not one of the peers`, notPeerErr.Error(), `notPeerErr should contain expected msg`)
+}
+
+func Test_RaftStore_single_node(t *testing.T){
+	c := newRaftTestCluster(1, 0)
+	defer c.close()
+
+	id, f, createErr := c.nodes[0].Create()
+	updateErr := c.nodes[0].Update(id, f)
+	v, readErr := c.nodes[0].Read(id)
+	deleteErr := c.nodes[0].Delete(id)
+	_, goneErr := c.nodes[0].Read(id)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+id+`" does not exist`, goneErr.Error(), `goneErr should contain expected msg`)
+}
+
+func Test_RaftStore_replicates_to_followers(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	leader := c.leader()
+
+	id, f, createErr := c.nodes[leader].Create()
+	updateErr := c.nodes[leader].Update(id, f)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	for i, node := range c.nodes {
+		v, err := node.Read(id)
+		assert.Nil(t, err, `node %d should have the entity`, i)
+		assert.Equal(t, 1, v.GetVersion(), `node %d should have version 1`, i)
+		assert.Equal(t, c.nodes[leader].Leader(), node.Leader(), `node %d should agree on the leader`, i)
+	}
+}
+
+func Test_RaftStore_forwards_follower_writes(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	follower := (c.leader() + 1) % 3
+
+	id, f, createErr := c.nodes[follower].Create()
+	updateErr := c.nodes[follower].Update(id, f)
+	v, readErr := c.nodes[c.leader()].Read(id)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+}
+
+func Test_RaftStore_Update_errors(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	node := c.nodes[c.leader()]
+	id, f, _ := node.Create()
+	f.IncrementVersion()
+
+	seqErr := node.Update(id, f)
+	nonExtantErr := node.Update(`a_fake_id`, f)
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, seqErr.Error(), `seqErr should contain expected msg`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, nonExtantErr.Error(), `nonExtantErr should contain expected msg`)
+}
+
+func Test_RaftStore_conflicting_write_is_rejected(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	leader := c.nodes[c.leader()]
+	follower := c.nodes[(c.leader() + 1) % 3].(*raftStore)
+	id, f, _ := leader.Create()
+	follower.Read(id)
+	var staleRead func()
+	staleRead = func() {
+		// another write lands between this transaction's read and its commit.
+		staleRead = nil
+		leader.Update(id, f)
+	}
+	conflicted := follower.Store
+	follower.Store = NewByteStore(func(id string) ([]byte, error) {
+		d, err := follower.get(id)
+		if staleRead != nil {
+			follower.mtx.Unlock()
+			staleRead()
+			follower.mtx.Lock()
+		}
+		return d, err
+	}, follower.data.put, follower.data.del, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, follower.runInTransaction)
+	stale, _ := leader.Read(id)
+
+	err := follower.Update(id, stale)
+	follower.Store = conflicted
+	v, _ := follower.Read(id)
+
+	assert.Equal(t, `transaction conflicted with a concurrent write to entity with id "`+id+`"`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, 0, stale.GetVersion(), `stale's version should be unchanged`)
+	assert.Equal(t, 1, v.GetVersion(), `only the leader's update should have been applied`)
+}
+
+func Test_RaftStore_survives_leader_failure(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	oldLeader := c.leader()
+	id, f, _ := c.nodes[oldLeader].Create()
+	c.network.Isolate(c.ids[oldLeader], true)
+
+	newLeader := c.leaderOtherThan(oldLeader)
+	updateErr := c.nodes[newLeader].Update(id, f)
+	c.network.Isolate(c.ids[oldLeader], false)
+	for c.nodes[oldLeader].IsLeader() {
+		time.Sleep(time.Millisecond)
+	}
+	v, readErr := c.nodes[oldLeader].Read(id)
+
+	assert.NotEqual(t, oldLeader, newLeader, `a new leader should have been elected`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `the old leader should have caught up`)
+	assert.False(t, c.nodes[oldLeader].IsLeader(), `the old leader should have stepped down`)
+}
+
+func Test_RaftStore_isolated_leader_can_not_commit(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	leader := c.leader()
+	c.network.Isolate(c.ids[leader], true)
+
+	_, _, err := c.nodes[leader].Create()
+
+	assert.Equal(t, `timed out waiting for the raft cluster, the outcome of the transaction is unknown`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_RaftStore_isolated_leader_can_not_serve_reads(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	leader := c.leader()
+	id, _, _ := c.nodes[leader].Create()
+	c.network.Isolate(c.ids[leader], true)
+
+	_, err := c.nodes[leader].Read(id)
+
+	assert.Equal(t, `timed out waiting for the raft cluster, the outcome of the transaction is unknown`, err.Error(), `a leader that can not confirm its leadership should not serve reads`)
+}
+
+func Test_RaftStore_catches_up_from_snapshot(t *testing.T){
+	c := newRaftTestCluster(3, 5)
+	defer c.close()
+	leader := c.leader()
+	lagging := (leader + 1) % 3
+	id, f, _ := c.nodes[leader].Create()
+	c.network.Isolate(c.ids[lagging], true)
+
+	for i := 0; i < 20; i++ {
+		c.nodes[leader].Update(id, f)
+	}
+	c.network.Isolate(c.ids[lagging], false)
+	v, err := c.nodes[lagging].Read(id)
+	node := c.nodes[lagging].(*raftStore)
+	node.mtx.Lock()
+	snapIndex := node.snapIndex
+	node.mtx.Unlock()
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 20, v.GetVersion(), `v's version should be 20`)
+	assert.True(t, snapIndex > 0, `the lagging node should have installed a snapshot`)
+}
+
+func Test_RaftStore_Transact(t *testing.T){
+	c := newRaftTestCluster(3, 0)
+	defer c.close()
+	follower := c.nodes[(c.leader() + 1) % 3]
+	ids, _, _ := follower.CreateMulti(2)
+
+	err := follower.(Transactor).Transact(func(tx Tx) error {
+		a, _ := tx.Read(ids[0])
+		tx.Update(ids[0], a)
+		return tx.Delete(ids[1])
+	})
+	a, _ := c.nodes[c.leader()].Read(ids[0])
+	_, deletedErr := c.nodes[c.leader()].Read(ids[1])
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, a.GetVersion(), `a's version should be 1`)
+	assert.NotNil(t, deletedErr, `the deleted entity should be gone`)
+}
+
+func Test_RaftStore_over_tcp(t *testing.T){
+	ids := []string{`a`, `b`, `c`}
+	transports := make([]*RaftTCPTransport, 3, 3)
+	for i := range ids {
+		transports[i], _ = NewRaftTCPTransport(`127.0.0.1:0`, nil)
+	}
+	nodes := make([]RaftStore, 3, 3)
+	for i, id := range ids {
+		for j, peer := range ids {
+			transports[i].AddPeer(peer, transports[j].Addr())
+		}
+		nodes[i], _ = NewRaftStore(RaftConfig{Id: id, Peers: ids, Transport: transports[i], ProposalTimeout: 5 * time.Second}, JsonMarshaler, JsonUnmarshaler, newRaftTestIdFactory(id), fooVersionFactory, fooEntityInitializer)
+		nodes[i].Run(5 * time.Millisecond)
+		defer nodes[i].Close()
+	}
+
+	id, f, createErr := nodes[0].Create()
+	updateErr := nodes[1].Update(id, f)
+	v, readErr := nodes[2].Read(id)
+
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+}
+
+type raftTestCluster struct{
+	ids		[]string
+	nodes	[]RaftStore
+	network	*RaftMemoryNetwork
+	stop	chan struct{}
+	done	chan struct{}
+}
+
+// Builds an n node cluster on a memory network which is pumped in the background until close.
+func newRaftTestCluster(n int, snapshotThreshold int) *raftTestCluster {
+	c := &raftTestCluster{
+		network: NewRaftMemoryNetwork(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		c.ids = append(c.ids, fmt.Sprintf(`n%d`, i))
+	}
+	for _, id := range c.ids {
+		node, _ := NewRaftStore(RaftConfig{Id: id, Peers: c.ids, Transport: c.network.Transport(id), SnapshotThreshold: snapshotThreshold, ProposalTimeout: time.Second}, JsonMarshaler, JsonUnmarshaler, newRaftTestIdFactory(id), fooVersionFactory, fooEntityInitializer)
+		c.nodes = append(c.nodes, node)
+	}
+	go func() {
+		defer close(c.done)
+		for {
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+			for _, node := range c.nodes {
+				node.Tick()
+			}
+			for c.network.Deliver() > 0 {}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	return c
+}
+
+func (c *raftTestCluster) leader() int {
+	return c.leaderOtherThan(-1)
+}
+
+// Waits for a node other than the excluded one to become leader and returns its index.
+func (c *raftTestCluster) leaderOtherThan(excluded int) int {
+	for {
+		for i, node := range c.nodes {
+			if i != excluded && node.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *raftTestCluster) close() {
+	close(c.stop)
+	<-c.done
+	for _, node := range c.nodes {
+		node.Close()
+	}
+}
+
+func newRaftTestIdFactory(node string) IdFactory {
+	idf := newFooIdFactory()
+	return func() string {
+		return node + `-` + idf()
+	}
+}
@@ -0,0 +1,250 @@
+package sus
+
+import(
+	`net`
+	`sync`
+	`time`
+	`encoding/gob`
+)
+
+const(
+	raftSendQueueLen = 1024
+	raftDialTimeout = time.Second
+)
+
+// An in-process network for raft nodes that only moves messages when told to, so tests can drive a cluster
+// deterministically. Messages are delivered in the order they were sent unless either end is isolated, in which
+// case they are dropped.
+type RaftMemoryNetwork struct{
+	mtx			sync.Mutex
+	queue		[]RaftMessage
+	handlers	map[string]func(msg RaftMessage)
+	isolated	map[string]bool
+}
+
+func NewRaftMemoryNetwork() *RaftMemoryNetwork {
+	return &RaftMemoryNetwork{
+		handlers: map[string]func(msg RaftMessage){},
+		isolated: map[string]bool{},
+	}
+}
+
+// Returns the transport for the node with id.
+func (n *RaftMemoryNetwork) Transport(id string) RaftTransport {
+	return &memoryRaftTransport{n, id}
+}
+
+// Cuts the node with id off from (or reconnects it to) every other node.
+func (n *RaftMemoryNetwork) Isolate(id string, isolated bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.isolated[id] = isolated
+}
+
+// Delivers every queued message, messages sent while delivering wait for the next call. Returns the number delivered.
+func (n *RaftMemoryNetwork) Deliver() int {
+	n.mtx.Lock()
+	queue := n.queue
+	n.queue = nil
+	n.mtx.Unlock()
+	delivered := 0
+	for _, msg := range queue {
+		n.mtx.Lock()
+		handler := n.handlers[msg.To]
+		dropped := n.isolated[msg.From] || n.isolated[msg.To]
+		n.mtx.Unlock()
+		if handler != nil && !dropped {
+			handler(msg)
+			delivered++
+		}
+	}
+	return delivered
+}
+
+type memoryRaftTransport struct{
+	network	*RaftMemoryNetwork
+	id		string
+}
+
+func (t *memoryRaftTransport) Send(msg RaftMessage) {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	if !t.network.isolated[msg.From] && !t.network.isolated[msg.To] {
+		t.network.queue = append(t.network.queue, msg)
+	}
+}
+
+func (t *memoryRaftTransport) Listen(handler func(msg RaftMessage)) {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	t.network.handlers[t.id] = handler
+}
+
+func (t *memoryRaftTransport) Close() error {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	delete(t.network.handlers, t.id)
+	return nil
+}
+
+// A raft transport that gob encodes messages over tcp connections, one outgoing connection per peer.
+type RaftTCPTransport struct{
+	listener	net.Listener
+	mtx			sync.Mutex
+	peers		map[string]string
+	outgoing	map[string]chan RaftMessage
+	incoming	map[net.Conn]bool
+	handler		func(msg RaftMessage)
+	closed		bool
+	wg			sync.WaitGroup
+}
+
+// Creates a transport listening on listenAddr that sends to peers, a map of node ids to their addresses.
+func NewRaftTCPTransport(listenAddr string, peers map[string]string) (*RaftTCPTransport, error) {
+	listener, err := net.Listen(`tcp`, listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &RaftTCPTransport{
+		listener: listener,
+		peers: map[string]string{},
+		outgoing: map[string]chan RaftMessage{},
+		incoming: map[net.Conn]bool{},
+	}
+	for id, addr := range peers {
+		t.peers[id] = addr
+	}
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+// Returns the address the transport is listening on.
+func (t *RaftTCPTransport) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Sets the address of the peer with id.
+func (t *RaftTCPTransport) AddPeer(id, addr string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.peers[id] = addr
+}
+
+// Queues msg for its peer, dropping it if the peer is unknown or too far behind.
+func (t *RaftTCPTransport) Send(msg RaftMessage) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closed {
+		return
+	}
+	queue, exists := t.outgoing[msg.To]
+	if !exists {
+		if _, known := t.peers[msg.To]; !known {
+			return
+		}
+		queue = make(chan RaftMessage, raftSendQueueLen)
+		t.outgoing[msg.To] = queue
+		t.wg.Add(1)
+		go t.sendLoop(msg.To, queue)
+	}
+	select {
+	case queue <- msg:
+	default:
+	}
+}
+
+func (t *RaftTCPTransport) Listen(handler func(msg RaftMessage)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.handler = handler
+}
+
+func (t *RaftTCPTransport) Close() error {
+	t.mtx.Lock()
+	if t.closed {
+		t.mtx.Unlock()
+		return nil
+	}
+	t.closed = true
+	for _, queue := range t.outgoing {
+		close(queue)
+	}
+	for conn := range t.incoming {
+		conn.Close()
+	}
+	t.mtx.Unlock()
+	err := t.listener.Close()
+	t.wg.Wait()
+	return err
+}
+
+func (t *RaftTCPTransport) sendLoop(peer string, queue chan RaftMessage) {
+	defer t.wg.Done()
+	var conn net.Conn
+	var enc *gob.Encoder
+	for msg := range queue {
+		if conn == nil {
+			t.mtx.Lock()
+			addr := t.peers[peer]
+			t.mtx.Unlock()
+			var err error
+			if conn, err = net.DialTimeout(`tcp`, addr, raftDialTimeout); err != nil {
+				// raft retries on its own so the message is simply lost.
+				conn = nil
+				continue
+			}
+			enc = gob.NewEncoder(conn)
+		}
+		if err := enc.Encode(&msg); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (t *RaftTCPTransport) accept() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.mtx.Lock()
+		if t.closed {
+			t.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		t.incoming[conn] = true
+		t.wg.Add(1)
+		t.mtx.Unlock()
+		go t.receiveLoop(conn)
+	}
+}
+
+func (t *RaftTCPTransport) receiveLoop(conn net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		t.mtx.Lock()
+		delete(t.incoming, conn)
+		t.mtx.Unlock()
+		conn.Close()
+	}()
+	dec := gob.NewDecoder(conn)
+	for {
+		var msg RaftMessage
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		t.mtx.Lock()
+		handler := t.handler
+		t.mtx.Unlock()
+		if handler != nil {
+			handler(msg)
+		}
+	}
+}
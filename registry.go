@@ -0,0 +1,115 @@
+package sus
+
+import(
+	`sync`
+	`reflect`
+)
+
+// The codecs records are enveloped with, see Envelope, the migrations of their schemas and the entity types they are
+// decoded into. Stores and functions that read or write envelopes are given a Registry through their options or
+// arguments, a nil *Registry stands for one just returned by NewRegistry, so registering with one Registry never
+// affects stores given another.
+type Registry struct{
+	mtx			sync.RWMutex
+	codecs		map[string]codec
+	migrations	map[string]schemaMigrations
+	types		map[string]VersionFactory
+	typeSchemas	map[reflect.Type]string
+}
+
+type codec struct{
+	m	Marshaler
+	un	Unmarshaler
+}
+
+// Never registered with, so it always holds just the built in codecs.
+var builtinRegistry = NewRegistry()
+
+// Returns a Registry holding the built in json, gob, xml and binary codecs under those names, and no migrations or
+// types.
+func NewRegistry() *Registry {
+	return &Registry{
+		codecs: map[string]codec{
+			`json`: {JsonMarshaler, JsonUnmarshaler},
+			`gob`: {GobMarshaler, GobUnmarshaler},
+			`xml`: {XmlMarshaler, XmlUnmarshaler},
+			`binary`: {BinaryMarshaler, BinaryUnmarshaler},
+		},
+		migrations: map[string]schemaMigrations{},
+		types: map[string]VersionFactory{},
+		typeSchemas: map[reflect.Type]string{},
+	}
+}
+
+// Makes a codec available to envelopes under id. Registering an id again replaces its codec.
+func (r *Registry) RegisterCodec(id string, m Marshaler, un Unmarshaler) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.codecs[id] = codec{m, un}
+}
+
+func (r *Registry) codec(id string) (codec, error) {
+	r = r.orBuiltin()
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	c, exists := r.codecs[id]
+	if !exists {
+		return codec{}, &unknownCodecError{id}
+	}
+	return c, nil
+}
+
+// Registers the migrations that bring entities of schema up to date, migrations[v] upgrades an entity decoded from a
+// record written at schema version v to version v+1, so the current version is len(migrations). Byte stores given r
+// apply them after decoding any enveloped record of schema with an older version. When writeBack is true the store
+// writes the upgraded entity straight back with its Marshaler, which should then write the current version, so each
+// record is only migrated once. Registering a schema again replaces its migrations.
+func (r *Registry) RegisterMigrations(schema string, writeBack bool, migrations ...Migration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.migrations[schema] = schemaMigrations{writeBack, append([]Migration{}, migrations...)}
+}
+
+func (r *Registry) schemaMigrations(schema string) schemaMigrations {
+	r = r.orBuiltin()
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.migrations[schema]
+}
+
+// Registers the concrete entity type made by vf under schema, so stores can hold several implementations of an
+// interface side by side. Byte stores given r decode enveloped records of schema into a new entity from vf rather than
+// their own VersionFactory, and NewTypedMarshaler records schema in the envelopes of entities of the type. Registering
+// a schema again replaces its type.
+func (r *Registry) RegisterType(schema string, vf VersionFactory) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if old, exists := r.types[schema]; exists {
+		delete(r.typeSchemas, reflect.TypeOf(old()))
+	}
+	r.types[schema] = vf
+	r.typeSchemas[reflect.TypeOf(vf())] = schema
+}
+
+func (r *Registry) typeFactory(schema string) (VersionFactory, bool) {
+	r = r.orBuiltin()
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	vf, exists := r.types[schema]
+	return vf, exists
+}
+
+func (r *Registry) typeSchema(t reflect.Type) (string, bool) {
+	r = r.orBuiltin()
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	schema, exists := r.typeSchemas[t]
+	return schema, exists
+}
+
+func (r *Registry) orBuiltin() *Registry {
+	if r == nil {
+		return builtinRegistry
+	}
+	return r
+}
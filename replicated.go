@@ -0,0 +1,321 @@
+package sus
+
+import(
+	`sync`
+	`strconv`
+)
+
+// One committed batch of puts and deletes from a primary's commit log.
+type CommitEntry struct{
+	Seq	uint64
+	Ops	[]CommitOp
+}
+
+// A single put (or delete if Delete is true) within a CommitEntry.
+type CommitOp struct{
+	Id		string
+	Data	[]byte
+	Delete	bool
+}
+
+// An ordered source of commit entries, as exposed by a PrimaryStore.
+type CommitLog interface{
+	// Returns every retained entry with a sequence number greater than seq.
+	Since(seq uint64) ([]CommitEntry, error)
+	// Returns the sequence number of the latest entry, 0 if nothing has been committed.
+	LastSeq() uint64
+}
+
+// A memory store that records every committed batch in a CommitLog for replicas to apply.
+type PrimaryStore interface{
+	Store
+	CommitLog
+	// Discards entries up to and including seq, replicas that have not yet applied them can no longer catch up.
+	Compact(seq uint64)
+}
+
+// A read only memory store that follows a primary's CommitLog.
+type ReplicaStore interface{
+	Store
+	// Fetches and applies every new entry from the primary.
+	Sync() error
+	// Returns the sequence number of the latest applied entry.
+	AppliedSeq() uint64
+	// Returns how many entries the primary has committed that have not been applied here.
+	Lag() uint64
+	// Stops following the primary and returns a primary over this replica's data whose log carries on from AppliedSeq.
+	Promote(idf IdFactory, ei EntityInitializer) (PrimaryStore, error)
+}
+
+// Creates and configures a store that stores entities by converting them to and from []byte, keeps them in the local
+// system memory and records every committed batch of puts and deletes in an in-process commit log.
+func NewPrimaryStore(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) PrimaryStore {
+	return newPrimaryStore(newStagedMap(), 0, m, un, idf, vf, ei)
+}
+
+// Creates and configures a read only store that applies the entries from source to its own copy of the data in the
+// local system memory. Reads are served locally as long as the replica is no more than maxLag entries behind source,
+// beyond that a read first syncs and fails if the replica still can not get close enough.
+func NewReplicaStore(source CommitLog, maxLag uint64, m Marshaler, un Unmarshaler, vf VersionFactory) ReplicaStore {
+	s := &replicaStore{
+		source: source,
+		maxLag: maxLag,
+		data: newStagedMap(),
+		marshaler: m,
+		unmarshaler: un,
+		versionFactory: vf,
+	}
+	readOnly := func(id string) error {
+		return &readOnlyReplicaError{}
+	}
+	rit := func(tran Transaction) error {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return tran()
+	}
+	noIds := func() string {
+		return ``
+	}
+	s.Store = NewByteStore(s.data.get, func(id string, d []byte) error { return readOnly(id) }, readOnly, m, un, noIds, vf, func(v Version) Version { return v }, isLocalEntityDoesNotExistError, rit)
+	return s
+}
+
+func newPrimaryStore(data *stagedMap, seq uint64, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) *primaryStore {
+	s := &primaryStore{
+		data: data,
+		firstSeq: seq + 1,
+		lastSeq: seq,
+	}
+	s.Store = NewByteStore(data.get, data.put, data.del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, s.runInTransaction)
+	return s
+}
+
+type primaryStore struct{
+	Store
+	mtx			sync.Mutex
+	data		*stagedMap
+	logMtx		sync.RWMutex
+	entries		[]CommitEntry
+	firstSeq	uint64
+	lastSeq		uint64
+}
+
+// Returns every retained entry with a sequence number greater than seq.
+func (s *primaryStore) Since(seq uint64) ([]CommitEntry, error) {
+	s.logMtx.RLock()
+	defer s.logMtx.RUnlock()
+	if seq+1 < s.firstSeq {
+		return nil, &commitLogCompactedError{seq, s.firstSeq}
+	}
+	if seq >= s.lastSeq {
+		return nil, nil
+	}
+	entries := s.entries[seq+1-s.firstSeq:]
+	return append(make([]CommitEntry, 0, len(entries)), entries...), nil
+}
+
+// Returns the sequence number of the latest entry, 0 if nothing has been committed.
+func (s *primaryStore) LastSeq() uint64 {
+	s.logMtx.RLock()
+	defer s.logMtx.RUnlock()
+	return s.lastSeq
+}
+
+// Discards entries up to and including seq.
+func (s *primaryStore) Compact(seq uint64) {
+	s.logMtx.Lock()
+	defer s.logMtx.Unlock()
+	if seq > s.lastSeq {
+		seq = s.lastSeq
+	}
+	if seq < s.firstSeq {
+		return
+	}
+	s.entries = append([]CommitEntry{}, s.entries[seq+1-s.firstSeq:]...)
+	s.firstSeq = seq + 1
+}
+
+// Runs fn as an interactive transaction whose writes are appended to the commit log as one entry.
+func (s *primaryStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+func (s *primaryStore) runInTransaction(tran Transaction) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := tran(); err != nil {
+		s.data.rollback()
+		return err
+	}
+	ops := s.data.commit()
+	if len(ops) == 0 {
+		return nil
+	}
+	entry := CommitEntry{Ops: make([]CommitOp, len(ops), len(ops))}
+	for i, op := range ops {
+		entry.Ops[i] = CommitOp{op.id, op.d, op.kind == deleteOp}
+	}
+	s.logMtx.Lock()
+	defer s.logMtx.Unlock()
+	s.lastSeq++
+	entry.Seq = s.lastSeq
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+type replicaStore struct{
+	Store
+	source			CommitLog
+	maxLag			uint64
+	mtx				sync.Mutex
+	data			*stagedMap
+	appliedSeq		uint64
+	promoted		bool
+	marshaler		Marshaler
+	unmarshaler		Unmarshaler
+	versionFactory	VersionFactory
+}
+
+// Fails, replicas only change by applying the source's log.
+func (s *replicaStore) Create() (string, Version, error) {
+	return ``, nil, &readOnlyReplicaError{}
+}
+
+// Fails, replicas only change by applying the source's log.
+func (s *replicaStore) CreateMulti(count uint) ([]string, []Version, error) {
+	return nil, nil, &readOnlyReplicaError{}
+}
+
+// Fails without touching v, replicas only change by applying the source's log.
+func (s *replicaStore) Update(id string, v Version) error {
+	return &readOnlyReplicaError{}
+}
+
+// Fails without touching vs, replicas only change by applying the source's log.
+func (s *replicaStore) UpdateMulti(ids []string, vs []Version) error {
+	return &readOnlyReplicaError{}
+}
+
+// Fails, replicas only change by applying the source's log.
+func (s *replicaStore) Delete(id string) error {
+	return &readOnlyReplicaError{}
+}
+
+// Fails, replicas only change by applying the source's log.
+func (s *replicaStore) DeleteMulti(ids []string) error {
+	return &readOnlyReplicaError{}
+}
+
+// Fetches the versioned entity with id.
+func (s *replicaStore) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the versioned entities with id's from the local copy, syncing first if it is more than maxLag behind.
+func (s *replicaStore) ReadMulti(ids []string) ([]Version, error) {
+	if s.Lag() > s.maxLag {
+		if err := s.Sync(); err != nil {
+			return nil, err
+		}
+		if lag := s.Lag(); lag > s.maxLag {
+			return nil, &staleReplicaError{lag, s.maxLag}
+		}
+	}
+	return s.Store.ReadMulti(ids)
+}
+
+// Fetches and applies every new entry from the primary.
+func (s *replicaStore) Sync() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.promoted {
+		return nil
+	}
+	entries, err := s.source.Since(s.appliedSeq)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Seq != s.appliedSeq+1 {
+			return &commitLogGapError{s.appliedSeq, entry.Seq}
+		}
+		for _, op := range entry.Ops {
+			if op.Delete {
+				s.data.del(op.Id)
+			} else {
+				s.data.put(op.Id, op.Data)
+			}
+		}
+		s.data.commit()
+		s.appliedSeq = entry.Seq
+	}
+	return nil
+}
+
+// Returns the sequence number of the latest applied entry.
+func (s *replicaStore) AppliedSeq() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.appliedSeq
+}
+
+// Returns how many entries the primary has committed that have not been applied here.
+func (s *replicaStore) Lag() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.promoted {
+		return 0
+	}
+	if last := s.source.LastSeq(); last > s.appliedSeq {
+		return last - s.appliedSeq
+	}
+	return 0
+}
+
+// Stops following the primary and returns a primary over this replica's data whose log carries on from AppliedSeq.
+func (s *replicaStore) Promote(idf IdFactory, ei EntityInitializer) (PrimaryStore, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.promoted {
+		return nil, &alreadyPromotedError{}
+	}
+	s.promoted = true
+	data := newStagedMap()
+	for id, d := range s.data.data {
+		data.data[id] = d
+	}
+	return newPrimaryStore(data, s.appliedSeq, s.marshaler, s.unmarshaler, idf, s.versionFactory, ei), nil
+}
+
+type readOnlyReplicaError struct{}
+
+func (e *readOnlyReplicaError) Error() string { return `replica stores are read only` }
+
+type staleReplicaError struct{
+	lag		uint64
+	maxLag	uint64
+}
+
+func (e *staleReplicaError) Error() string { return `replica is `+strconv.FormatUint(e.lag, 10)+` entries behind, more than the tolerated `+strconv.FormatUint(e.maxLag, 10) }
+
+type commitLogCompactedError struct{
+	seq			uint64
+	firstSeq	uint64
+}
+
+func (e *commitLogCompactedError) Error() string { return `commit log entries after `+strconv.FormatUint(e.seq, 10)+` have been compacted, the oldest retained entry is `+strconv.FormatUint(e.firstSeq, 10) }
+
+type commitLogGapError struct{
+	appliedSeq	uint64
+	nextSeq		uint64
+}
+
+func (e *commitLogGapError) Error() string { return `commit log gap, expected entry `+strconv.FormatUint(e.appliedSeq+1, 10)+` but got `+strconv.FormatUint(e.nextSeq, 10) }
+
+type alreadyPromotedError struct{}
+
+func (e *alreadyPromotedError) Error() string { return `replica has already been promoted` }
@@ -0,0 +1,161 @@
+package sus
+
+import(
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_PrimaryStore_records_commit_log(t *testing.T){
+	ps := newFooPrimaryStore()
+
+	ids, fs, _ := ps.CreateMulti(2)
+	ps.UpdateMulti(ids, fs)
+	ps.Delete(ids[0])
+	ps.Read(ids[1])
+	entries, err := ps.Since(0)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, uint64(3), ps.LastSeq(), `there should be 3 entries`)
+	assert.Equal(t, 3, len(entries), `there should be 3 entries`)
+	assert.Equal(t, 2, len(entries[1].Ops), `the update entry should have 2 ops`)
+	assert.Equal(t, CommitOp{ids[0], nil, true}, entries[2].Ops[0], `the last entry should be the delete`)
+}
+
+func Test_PrimaryStore_failed_transaction_is_not_logged(t *testing.T){
+	ps := newFooPrimaryStore()
+	id, f, _ := ps.Create()
+	f.IncrementVersion()
+
+	ps.Update(id, f)
+
+	assert.Equal(t, uint64(1), ps.LastSeq(), `only the create should be logged`)
+}
+
+func Test_PrimaryStore_Compact(t *testing.T){
+	ps := newFooPrimaryStore()
+	ps.CreateMulti(1)
+	ps.CreateMulti(1)
+	ps.CreateMulti(1)
+
+	ps.Compact(2)
+	entries, err := ps.Since(2)
+	_, compactedErr := ps.Since(0)
+	ps.Compact(1)
+	ps.Compact(10)
+	none, noneErr := ps.Since(3)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, len(entries), `there should be 1 entry`)
+	assert.Equal(t, `commit log entries after 0 have been compacted, the oldest retained entry is 3`, compactedErr.Error(), `compactedErr should contain expected msg`)
+	assert.Nil(t, none, `none should be nil`)
+	assert.Nil(t, noneErr, `noneErr should be nil`)
+}
+
+func Test_ReplicaStore_follows_primary(t *testing.T){
+	ps := newFooPrimaryStore()
+	rs := NewReplicaStore(ps, 0, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+	id, f, _ := ps.Create()
+	ps.Update(id, f)
+
+	lagBefore := rs.Lag()
+	v, err := rs.Read(id)
+
+	assert.Equal(t, uint64(2), lagBefore, `lagBefore should be 2`)
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Equal(t, uint64(0), rs.Lag(), `lag should be 0 after reading`)
+	assert.Equal(t, uint64(2), rs.AppliedSeq(), `applied seq should be 2`)
+}
+
+func Test_ReplicaStore_tolerates_bounded_staleness(t *testing.T){
+	ps := newFooPrimaryStore()
+	rs := NewReplicaStore(ps, 1, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+	id, f, _ := ps.Create()
+	rs.Sync()
+	ps.Update(id, f)
+
+	v, err := rs.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 0, v.GetVersion(), `v should be the stale version 0`)
+	assert.Equal(t, uint64(1), rs.Lag(), `lag should be 1`)
+}
+
+func Test_ReplicaStore_rejects_writes(t *testing.T){
+	ps := newFooPrimaryStore()
+	rs := NewReplicaStore(ps, 0, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+	id, f, _ := ps.Create()
+	rs.Sync()
+
+	_, _, createErr := rs.Create()
+	updateErr := rs.Update(id, f)
+	deleteErr := rs.Delete(id)
+	missingErr := rs.Update(`missing`, &foo{})
+
+	assert.Equal(t, `replica stores are read only`, createErr.Error(), `createErr should contain expected msg`)
+	assert.Equal(t, `replica stores are read only`, updateErr.Error(), `updateErr should contain expected msg`)
+	assert.Equal(t, 0, f.GetVersion(), `f's version should be unchanged`)
+	assert.Equal(t, `replica stores are read only`, deleteErr.Error(), `deleteErr should contain expected msg`)
+	assert.Equal(t, `replica stores are read only`, missingErr.Error(), `writes should be refused before anything is read`)
+}
+
+func Test_ReplicaStore_fails_when_log_is_compacted(t *testing.T){
+	ps := newFooPrimaryStore()
+	rs := NewReplicaStore(ps, 0, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+	id, _, _ := ps.Create()
+	ps.Compact(1)
+
+	_, err := rs.Read(id)
+
+	assert.Equal(t, `commit log entries after 0 have been compacted, the oldest retained entry is 2`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_ReplicaStore_fails_on_log_gap(t *testing.T){
+	rs := NewReplicaStore(&fakeCommitLog{[]CommitEntry{{Seq: 2}}}, 0, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+
+	err := rs.Sync()
+	_, readErr := rs.Read(`a`)
+
+	assert.Equal(t, `commit log gap, expected entry 1 but got 2`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, `commit log gap, expected entry 1 but got 2`, readErr.Error(), `readErr should contain expected msg`)
+}
+
+func Test_ReplicaStore_stale_read_failure(t *testing.T){
+	rs := NewReplicaStore(&fakeCommitLog{}, 0, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+
+	_, err := rs.Read(`a`)
+
+	assert.Equal(t, `replica is 1 entries behind, more than the tolerated 0`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_ReplicaStore_Promote(t *testing.T){
+	ps := newFooPrimaryStore()
+	rs := NewReplicaStore(ps, 0, JsonMarshaler, JsonUnmarshaler, fooVersionFactory)
+	id, _, _ := ps.Create()
+	rs.Sync()
+
+	newPs, err := rs.Promote(newFooIdFactory(), fooEntityInitializer)
+	f, readErr := newPs.Read(id)
+	updateErr := newPs.Update(id, f)
+	_, promoteAgainErr := rs.Promote(newFooIdFactory(), fooEntityInitializer)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Equal(t, uint64(2), newPs.LastSeq(), `the new primary's log should carry on from the replica`)
+	assert.Equal(t, uint64(0), rs.Lag(), `a promoted replica should report no lag`)
+	assert.Nil(t, rs.Sync(), `syncing a promoted replica should do nothing`)
+	assert.Equal(t, `replica has already been promoted`, promoteAgainErr.Error(), `promoteAgainErr should contain expected msg`)
+}
+
+type fakeCommitLog struct{
+	entries	[]CommitEntry
+}
+
+func (l *fakeCommitLog) Since(seq uint64) ([]CommitEntry, error) { return l.entries, nil }
+
+func (l *fakeCommitLog) LastSeq() uint64 { return 1 }
+
+func newFooPrimaryStore() PrimaryStore {
+	return NewPrimaryStore(JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+}
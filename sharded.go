@@ -0,0 +1,286 @@
+package sus
+
+import(
+	`sort`
+	`sync`
+	`strconv`
+	`strings`
+	`hash/crc32`
+	`sync/atomic`
+)
+
+const(
+	shardSeparator = `:`
+)
+
+// Creates and configures a store that spreads entities over the named shards with consistent hashing, using
+// virtualNodes points per shard on the hash ring. Ids handed out by Create/CreateMulti embed the name of the shard
+// that created them as a hint ("shard:innerId") so they always route back to it, any other id is routed by its hash.
+// Multi calls are split per shard and run concurrently, they are only atomic when every id lives in the same shard,
+// in strict mode a batch that would span shards is rejected instead of being partially applied.
+func NewShardedStore(shards map[string]Store, virtualNodes int, strict bool) (Store, error) {
+	if len(shards) == 0 {
+		return nil, &noShardsError{}
+	}
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	s := &shardedStore{
+		shards: shards,
+		strict: strict,
+	}
+	for name := range shards {
+		if name == `` || strings.Contains(name, shardSeparator) {
+			return nil, &invalidShardNameError{name}
+		}
+		for i := 0; i < virtualNodes; i++ {
+			s.ring = append(s.ring, ringPoint{crc32.ChecksumIEEE([]byte(name+`#`+strconv.Itoa(i))), name})
+		}
+	}
+	sort.Sort(s.ring)
+	return s, nil
+}
+
+type ringPoint struct{
+	hash	uint32
+	shard	string
+}
+
+type hashRing []ringPoint
+
+func (r hashRing) Len() int { return len(r) }
+func (r hashRing) Less(i, j int) bool { return r[i].hash < r[j].hash || (r[i].hash == r[j].hash && r[i].shard < r[j].shard) }
+func (r hashRing) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+func (r hashRing) get(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].shard
+}
+
+type shardedStore struct{
+	shards		map[string]Store
+	ring		hashRing
+	strict		bool
+	createSeq	uint64
+}
+
+type shardBatch struct{
+	shard	string
+	ids		[]string
+	idxs	[]int
+	vs		[]Version
+}
+
+// Creates a new versioned entity.
+func (s *shardedStore) Create() (id string, v Version, err error) {
+	ids, vs, err := s.CreateMulti(1)
+	if len(ids) == 1 && len(vs) == 1 {
+		id = ids[0]
+		v = vs[0]
+	}
+	return
+}
+
+// Creates a set of new versioned entities spread over the shards, or all in one shard in strict mode.
+func (s *shardedStore) CreateMulti(count uint) (ids []string, vs []Version, err error) {
+	if count == 0 {
+		return
+	}
+	icount := int(count)
+	batches := map[string]*shardBatch{}
+	var shard string
+	for i := 0; i < icount; i++ {
+		if i == 0 || !s.strict {
+			shard = s.ring.get(strconv.FormatUint(atomic.AddUint64(&s.createSeq, 1), 10))
+		}
+		b := batches[shard]
+		if b == nil {
+			b = &shardBatch{shard: shard}
+			batches[shard] = b
+		}
+		b.idxs = append(b.idxs, i)
+	}
+	ids = make([]string, count, count)
+	vs = make([]Version, count, count)
+	err = s.each(batches, func(st Store, b *shardBatch) error {
+		shardIds, shardVs, err := st.CreateMulti(uint(len(b.idxs)))
+		if err != nil {
+			return err
+		}
+		for i, idx := range b.idxs {
+			ids[idx] = b.shard + shardSeparator + shardIds[i]
+			vs[idx] = shardVs[i]
+		}
+		return nil
+	})
+	if err != nil {
+		ids, vs = nil, nil
+	}
+	return
+}
+
+// Fetches the versioned entity with id.
+func (s *shardedStore) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the versioned entities with id's from their shards concurrently.
+func (s *shardedStore) ReadMulti(ids []string) (vs []Version, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	batches, err := s.split(ids, nil)
+	if err != nil {
+		return
+	}
+	count := len(ids)
+	vs = make([]Version, count, count)
+	err = s.each(batches, func(st Store, b *shardBatch) error {
+		shardVs, err := st.ReadMulti(b.ids)
+		if err != nil {
+			return err
+		}
+		for i, idx := range b.idxs {
+			vs[idx] = shardVs[i]
+		}
+		return nil
+	})
+	if err != nil {
+		vs = nil
+	}
+	return
+}
+
+// Updates the versioned entity with id.
+func (s *shardedStore) Update(id string, v Version) error {
+	return s.UpdateMulti([]string{id}, []Version{v})
+}
+
+// Updates the versioned entities with id's in their shards concurrently.
+func (s *shardedStore) UpdateMulti(ids []string, vs []Version) error {
+	if len(ids) != len(vs) {
+		return &idCountNotEqualToEntityCountError{len(ids), len(vs)}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	batches, err := s.split(ids, vs)
+	if err != nil {
+		return err
+	}
+	return s.each(batches, func(st Store, b *shardBatch) error {
+		return st.UpdateMulti(b.ids, b.vs)
+	})
+}
+
+// Deletes the versioned entity with id.
+func (s *shardedStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+// Deletes the versioned entities with id's from their shards concurrently.
+func (s *shardedStore) DeleteMulti(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	batches, err := s.split(ids, nil)
+	if err != nil {
+		return err
+	}
+	return s.each(batches, func(st Store, b *shardBatch) error {
+		return st.DeleteMulti(b.ids)
+	})
+}
+
+func (s *shardedStore) route(id string) (shard string, innerId string) {
+	if i := strings.Index(id, shardSeparator); i > 0 {
+		if _, exists := s.shards[id[:i]]; exists {
+			return id[:i], id[i+1:]
+		}
+	}
+	return s.ring.get(id), id
+}
+
+func (s *shardedStore) split(ids []string, vs []Version) (map[string]*shardBatch, error) {
+	batches := map[string]*shardBatch{}
+	for i, id := range ids {
+		shard, innerId := s.route(id)
+		b := batches[shard]
+		if b == nil {
+			b = &shardBatch{shard: shard}
+			batches[shard] = b
+		}
+		b.ids = append(b.ids, innerId)
+		b.idxs = append(b.idxs, i)
+		if vs != nil {
+			b.vs = append(b.vs, vs[i])
+		}
+	}
+	if s.strict && len(batches) > 1 {
+		return nil, &crossShardBatchError{sortedShardNames(batches)}
+	}
+	return batches, nil
+}
+
+// Runs fn against every batch's shard concurrently, returning the error from the first shard by name.
+func (s *shardedStore) each(batches map[string]*shardBatch, fn func(st Store, b *shardBatch) error) error {
+	if len(batches) == 1 {
+		for _, b := range batches {
+			return fn(s.shards[b.shard], b)
+		}
+	}
+	errs := make(map[string]error, len(batches))
+	errsMtx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, b := range batches {
+		wg.Add(1)
+		go func(b *shardBatch) {
+			defer wg.Done()
+			if err := fn(s.shards[b.shard], b); err != nil {
+				errsMtx.Lock()
+				errs[b.shard] = err
+				errsMtx.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+	for _, name := range sortedShardNames(batches) {
+		if err := errs[name]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedShardNames(batches map[string]*shardBatch) []string {
+	names := make([]string, 0, len(batches))
+	for name := range batches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type noShardsError struct{}
+
+func (e *noShardsError) Error() string { return `sharded store requires at least one shard` }
+
+type invalidShardNameError struct{
+	name	string
+}
+
+func (e *invalidShardNameError) Error() string { return `invalid shard name "`+e.name+`", shard names must be non empty and not contain "`+shardSeparator+`"` }
+
+type crossShardBatchError struct{
+	shards	[]string
+}
+
+func (e *crossShardBatchError) Error() string { return `batch spans shards "`+strings.Join(e.shards, `", "`)+`", batches are only atomic within a single shard` }
@@ -0,0 +1,157 @@
+package sus
+
+import(
+	`strings`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_NewShardedStore_failure(t *testing.T){
+	s1, err1 := NewShardedStore(map[string]Store{}, 10, false)
+	s2, err2 := NewShardedStore(map[string]Store{`a:b`: newFooShard()}, 10, false)
+
+	assert.Nil(t, s1, `s1 should be nil`)
+	assert.Equal(t, `sharded store requires at least one shard`, err1.Error(), `err1 should contain expected msg`)
+	assert.Nil(t, s2, `s2 should be nil`)
+	assert.Equal(t, `invalid shard name "a:b", shard names must be non empty and not contain ":"`, err2.Error(), `err2 should contain expected msg`)
+}
+
+func Test_ShardedStore_CreateMulti_spreads_over_shards(t *testing.T){
+	shards, ss := newFooShardedStore(false)
+
+	ids, vs, err := ss.CreateMulti(30)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 30, len(ids), `there should be 30 ids`)
+	assert.Equal(t, 30, len(vs), `there should be 30 entities`)
+	used := map[string]bool{}
+	for _, id := range ids {
+		shard := id[:strings.Index(id, shardSeparator)]
+		_, err := shards[shard].Read(id[len(shard)+1:])
+		assert.Nil(t, err, `every entity should be in the shard named by its id`)
+		used[shard] = true
+	}
+	assert.Equal(t, 3, len(used), `every shard should have been used`)
+}
+
+func Test_ShardedStore_CreateMulti_in_strict_mode_uses_one_shard(t *testing.T){
+	_, ss := newFooShardedStore(true)
+
+	ids, _, err := ss.CreateMulti(10)
+
+	assert.Nil(t, err, `err should be nil`)
+	for _, id := range ids {
+		assert.Equal(t, ids[0][:strings.Index(ids[0], shardSeparator)], id[:strings.Index(id, shardSeparator)], `every id should be in the same shard`)
+	}
+}
+
+func Test_ShardedStore_with_zero_counts(t *testing.T){
+	_, ss := newFooShardedStore(false)
+
+	ids, vs, createErr := ss.CreateMulti(0)
+	readVs, readErr := ss.ReadMulti([]string{})
+	updateErr := ss.UpdateMulti([]string{}, []Version{})
+	deleteErr := ss.DeleteMulti([]string{})
+
+	assert.Nil(t, ids, `ids should be nil`)
+	assert.Nil(t, vs, `vs should be nil`)
+	assert.Nil(t, createErr, `createErr should be nil`)
+	assert.Nil(t, readVs, `readVs should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+}
+
+func Test_ShardedStore_Read_Update_Delete_across_shards(t *testing.T){
+	_, ss := newFooShardedStore(false)
+	ids, vs, _ := ss.CreateMulti(20)
+
+	updateErr := ss.UpdateMulti(ids, vs)
+	readVs, readErr := ss.ReadMulti(ids)
+	deleteErr := ss.DeleteMulti(ids)
+	_, goneErr := ss.Read(ids[0])
+
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	for i := range ids {
+		assert.Equal(t, 1, readVs[i].GetVersion(), `every entity should be at version 1`)
+	}
+	assert.Nil(t, deleteErr, `deleteErr should be nil`)
+	assert.NotNil(t, goneErr, `goneErr should not be nil`)
+}
+
+func Test_ShardedStore_routes_unhinted_ids_by_hash(t *testing.T){
+	shards, ss := newFooShardedStore(false)
+	shard := ss.(*shardedStore).ring.get(`plain`)
+	shards[shard].(*seededFooShard).seedCreate(`plain`)
+
+	v, err := ss.Read(`plain`)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.NotNil(t, v, `v should not be nil`)
+}
+
+func Test_ShardedStore_Update_errors(t *testing.T){
+	_, ss := newFooShardedStore(false)
+	id, f, _ := ss.Create()
+	f.IncrementVersion()
+
+	seqErr := ss.Update(id, f)
+	countErr := ss.UpdateMulti([]string{``}, []Version{})
+	_, readErr := ss.Read(`a:fake`)
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id[strings.Index(id, shardSeparator)+1:]+`"`, seqErr.Error(), `seqErr should contain expected msg`)
+	assert.Equal(t, `id count (1) not equal to entity count (0)`, countErr.Error(), `countErr should contain expected msg`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "fake" does not exist`, readErr.Error(), `readErr should contain expected msg`)
+}
+
+func Test_ShardedStore_strict_mode_rejects_cross_shard_batches(t *testing.T){
+	_, ss := newFooShardedStore(true)
+	id1, f1, _ := ss.Create()
+	var id2 string
+	var f2 Version
+	for id2 == `` || id2[:1] == id1[:1] {
+		id2, f2, _ = ss.Create()
+	}
+
+	err := ss.UpdateMulti([]string{id1, id2}, []Version{f1, f2})
+
+	assert.True(t, strings.HasPrefix(err.Error(), `batch spans shards "`), `err should be a cross shard error`)
+	assert.Equal(t, 0, f1.GetVersion(), `f1 should not have been updated`)
+	assert.Equal(t, 0, f2.GetVersion(), `f2 should not have been updated`)
+	assert.NotNil(t, ss.DeleteMulti([]string{id1, id2}), `cross shard delete should fail`)
+}
+
+type seededFooShard struct{
+	Store
+	seed	*seeder
+}
+
+func (s *seededFooShard) seedCreate(id string) {
+	s.seed.seed(s.Store, []string{id}, []Version{&foo{}})
+}
+
+func newFooShard() Store {
+	seed := &seeder{}
+	idf := newFooIdFactory()
+	return &seededFooShard{
+		Store: NewJsonMemoryStore(func() string {
+			if len(seed.ids) > 0 {
+				return seed.idFactory()
+			}
+			return idf()
+		}, fooVersionFactory, func(v Version) Version {
+			if len(seed.vs) > 0 {
+				return seed.entityInitializer(v)
+			}
+			return v
+		}),
+		seed: seed,
+	}
+}
+
+func newFooShardedStore(strict bool) (map[string]Store, Store) {
+	shards := map[string]Store{`a`: newFooShard(), `b`: newFooShard(), `c`: newFooShard()}
+	ss, _ := NewShardedStore(shards, 16, strict)
+	return shards, ss
+}
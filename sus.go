@@ -7,6 +7,7 @@ package sus
 
 import(
 	`fmt`
+	`strings`
 )
 
 // The interface that struct entities must include as anonymous fields in order to be used with sus stores.
@@ -40,9 +41,13 @@ type EntityInitializer func(v Version) Version
 
 // Create and configure a core store.
 func NewStore(gm GetMulti, pm PutMulti, dm DeleteMulti, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, rit RunInTransaction) Store {
-	return &store{gm, pm, dm, idf, vf, ei, inee, rit}
+	return &store{gm, pm, dm, idf, vf, ei, inee, rit, nil}
 }
 
+// Vets the ids about to be updated or deleted, run in the transaction before any version is checked or incremented
+// so a rejected write leaves its entities untouched.
+type writeCheck func(ids []string) error
+
 type store struct{
 	getMulti			GetMulti
 	putMulti			PutMulti
@@ -52,6 +57,7 @@ type store struct{
 	entityInitializer 	EntityInitializer
 	isNonExtantError	IsNonExtantError
 	runInTransaction	RunInTransaction
+	checkWrite			writeCheck
 }
 
 // Creates a new versioned entity.
@@ -124,7 +130,13 @@ func (s *store) UpdateMulti(ids []string, vs []Version) (err error) {
 	if count == 0 {
 		return
 	}
+	incremented := false
 	err = s.runInTransaction(func() error {
+		if s.checkWrite != nil {
+			if err := s.checkWrite(ids); err != nil {
+				return err
+			}
+		}
 		oldVs, err := s.getMulti(ids)
 		if err != nil {
 			if s.isNonExtantError(err) {
@@ -145,11 +157,18 @@ func (s *store) UpdateMulti(ids []string, vs []Version) (err error) {
 					vs[i].DecrementVersion()
 				}
 			} else {
+				incremented = true
 				err = s.putMulti(ids, vs)
 			}
 		}
 		return err
 	})
+	if err != nil && incremented {
+		// the new versions were never committed so hand the entities back as they were.
+		for i := 0; i < count; i++ {
+			vs[i].DecrementVersion()
+		}
+	}
 	return
 }
 
@@ -164,10 +183,22 @@ func (s *store) DeleteMulti(ids []string) error {
 		return nil
 	}
 	return s.runInTransaction(func() error {
+		if s.checkWrite != nil {
+			if err := s.checkWrite(ids); err != nil {
+				return err
+			}
+		}
 		return s.deleteMulti(ids)
 	})
 }
 
+// Reports whether id is one of those stores keep their own records under rather than an entity's, the ".2pc" and
+// ".2pc.<txId>" records of participant stores, the ".lease.<id>" records of lease stores and the ".journal" records of
+// kind stores. Tools working over every id in a store skip these.
+func isReservedId(id string) bool {
+	return id == twoPhaseIndexKey || strings.HasPrefix(id, twoPhaseIndexKey+`.`) || strings.HasPrefix(id, leaseKeyPrefix) || id == groupJournalName || strings.HasSuffix(id, ancestorSeparator+groupJournalName)
+}
+
 type nonExtantError struct{
 	inner error
 }
@@ -0,0 +1,356 @@
+package sus
+
+import(
+	`sync`
+	`time`
+)
+
+// A store that serves reads and version checks from memory and writes dirty entities back to a backing store in batches.
+type TieredStore interface{
+	Store
+	// Writes all dirty and deleted entities through to the backing store.
+	Flush() error
+	// Stops the background flusher and performs a final Flush.
+	Close() error
+}
+
+// Creates and configures a store that keeps entities in a memory store in front of backing, warm-loading warmIds
+// on start. Creates go straight to backing so that it remains the source of ids, updates and deletes are written
+// behind every flushInterval (never if flushInterval is 0) or whenever Flush/Close is called. Each flush brings an
+// entity's backing version up to its version in memory, so a store reloaded from backing rejects updates from callers
+// holding versions it has already moved past.
+func NewTieredStore(backing Store, m Marshaler, un Unmarshaler, vf VersionFactory, flushInterval time.Duration, warmIds []string) (TieredStore, error) {
+	seed := &seeder{}
+	s := &tieredStore{
+		backing: backing,
+		front: NewMemoryStore(m, un, seed.idFactory, vf, seed.entityInitializer),
+		seed: seed,
+		loaded: map[string]bool{},
+		dirty: map[string]bool{},
+		deleted: map[string]bool{},
+		backingVersions: map[string]int{},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := s.load(warmIds); err != nil {
+		return nil, err
+	}
+	if flushInterval > 0 {
+		go s.flushLoop(flushInterval)
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+type tieredStore struct{
+	backing			Store
+	front			Store
+	seed			*seeder
+	mtx				sync.Mutex
+	flushMtx		sync.Mutex
+	loaded			map[string]bool
+	dirty			map[string]bool
+	deleted			map[string]bool
+	backingVersions	map[string]int
+	stop			chan struct{}
+	done			chan struct{}
+	closeOnce		sync.Once
+}
+
+// Creates a new versioned entity.
+func (s *tieredStore) Create() (id string, v Version, err error) {
+	ids, vs, err := s.CreateMulti(1)
+	if len(ids) == 1 && len(vs) == 1 {
+		id = ids[0]
+		v = vs[0]
+	}
+	return
+}
+
+// Creates a set of new versioned entities in the backing store and loads them into memory.
+func (s *tieredStore) CreateMulti(count uint) (ids []string, vs []Version, err error) {
+	if count == 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids, vs, err = s.backing.CreateMulti(count)
+	if err != nil {
+		return
+	}
+	for i, id := range ids {
+		s.backingVersions[id] = vs[i].GetVersion()
+		s.loaded[id] = true
+		delete(s.deleted, id)
+	}
+	err = s.seed.seed(s.front, ids, vs)
+	return
+}
+
+// Fetches the versioned entity with id.
+func (s *tieredStore) Read(id string) (v Version, err error) {
+	vs, err := s.ReadMulti([]string{id})
+	if len(vs) == 1 {
+		v = vs[0]
+	}
+	return
+}
+
+// Fetches the versioned entities with id's, reading through to the backing store for any not yet in memory.
+func (s *tieredStore) ReadMulti(ids []string) (vs []Version, err error) {
+	if len(ids) == 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err = s.load(ids); err != nil {
+		return
+	}
+	return s.front.ReadMulti(ids)
+}
+
+// Updates the versioned entity with id.
+func (s *tieredStore) Update(id string, v Version) error {
+	return s.UpdateMulti([]string{id}, []Version{v})
+}
+
+// Updates the versioned entities with id's in memory and marks them dirty.
+func (s *tieredStore) UpdateMulti(ids []string, vs []Version) (err error) {
+	if len(ids) != len(vs) {
+		return s.front.UpdateMulti(ids, vs)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err = s.load(ids); err != nil {
+		return
+	}
+	if err = s.front.UpdateMulti(ids, vs); err == nil {
+		for _, id := range ids {
+			s.dirty[id] = true
+		}
+	}
+	return
+}
+
+// Deletes the versioned entity with id.
+func (s *tieredStore) Delete(id string) error {
+	return s.DeleteMulti([]string{id})
+}
+
+// Deletes the versioned entities with id's from memory and marks them for deletion from the backing store.
+func (s *tieredStore) DeleteMulti(ids []string) (err error) {
+	if len(ids) == 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err = s.load(ids); err != nil {
+		return
+	}
+	if err = s.front.DeleteMulti(ids); err == nil {
+		for _, id := range ids {
+			delete(s.loaded, id)
+			delete(s.dirty, id)
+			s.deleted[id] = true
+		}
+	}
+	return
+}
+
+// Writes all dirty and deleted entities through to the backing store.
+func (s *tieredStore) Flush() error {
+	s.flushMtx.Lock()
+	defer s.flushMtx.Unlock()
+
+	s.mtx.Lock()
+	dirtyIds := make([]string, 0, len(s.dirty))
+	for id := range s.dirty {
+		dirtyIds = append(dirtyIds, id)
+	}
+	deletedIds := make([]string, 0, len(s.deleted))
+	for id := range s.deleted {
+		deletedIds = append(deletedIds, id)
+	}
+	var vs []Version
+	var err error
+	if len(dirtyIds) > 0 {
+		vs, err = s.front.ReadMulti(dirtyIds)
+		if err != nil {
+			s.mtx.Unlock()
+			return err
+		}
+	}
+	backingVersions := make([]int, len(dirtyIds), len(dirtyIds))
+	unknownIds := []string{}
+	for i, id := range dirtyIds {
+		if bv, exists := s.backingVersions[id]; exists {
+			backingVersions[i] = bv
+		} else {
+			backingVersions[i] = -1
+			unknownIds = append(unknownIds, id)
+		}
+	}
+	s.dirty = map[string]bool{}
+	s.deleted = map[string]bool{}
+	s.mtx.Unlock()
+
+	writeErr := s.writeBack(dirtyIds, vs, backingVersions, unknownIds)
+	var deleteErr error
+	if writeErr == nil {
+		deleteErr = s.backing.DeleteMulti(deletedIds)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, id := range dirtyIds {
+		if writeErr != nil {
+			// the backing version is unknown after a failed round, it is reread on the next flush.
+			delete(s.backingVersions, id)
+			if s.loaded[id] {
+				s.dirty[id] = true
+			}
+		} else if s.loaded[id] {
+			s.backingVersions[id] = vs[i].GetVersion()
+		}
+	}
+	for _, id := range deletedIds {
+		if writeErr != nil || deleteErr != nil {
+			if !s.loaded[id] {
+				s.deleted[id] = true
+			}
+		} else {
+			delete(s.backingVersions, id)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return deleteErr
+}
+
+// Stops the background flusher and performs a final Flush.
+func (s *tieredStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.Flush()
+}
+
+// Writes the in-memory state of each entity to the backing store based on the version the backing store holds, then
+// writes it again, in one UpdateMulti per round, until the backing version reaches the version in memory, as backing
+// stores only move versions on one update at a time. vs are the store's own copies so their versions can be moved
+// onto that base. If the backing store rejects a write, because it has moved on without this store or for any other
+// reason, the error is returned and the entities stay dirty.
+func (s *tieredStore) writeBack(ids []string, vs []Version, backingVersions []int, unknownIds []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(unknownIds) > 0 {
+		bvs, err := s.backing.ReadMulti(unknownIds)
+		if err != nil {
+			return err
+		}
+		known := map[string]int{}
+		for i, id := range unknownIds {
+			known[id] = bvs[i].GetVersion()
+		}
+		for i, id := range ids {
+			if backingVersions[i] == -1 {
+				backingVersions[i] = known[id]
+			}
+		}
+	}
+	targets := make([]int, len(vs))
+	for i, v := range vs {
+		targets[i] = v.GetVersion()
+		for v.GetVersion() > backingVersions[i] {
+			v.DecrementVersion()
+		}
+		for v.GetVersion() < backingVersions[i] {
+			v.IncrementVersion()
+		}
+	}
+	if err := s.backing.UpdateMulti(ids, vs); err != nil {
+		return err
+	}
+	for {
+		behindIds := []string{}
+		behindVs := []Version{}
+		for i, v := range vs {
+			if v.GetVersion() < targets[i] {
+				behindIds = append(behindIds, ids[i])
+				behindVs = append(behindVs, v)
+			}
+		}
+		if len(behindIds) == 0 {
+			return nil
+		}
+		if err := s.backing.UpdateMulti(behindIds, behindVs); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads any ids not yet in memory or pending deletion from the backing store into memory, s.mtx must be held.
+func (s *tieredStore) load(ids []string) error {
+	missIds := []string{}
+	for _, id := range ids {
+		if !s.loaded[id] && !s.deleted[id] {
+			missIds = append(missIds, id)
+		}
+	}
+	if len(missIds) == 0 {
+		return nil
+	}
+	vs, err := s.backing.ReadMulti(missIds)
+	if err != nil {
+		return err
+	}
+	for i, id := range missIds {
+		s.loaded[id] = true
+		s.backingVersions[id] = vs[i].GetVersion()
+	}
+	return s.seed.seed(s.front, missIds, vs)
+}
+
+func (s *tieredStore) flushLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Hands out pre-determined ids and entities to a store's IdFactory and EntityInitializer so that entities
+// can be created in it under ids chosen elsewhere, callers must serialize access.
+type seeder struct{
+	ids	[]string
+	vs	[]Version
+}
+
+func (s *seeder) seed(st Store, ids []string, vs []Version) error {
+	s.ids, s.vs = ids, vs
+	_, _, err := st.CreateMulti(uint(len(ids)))
+	s.ids, s.vs = nil, nil
+	return err
+}
+
+func (s *seeder) idFactory() string {
+	id := s.ids[0]
+	s.ids = s.ids[1:]
+	return id
+}
+
+func (s *seeder) entityInitializer(v Version) Version {
+	v = s.vs[0]
+	s.vs = s.vs[1:]
+	return v
+}
@@ -0,0 +1,213 @@
+package sus
+
+import(
+	`time`
+	`errors`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_TieredStore_Create_writes_through(t *testing.T){
+	backing, ts := newFooTieredStore(0, nil)
+
+	id, f, err := ts.Create()
+	bf, bErr := backing.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, bErr, `bErr should be nil`)
+	assert.Equal(t, f, bf, `backing should hold the created entity`)
+}
+
+func Test_TieredStore_CreateMulti_with_zero_count(t *testing.T){
+	_, ts := newFooTieredStore(0, nil)
+
+	ids, vs, err := ts.CreateMulti(0)
+
+	assert.Nil(t, ids, `ids should be nil`)
+	assert.Nil(t, vs, `vs should be nil`)
+	assert.Nil(t, err, `err should be nil`)
+}
+
+func Test_TieredStore_Update_is_written_behind(t *testing.T){
+	backing, ts := newFooTieredStore(0, nil)
+	id, f, _ := ts.Create()
+
+	ts.Update(id, f)
+	ts.Update(id, f)
+	ts.Update(id, f)
+	before, _ := backing.Read(id)
+	err := ts.Flush()
+	after, _ := backing.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 3, f.GetVersion(), `f's version should be 3`)
+	assert.Equal(t, 0, before.GetVersion(), `backing should not see updates before flush`)
+	assert.Equal(t, 3, after.GetVersion(), `backing should have been brought up to the version in memory`)
+}
+
+func Test_TieredStore_Update_NonsequentialUpdate_failure(t *testing.T){
+	_, ts := newFooTieredStore(0, nil)
+	id, f, _ := ts.Create()
+	f.IncrementVersion()
+
+	err := ts.Update(id, f)
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_TieredStore_UpdateMulti_IdCountNotEqualToEntityCount_failure(t *testing.T){
+	_, ts := newFooTieredStore(0, nil)
+
+	err := ts.UpdateMulti([]string{``}, []Version{})
+
+	assert.Equal(t, `id count (1) not equal to entity count (0)`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_TieredStore_Read_reads_through(t *testing.T){
+	backing, ts := newFooTieredStore(0, nil)
+	id, bf, _ := backing.Create()
+	backing.Update(id, bf)
+
+	f, err := ts.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, f.GetVersion(), `f's version should be 1`)
+
+	_, err = ts.Read(`a_fake_id`)
+
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_TieredStore_ReadMulti_with_zero_count(t *testing.T){
+	_, ts := newFooTieredStore(0, nil)
+
+	vs, err := ts.ReadMulti([]string{})
+
+	assert.Nil(t, vs, `vs should be nil`)
+	assert.Nil(t, err, `err should be nil`)
+}
+
+func Test_TieredStore_Delete_is_written_behind(t *testing.T){
+	backing, ts := newFooTieredStore(0, nil)
+	id, _, _ := ts.Create()
+
+	err := ts.Delete(id)
+	_, readErr := ts.Read(id)
+	_, beforeErr := backing.Read(id)
+	ts.Flush()
+	_, afterErr := backing.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.NotNil(t, readErr, `readErr should not be nil`)
+	assert.Nil(t, beforeErr, `backing should still hold the entity before flush`)
+	assert.NotNil(t, afterErr, `backing should not hold the entity after flush`)
+	assert.Nil(t, ts.DeleteMulti([]string{}), `deleting zero ids should succeed`)
+}
+
+func Test_TieredStore_warm_loads_on_start(t *testing.T){
+	backing := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, _, _ := backing.CreateMulti(2)
+
+	ts, err := NewTieredStore(backing, JsonMarshaler, JsonUnmarshaler, fooVersionFactory, 0, ids)
+	backing.DeleteMulti(ids)
+	vs, readErr := ts.ReadMulti(ids)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, 2, len(vs), `both warm entities should be served from memory`)
+
+	_, err = NewTieredStore(backing, JsonMarshaler, JsonUnmarshaler, fooVersionFactory, 0, ids)
+
+	assert.NotNil(t, err, `warm loading missing ids should fail`)
+}
+
+func Test_TieredStore_flushes_on_interval_and_Close(t *testing.T){
+	backing, ts := newFooTieredStore(time.Millisecond, nil)
+	id, f, _ := ts.Create()
+
+	ts.Update(id, f)
+	time.Sleep(50 * time.Millisecond)
+	intervalF, _ := backing.Read(id)
+	ts.Update(id, f)
+	err := ts.Close()
+	closeF, _ := backing.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, intervalF.GetVersion(), `interval flush should have written version 1`)
+	assert.Equal(t, 2, closeF.GetVersion(), `Close should have written version 2`)
+}
+
+func Test_TieredStore_Flush_failure_is_retried(t *testing.T){
+	flushErr := errors.New(`flush error`)
+	inner := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	backing := &failingUpdateStore{Store: inner}
+	ts, _ := NewTieredStore(backing, JsonMarshaler, JsonUnmarshaler, fooVersionFactory, 0, nil)
+	id, f, _ := ts.Create()
+	ts.Update(id, f)
+
+	backing.err = flushErr
+	err1 := ts.Flush()
+	backing.err = nil
+	err2 := ts.Flush()
+	bf, _ := inner.Read(id)
+
+	assert.Equal(t, flushErr, err1, `err1 should be flushErr`)
+	assert.Nil(t, err2, `err2 should be nil`)
+	assert.Equal(t, 1, bf.GetVersion(), `backing should be at version 1 after the retry`)
+}
+
+func Test_TieredStore_Flush_when_backing_is_ahead(t *testing.T){
+	backing, ts := newFooTieredStore(0, nil)
+	id, f, _ := ts.Create()
+	bf, _ := backing.Read(id)
+	backing.Update(id, bf)
+	backing.Update(id, bf)
+	ts.Update(id, f)
+
+	err1 := ts.Flush()
+	err2 := ts.Flush()
+	after, _ := backing.Read(id)
+	err3 := ts.Flush()
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, err1.Error(), `the rejected write should be reported`)
+	assert.Nil(t, err2, `err2 should be nil`)
+	assert.Equal(t, 3, after.GetVersion(), `the entity should have stayed dirty and been written over the backing version`)
+	assert.Nil(t, err3, `err3 should be nil`)
+}
+
+func Test_TieredStore_reload_rejects_stale_versions(t *testing.T){
+	backing, ts := newFooTieredStore(0, nil)
+	id, f, _ := ts.Create()
+	ts.Update(id, f)
+	ts.Update(id, f)
+	stale := &foo{Version: f.GetVersion()}
+	ts.Update(id, f)
+	ts.Update(id, f)
+	closeErr := ts.Close()
+
+	reloaded, _ := NewTieredStore(backing, JsonMarshaler, JsonUnmarshaler, fooVersionFactory, 0, nil)
+	staleErr := reloaded.Update(id, stale)
+	v, _ := reloaded.Read(id)
+
+	assert.Nil(t, closeErr, `closeErr should be nil`)
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, staleErr.Error(), `the stale update should be rejected after a reload`)
+	assert.Equal(t, 4, v.GetVersion(), `the reloaded entity should be at the version it reached in memory`)
+}
+
+type failingUpdateStore struct{
+	Store
+	err	error
+}
+
+func (s *failingUpdateStore) UpdateMulti(ids []string, vs []Version) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Store.UpdateMulti(ids, vs)
+}
+
+func newFooTieredStore(flushInterval time.Duration, warmIds []string) (Store, TieredStore) {
+	backing := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ts, _ := NewTieredStore(backing, JsonMarshaler, JsonUnmarshaler, fooVersionFactory, flushInterval, warmIds)
+	return backing, ts
+}
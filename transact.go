@@ -0,0 +1,197 @@
+package sus
+
+const(
+	maxTransactAttempts	= 10
+	absentVersion		= -1
+)
+
+// The operations available to a function run by Transact, their effects only become visible once it commits.
+type Tx interface{
+	Create() (id string, v Version, err error)
+	Read(id string) (v Version, err error)
+	Update(id string, v Version) error
+	// Deletes the entity with id, which must exist, the transaction only commits if it is still at the version the
+	// transaction first read.
+	Delete(id string) error
+}
+
+// A store that can run interactive transactions.
+type Transactor interface{
+	// Runs fn and commits everything it did through tx atomically, provided nothing it read has changed in the
+	// meantime. If something has, fn is run again from scratch, up to 10 times in all. An error from fn aborts the
+	// transaction without a retry. Versions of entities updated through tx are rolled back if it does not commit.
+	Transact(fn func(tx Tx) error) error
+}
+
+// Runs fn as an interactive transaction on s, failing if s is not a Transactor. Stores wrapping another store
+// forward Transact through this.
+func transactOn(s Store, fn func(tx Tx) error) error {
+	t, ok := s.(Transactor)
+	if !ok {
+		return &notTransactorError{}
+	}
+	return t.Transact(fn)
+}
+
+// Runs fn as a serializable transaction, retrying it on conflicts.
+func (s *store) Transact(fn func(tx Tx) error) (err error) {
+	for attempt := 0; attempt < maxTransactAttempts; attempt++ {
+		t := &tx{store: s, reads: map[string]int{}, writes: map[string]*txWrite{}}
+		if err = fn(t); err == nil {
+			err = t.commit()
+		}
+		if err == nil {
+			return
+		}
+		t.rollback()
+		if _, conflict := err.(*txConflictError); !conflict {
+			return
+		}
+	}
+	return
+}
+
+// A buffered write, a nil v is a delete.
+type txWrite struct{
+	v		Version
+	created	bool
+}
+
+type tx struct{
+	store		*store
+	reads		map[string]int
+	writes		map[string]*txWrite
+	order		[]string
+	incremented	[]Version
+}
+
+// Creates a new versioned entity that will be stored when the transaction commits.
+func (t *tx) Create() (id string, v Version, err error) {
+	id = t.store.idFactory()
+	v = t.store.entityInitializer(t.store.versionFactory())
+	t.write(id, &txWrite{v, true})
+	return
+}
+
+// Fetches the versioned entity with id as this transaction sees it.
+func (t *tx) Read(id string) (Version, error) {
+	if w, exists := t.writes[id]; exists {
+		if w.v == nil {
+			return nil, &nonExtantError{localEntityDoesNotExistError{id}}
+		}
+		return w.v, nil
+	}
+	var vs []Version
+	err := t.store.runInTransaction(func() (err error) {
+		vs, err = t.store.getMulti([]string{id})
+		return
+	})
+	version := absentVersion
+	if err == nil {
+		version = vs[0].GetVersion()
+	} else if !t.store.isNonExtantError(err) {
+		return nil, err
+	}
+	if read, seen := t.reads[id]; seen && read != version {
+		// the entity changed since this transaction first read it so it can never commit.
+		return nil, &txConflictError{id}
+	}
+	t.reads[id] = version
+	if err != nil {
+		return nil, &nonExtantError{err}
+	}
+	return vs[0], nil
+}
+
+// Updates the versioned entity with id once the transaction commits, v's version is incremented straight away.
+func (t *tx) Update(id string, v Version) error {
+	current, err := t.Read(id)
+	if err != nil {
+		return err
+	}
+	if current.GetVersion() != v.GetVersion() {
+		return &nonsequentialUpdateError{id}
+	}
+	v.IncrementVersion()
+	t.incremented = append(t.incremented, v)
+	created := false
+	if w, exists := t.writes[id]; exists {
+		created = w.created
+	}
+	t.write(id, &txWrite{v, created})
+	return nil
+}
+
+// Deletes the versioned entity with id once the transaction commits, provided it is unchanged since it was read.
+func (t *tx) Delete(id string) error {
+	if _, err := t.Read(id); err != nil {
+		return err
+	}
+	created := false
+	if w, exists := t.writes[id]; exists {
+		created = w.created
+	}
+	t.write(id, &txWrite{nil, created})
+	return nil
+}
+
+func (t *tx) write(id string, w *txWrite) {
+	if _, exists := t.writes[id]; !exists {
+		t.order = append(t.order, id)
+	}
+	t.writes[id] = w
+}
+
+// Checks every read is still current and applies every write in a single run of the store's transaction.
+func (t *tx) commit() error {
+	return t.store.runInTransaction(func() error {
+		for id, read := range t.reads {
+			vs, err := t.store.getMulti([]string{id})
+			if err != nil {
+				if !t.store.isNonExtantError(err) {
+					return err
+				}
+				if read != absentVersion {
+					return &txConflictError{id}
+				}
+			} else if vs[0].GetVersion() != read {
+				return &txConflictError{id}
+			}
+		}
+		putIds, putVs, delIds := []string{}, []Version{}, []string{}
+		for _, id := range t.order {
+			w := t.writes[id]
+			if w.v != nil {
+				putIds = append(putIds, id)
+				putVs = append(putVs, w.v)
+			} else if !w.created {
+				delIds = append(delIds, id)
+			}
+		}
+		if len(putIds) > 0 {
+			if err := t.store.putMulti(putIds, putVs); err != nil {
+				return err
+			}
+		}
+		if len(delIds) > 0 {
+			return t.store.deleteMulti(delIds)
+		}
+		return nil
+	})
+}
+
+func (t *tx) rollback() {
+	for _, v := range t.incremented {
+		v.DecrementVersion()
+	}
+}
+
+type txConflictError struct{
+	id	string
+}
+
+func (e *txConflictError) Error() string { return `transaction conflicted with a concurrent write to entity with id "`+e.id+`"` }
+
+type notTransactorError struct{}
+
+func (e *notTransactorError) Error() string { return `store does not support transactions` }
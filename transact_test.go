@@ -0,0 +1,210 @@
+package sus
+
+import(
+	`os`
+	`errors`
+	`io/ioutil`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+var abortErr = errors.New(`abort`)
+
+func Test_Transact_reads_and_writes_atomically(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, _, _ := s.CreateMulti(2)
+	var createdId string
+
+	err := s.(Transactor).Transact(func(tx Tx) error {
+		a, err := tx.Read(ids[0])
+		if err != nil {
+			return err
+		}
+		if err = tx.Update(ids[0], a); err != nil {
+			return err
+		}
+		if err = tx.Delete(ids[1]); err != nil {
+			return err
+		}
+		createdId, _, err = tx.Create()
+		return err
+	})
+	a, _ := s.Read(ids[0])
+	_, deletedErr := s.Read(ids[1])
+	_, createdErr := s.Read(createdId)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, a.GetVersion(), `a's version should be 1`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+ids[1]+`" does not exist`, deletedErr.Error(), `deletedErr should contain expected msg`)
+	assert.Nil(t, createdErr, `the created entity should exist`)
+}
+
+func Test_Transact_sees_its_own_writes(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, _, _ := s.Create()
+	var createdId string
+
+	err := s.(Transactor).Transact(func(tx Tx) error {
+		v, _ := tx.Read(id)
+		tx.Update(id, v)
+		again, _ := tx.Read(id)
+		if err := tx.Update(id, again); err != nil {
+			return err
+		}
+		var created Version
+		createdId, created, _ = tx.Create()
+		tx.Update(createdId, created)
+		tx.Delete(createdId)
+		_, err := tx.Read(createdId)
+		return errors.New(err.Error())
+	})
+	_, neverCreatedErr := s.Read(createdId)
+	v, _ := s.Read(id)
+
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+createdId+`" does not exist`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, 0, v.GetVersion(), `an aborted transaction should write nothing`)
+	assert.NotNil(t, neverCreatedErr, `the created entity should not exist`)
+}
+
+func Test_Transact_retries_on_conflict(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	attempts := 0
+
+	err := s.(Transactor).Transact(func(tx Tx) error {
+		attempts++
+		v, _ := tx.Read(id)
+		if attempts == 1 {
+			// a write from outside the transaction lands after its read, nesting store calls must not deadlock.
+			s.Update(id, f)
+		}
+		return tx.Update(id, v)
+	})
+	v, _ := s.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, attempts, `fn should have been run twice`)
+	assert.Equal(t, 2, v.GetVersion(), `both updates should have been applied`)
+}
+
+func Test_Transact_gives_up_after_repeated_conflicts(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	attempts := 0
+	var v Version
+
+	err := s.(Transactor).Transact(func(tx Tx) error {
+		attempts++
+		v, _ = tx.Read(id)
+		s.Update(id, f)
+		return tx.Update(id, v)
+	})
+
+	assert.Equal(t, `transaction conflicted with a concurrent write to entity with id "`+id+`"`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, 10, attempts, `fn should have been run 10 times`)
+	assert.Equal(t, 9, v.GetVersion(), `the last attempt's update should have been rolled back`)
+}
+
+func Test_Transact_conflict_on_repeated_read(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	var readErr error
+
+	s.(Transactor).Transact(func(tx Tx) error {
+		tx.Read(id)
+		if readErr == nil {
+			s.Update(id, f)
+			_, readErr = tx.Read(id)
+		}
+		return nil
+	})
+
+	assert.Equal(t, `transaction conflicted with a concurrent write to entity with id "`+id+`"`, readErr.Error(), `readErr should contain expected msg`)
+}
+
+func Test_Transact_fn_error_aborts_without_retry(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	attempts := 0
+
+	err := s.(Transactor).Transact(func(tx Tx) error {
+		attempts++
+		tx.Update(id, f)
+		return abortErr
+	})
+	v, _ := s.Read(id)
+
+	assert.Equal(t, abortErr, err, `err should be abortErr`)
+	assert.Equal(t, 1, attempts, `fn should have been run once`)
+	assert.Equal(t, 0, f.GetVersion(), `f's version should have been rolled back`)
+	assert.Equal(t, 0, v.GetVersion(), `nothing should have been written`)
+}
+
+func Test_Transact_Update_errors(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	f.IncrementVersion()
+	var seqErr, nonExtantErr error
+
+	s.(Transactor).Transact(func(tx Tx) error {
+		seqErr = tx.Update(id, f)
+		nonExtantErr = tx.Update(`a_fake_id`, f)
+		return nil
+	})
+
+	assert.Equal(t, `nonsequential update for entity with id "`+id+`"`, seqErr.Error(), `seqErr should contain expected msg`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, nonExtantErr.Error(), `nonExtantErr should contain expected msg`)
+}
+
+func Test_Transact_Delete_is_version_checked(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := s.Create()
+	attempts := 0
+	var nonExtantErr error
+
+	err := s.(Transactor).Transact(func(tx Tx) error {
+		attempts++
+		nonExtantErr = tx.Delete(`a_fake_id`)
+		if err := tx.Delete(id); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			s.Update(id, f)
+		}
+		return nil
+	})
+	_, deletedErr := s.Read(id)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, attempts, `the delete should have conflicted with the concurrent update and been retried`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, nonExtantErr.Error(), `nonExtantErr should contain expected msg`)
+	assert.NotNil(t, deletedErr, `the entity should have been deleted`)
+}
+
+func Test_transactOn_non_transactor(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	err := transactOn(struct{ Store }{s}, func(tx Tx) error { return nil })
+
+	assert.Equal(t, `store does not support transactions`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_Transact_with_file_and_persistent_stores(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	fs, _ := NewJsonFileStore(dir+`/file`, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ps, _ := NewJsonPersistentMemoryStore(dir+`/persistent`, 0, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	defer ps.Close()
+
+	for _, s := range []Store{fs, ps} {
+		id, _, _ := s.Create()
+		err := s.(Transactor).Transact(func(tx Tx) error {
+			v, _ := tx.Read(id)
+			return tx.Update(id, v)
+		})
+		v, _ := s.Read(id)
+
+		assert.Nil(t, err, `err should be nil`)
+		assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	}
+}
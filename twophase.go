@@ -0,0 +1,528 @@
+package sus
+
+import(
+	`os`
+	`sort`
+	`sync`
+	`time`
+	`strconv`
+	`io/ioutil`
+)
+
+const(
+	twoPhaseIndexKey	= `.2pc`
+	txBegin				= byte(0)
+	txCommit			= byte(1)
+	txDone				= byte(2)
+)
+
+// A store that can take part in a transaction run by a Coordinator.
+type Participant interface{
+	// Checks that vs are the current versions of the entities with ids and durably stages their next versions under
+	// txId, a nil Version stages a delete. The ids are locked against any other write until Commit or Abort.
+	Prepare(txId string, ids []string, vs []Version) error
+	// Applies the writes staged under txId and releases their locks, does nothing if txId is not prepared.
+	Commit(txId string) error
+	// Discards the writes staged under txId and releases their locks, does nothing if txId is not prepared.
+	Abort(txId string) error
+}
+
+// A store that is also a Participant.
+type ParticipantStore interface{
+	Store
+	Participant
+}
+
+// The writes one participant makes in a transaction, a nil Version deletes its entity.
+type TxWrites struct{
+	Ids	[]string
+	Vs	[]Version
+}
+
+// Runs transactions across several participants with a two phase commit.
+type Coordinator interface{
+	// Prepares writes (keyed by participant name) on every participant and then commits them all, or aborts them all if
+	// any prepare fails. On success every non nil Version is incremented.
+	Commit(writes map[string]TxWrites) error
+	// Finishes every transaction in the log that was interrupted, committing those that reached the commit point and
+	// aborting the rest.
+	Recover() error
+	Close() error
+}
+
+// Creates and configures a participant store that stores entities by converting them to and from json []byte data
+// and keeps them in the local system memory, prepared transactions do not survive a restart.
+func NewJsonMemoryParticipantStore(idf IdFactory, vf VersionFactory, ei EntityInitializer) ParticipantStore {
+	return NewMemoryParticipantStore(JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a participant store that stores entities by converting them to and from []byte and keeps
+// them in the local system memory, prepared transactions do not survive a restart.
+func NewMemoryParticipantStore(m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) ParticipantStore {
+	get, put, del := memoryByteFuncs()
+	s, _ := NewParticipantStore(get, put, del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, mutexRunInTransaction())
+	return s
+}
+
+// Creates and configures a participant store that stores entities by converting them to and from json []byte data
+// and keeps them in the local file system.
+func NewJsonFileParticipantStore(storeDir string, idf IdFactory, vf VersionFactory, ei EntityInitializer) (ParticipantStore, error) {
+	return NewFileParticipantStore(storeDir, `json`, JsonMarshaler, JsonUnmarshaler, idf, vf, ei)
+}
+
+// Creates and configures a participant store that stores entities by converting them to and from []byte and keeps
+// them in the local file system, locked with the store's lock file so prepared transactions hold their locks against
+// other processes using the same storeDir too.
+func NewFileParticipantStore(storeDir string, fileExt string, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer) (ParticipantStore, error) {
+	return NewFileParticipantStoreWithOptions(storeDir, fileExt, m, un, idf, vf, ei, FileStoreOptions{})
+}
+
+// Creates and configures a participant store as NewFileParticipantStore does, keeping its files as a file store opened
+// with opts would, see NewFileStoreWithOptions.
+func NewFileParticipantStoreWithOptions(storeDir string, fileExt string, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, opts FileStoreOptions) (ParticipantStore, error) {
+	get, put, del, err := fileByteFuncs(storeDir, fileExt, opts)
+	if err != nil {
+		return nil, err
+	}
+	rit, _ := fileStoreRunInTransaction(storeDir, opts)
+	return NewParticipantStoreWithOptions(get, put, del, m, un, idf, vf, ei, isLocalEntityDoesNotExistError, rit, ByteStoreOptions{opts.Registry})
+}
+
+// Creates and configures a participant store that stores entities by converting them to and from []byte. Prepared
+// writes are staged under the reserved ids ".2pc" and ".2pc.<txId>" so they survive a restart whenever bg, bp and d
+// are durable, ids from idf must not start with ".2pc". Every operation runs in rit and reloads the prepared
+// transactions first, so when rit excludes other processes their prepared locks are honoured as well.
+func NewParticipantStore(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, rit RunInTransaction) (ParticipantStore, error) {
+	return NewParticipantStoreWithOptions(bg, bp, d, m, un, idf, vf, ei, inee, rit, ByteStoreOptions{})
+}
+
+// Creates and configures a participant store as NewParticipantStore does, decoding enveloped records with the codecs
+// and types in opts.Registry, see NewByteStoreWithOptions.
+func NewParticipantStoreWithOptions(bg ByteGetter, bp BytePutter, d Deleter, m Marshaler, un Unmarshaler, idf IdFactory, vf VersionFactory, ei EntityInitializer, inee IsNonExtantError, rit RunInTransaction, opts ByteStoreOptions) (ParticipantStore, error) {
+	s := &participantStore{
+		get: bg,
+		put: bp,
+		del: d,
+		marshaler: m,
+		unmarshaler: un,
+		versionFactory: vf,
+		isNonExtantError: inee,
+		runInTransaction: rit,
+		registry: opts.Registry,
+	}
+	if err := rit(s.load); err != nil {
+		return nil, err
+	}
+	s.Store = newCheckedByteStore(bg, bp, d, m, un, idf, vf, ei, inee, s.run, opts, s.checkUnlocked)
+	return s, nil
+}
+
+type participantStore struct{
+	Store
+	get					ByteGetter
+	put					BytePutter
+	del					Deleter
+	marshaler			Marshaler
+	unmarshaler			Unmarshaler
+	versionFactory		VersionFactory
+	isNonExtantError	IsNonExtantError
+	runInTransaction	RunInTransaction
+	registry			*Registry
+	prepared			map[string][]*logOp
+	locks				map[string]string
+}
+
+// Runs tran in the store's transaction once the prepared transactions have been reloaded.
+func (s *participantStore) run(tran Transaction) error {
+	return s.runInTransaction(func() error {
+		if err := s.load(); err != nil {
+			return err
+		}
+		return tran()
+	})
+}
+
+// Checks vs are current and durably stages their next versions under txId, locking ids until Commit or Abort.
+func (s *participantStore) Prepare(txId string, ids []string, vs []Version) error {
+	count := len(ids)
+	if count != len(vs) {
+		return &idCountNotEqualToEntityCountError{count, len(vs)}
+	}
+	return s.run(func() error {
+		return s.prepare(txId, ids, vs)
+	})
+}
+
+func (s *participantStore) prepare(txId string, ids []string, vs []Version) error {
+	if _, exists := s.prepared[txId]; exists {
+		return nil
+	}
+	ops := make([]*logOp, 0, len(ids))
+	for i, id := range ids {
+		if holder, locked := s.locks[id]; locked {
+			return &lockedEntityError{id, holder}
+		}
+		if vs[i] == nil {
+			ops = append(ops, &logOp{deleteOp, id, nil})
+			continue
+		}
+		d, err := s.get(id)
+		if err != nil {
+			if s.isNonExtantError(err) {
+				err = &nonExtantError{err}
+			}
+			return err
+		}
+		current := newRecordVersion(s.registry, s.versionFactory, d)
+		if err = unmarshalRecord(s.registry, s.unmarshaler, d, current); err != nil {
+			return err
+		}
+		if current.GetVersion() != vs[i].GetVersion() {
+			return &nonsequentialUpdateError{id}
+		}
+		vs[i].IncrementVersion()
+		d, err = s.marshaler(vs[i])
+		vs[i].DecrementVersion()
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &logOp{putOp, id, d})
+	}
+	if err := s.put(twoPhaseStagedKey(txId), encodeRecord(ops)); err != nil {
+		return err
+	}
+	s.prepared[txId] = ops
+	if err := s.writeIndex(); err != nil {
+		delete(s.prepared, txId)
+		s.del(twoPhaseStagedKey(txId))
+		return err
+	}
+	for _, op := range ops {
+		s.locks[op.id] = txId
+	}
+	return nil
+}
+
+// Applies the writes staged under txId and releases their locks.
+func (s *participantStore) Commit(txId string) error {
+	return s.run(func() error {
+		return s.commit(txId)
+	})
+}
+
+func (s *participantStore) commit(txId string) error {
+	ops, exists := s.prepared[txId]
+	if !exists {
+		return nil
+	}
+	for _, op := range ops {
+		if op.kind == putOp {
+			if err := s.put(op.id, op.d); err != nil {
+				return err
+			}
+		} else if _, err := s.get(op.id); err == nil {
+			if err = s.del(op.id); err != nil {
+				return err
+			}
+		} else if !s.isNonExtantError(err) {
+			return err
+		}
+	}
+	return s.finish(txId)
+}
+
+// Discards the writes staged under txId and releases their locks.
+func (s *participantStore) Abort(txId string) error {
+	return s.run(func() error {
+		if _, exists := s.prepared[txId]; !exists {
+			return nil
+		}
+		return s.finish(txId)
+	})
+}
+
+// Runs fn as an interactive transaction, its writes fail on entities locked by a prepared transaction.
+func (s *participantStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+// Forgets txId, the index is rewritten first so a crash part way through at worst leaves an unreferenced staged record.
+func (s *participantStore) finish(txId string) error {
+	ops := s.prepared[txId]
+	delete(s.prepared, txId)
+	if err := s.writeIndex(); err != nil {
+		s.prepared[txId] = ops
+		return err
+	}
+	for _, op := range ops {
+		delete(s.locks, op.id)
+	}
+	s.del(twoPhaseStagedKey(txId))
+	return nil
+}
+
+func (s *participantStore) writeIndex() error {
+	ops := make([]*logOp, 0, len(s.prepared))
+	for txId := range s.prepared {
+		ops = append(ops, &logOp{putOp, txId, nil})
+	}
+	return s.put(twoPhaseIndexKey, encodeRecord(ops))
+}
+
+func (s *participantStore) load() error {
+	s.prepared, s.locks = map[string][]*logOp{}, map[string]string{}
+	index, err := s.get(twoPhaseIndexKey)
+	if err != nil {
+		if s.isNonExtantError(err) {
+			return nil
+		}
+		return err
+	}
+	txIds, n := decodeRecord(index)
+	if n != len(index) {
+		return &corruptTwoPhaseRecordError{twoPhaseIndexKey}
+	}
+	for _, tx := range txIds {
+		key := twoPhaseStagedKey(tx.id)
+		staged, err := s.get(key)
+		if err != nil {
+			return err
+		}
+		ops, n := decodeRecord(staged)
+		if n != len(staged) {
+			return &corruptTwoPhaseRecordError{key}
+		}
+		s.prepared[tx.id] = ops
+		for _, op := range ops {
+			s.locks[op.id] = tx.id
+		}
+	}
+	return nil
+}
+
+func (s *participantStore) checkUnlocked(ids []string) error {
+	for _, id := range ids {
+		if holder, locked := s.locks[id]; locked {
+			return &lockedEntityError{id, holder}
+		}
+	}
+	return nil
+}
+
+func twoPhaseStagedKey(txId string) string {
+	return twoPhaseIndexKey + `.` + txId
+}
+
+// Creates a coordinator for participants (keyed by name) whose decisions are logged to the file at logPath, any
+// transaction a previous coordinator left unfinished in the log is recovered before this returns.
+func NewCoordinator(logPath string, participants map[string]Participant) (Coordinator, error) {
+	c := &coordinator{
+		logPath: logPath,
+		participants: participants,
+		txPrefix: strconv.FormatInt(time.Now().UnixNano(), 36),
+		active: map[string]bool{},
+	}
+	var err error
+	if c.log, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	if err = c.Recover(); err != nil {
+		c.log.Close()
+		return nil, err
+	}
+	// nothing is in flight yet and everything logged has been finished so the log can start afresh.
+	if err = c.log.Truncate(0); err != nil {
+		c.log.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type coordinator struct{
+	mtx				sync.Mutex
+	logPath			string
+	log				appendableLog
+	participants	map[string]Participant
+	txPrefix		string
+	txSeq			uint64
+	active			map[string]bool
+}
+
+// The state of one transaction as recorded in the coordinator log.
+type txRecord struct{
+	participants	[]string
+	committed		bool
+	done			bool
+}
+
+// Prepares writes on every participant and then commits them all, or aborts them all if any prepare fails.
+func (c *coordinator) Commit(writes map[string]TxWrites) error {
+	names := make([]string, 0, len(writes))
+	for name := range writes {
+		if _, exists := c.participants[name]; !exists {
+			return &unknownParticipantError{name}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c.mtx.Lock()
+	c.txSeq++
+	txId := c.txPrefix + `-` + strconv.FormatUint(c.txSeq, 36)
+	c.active[txId] = true
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		delete(c.active, txId)
+		c.mtx.Unlock()
+	}()
+	begin := make([]*logOp, 0, len(names)+1)
+	begin = append(begin, &logOp{putOp, txId, []byte{txBegin}})
+	for _, name := range names {
+		begin = append(begin, &logOp{putOp, name, nil})
+	}
+	if err := c.appendLog(begin); err != nil {
+		return err
+	}
+	var err error
+	for _, name := range names {
+		if err = c.participants[name].Prepare(txId, writes[name].Ids, writes[name].Vs); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		// once the commit record is durable the transaction must be committed everywhere, whatever happens next.
+		err = c.appendLog([]*logOp{{putOp, txId, []byte{txCommit}}})
+	}
+	if err != nil {
+		// aborting is best effort, Recover aborts anything left prepared from a transaction without a commit record.
+		for _, name := range names {
+			c.participants[name].Abort(txId)
+		}
+		c.appendLog([]*logOp{{putOp, txId, []byte{txDone}}})
+		return err
+	}
+	for _, name := range names {
+		for _, v := range writes[name].Vs {
+			if v != nil {
+				v.IncrementVersion()
+			}
+		}
+	}
+	for _, name := range names {
+		if err = c.participants[name].Commit(txId); err != nil {
+			return &incompleteCommitError{txId, name, err}
+		}
+	}
+	return c.appendLog([]*logOp{{putOp, txId, []byte{txDone}}})
+}
+
+// Finishes every interrupted transaction in the log that is not currently being run by Commit.
+func (c *coordinator) Recover() error {
+	txs, order, err := c.readLog()
+	if err != nil {
+		return err
+	}
+	for _, txId := range order {
+		tx := txs[txId]
+		c.mtx.Lock()
+		active := c.active[txId]
+		c.mtx.Unlock()
+		if tx.done || active {
+			continue
+		}
+		for _, name := range tx.participants {
+			p, exists := c.participants[name]
+			if !exists {
+				return &unknownParticipantError{name}
+			}
+			if tx.committed {
+				err = p.Commit(txId)
+			} else {
+				err = p.Abort(txId)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err = c.appendLog([]*logOp{{putOp, txId, []byte{txDone}}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *coordinator) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.log.Close()
+}
+
+func (c *coordinator) appendLog(ops []*logOp) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return appendRecord(c.log, ops)
+}
+
+// Reads the state of every logged transaction, ignoring a torn record at the tail.
+func (c *coordinator) readLog() (map[string]*txRecord, []string, error) {
+	c.mtx.Lock()
+	log, err := ioutil.ReadFile(c.logPath)
+	c.mtx.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	txs := map[string]*txRecord{}
+	order := []string{}
+	for offset := 0; offset < len(log); {
+		ops, n := decodeRecord(log[offset:])
+		if n == 0 || len(ops) == 0 || len(ops[0].d) != 1 {
+			break
+		}
+		offset += n
+		txId := ops[0].id
+		tx, exists := txs[txId]
+		if !exists {
+			tx = &txRecord{}
+			txs[txId] = tx
+			order = append(order, txId)
+		}
+		switch ops[0].d[0] {
+		case txBegin:
+			for _, op := range ops[1:] {
+				tx.participants = append(tx.participants, op.id)
+			}
+		case txCommit:
+			tx.committed = true
+		case txDone:
+			tx.done = true
+		}
+	}
+	return txs, order, nil
+}
+
+type lockedEntityError struct{
+	id		string
+	txId	string
+}
+
+func (e *lockedEntityError) Error() string { return `entity with id "`+e.id+`" is locked by prepared transaction "`+e.txId+`"` }
+
+type corruptTwoPhaseRecordError struct{
+	key	string
+}
+
+func (e *corruptTwoPhaseRecordError) Error() string { return `two phase commit record "`+e.key+`" is corrupt` }
+
+type unknownParticipantError struct{
+	name	string
+}
+
+func (e *unknownParticipantError) Error() string { return `unknown participant "`+e.name+`"` }
+
+type incompleteCommitError struct{
+	txId		string
+	participant	string
+	inner		error
+}
+
+func (e *incompleteCommitError) Error() string { return `transaction "`+e.txId+`" is committed but participant "`+e.participant+`" has not applied it yet, Recover will finish it: `+e.inner.Error() }
@@ -0,0 +1,268 @@
+package sus
+
+import(
+	`os`
+	`errors`
+	`io/ioutil`
+	`path/filepath`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+var commitFailedErr = errors.New(`commit failed`)
+
+func Test_Coordinator_Commit_across_participants(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	mem := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	file, _ := NewJsonFileParticipantStore(filepath.Join(dir, `file`), newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	c, _ := NewCoordinator(filepath.Join(dir, `log`), map[string]Participant{`mem`: mem, `file`: file})
+	defer c.Close()
+	memIds, memFs, _ := mem.CreateMulti(2)
+	fileId, fileF, _ := file.Create()
+
+	err := c.Commit(map[string]TxWrites{
+		`mem`: {memIds, []Version{memFs[0], nil}},
+		`file`: {[]string{fileId}, []Version{fileF}},
+	})
+	memV, _ := mem.Read(memIds[0])
+	_, deletedErr := mem.Read(memIds[1])
+	fileV, _ := file.Read(fileId)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, memFs[0].GetVersion(), `memFs[0]'s version should be 1`)
+	assert.Equal(t, 1, fileF.GetVersion(), `fileF's version should be 1`)
+	assert.Equal(t, 1, memV.GetVersion(), `memV's version should be 1`)
+	assert.Equal(t, `Non extant error, inner error message: entity with id "`+memIds[1]+`" does not exist`, deletedErr.Error(), `deletedErr should contain expected msg`)
+	assert.Equal(t, 1, fileV.GetVersion(), `fileV's version should be 1`)
+}
+
+func Test_Coordinator_Commit_aborts_everywhere_when_a_prepare_fails(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	a := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	b := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	c, _ := NewCoordinator(filepath.Join(dir, `log`), map[string]Participant{`a`: a, `b`: b})
+	defer c.Close()
+	aId, aF, _ := a.Create()
+	bId, bF, _ := b.Create()
+	bF.IncrementVersion()
+
+	err := c.Commit(map[string]TxWrites{`a`: {[]string{aId}, []Version{aF}}, `b`: {[]string{bId}, []Version{bF}}})
+	aV, _ := a.Read(aId)
+	updateErr := a.Update(aId, aV)
+
+	assert.Equal(t, `nonsequential update for entity with id "`+bId+`"`, err.Error(), `err should contain expected msg`)
+	assert.Equal(t, 0, aF.GetVersion(), `aF's version should be unchanged`)
+	assert.Equal(t, 1, aV.GetVersion(), `only the later update should have been applied to a's entity`)
+	assert.Nil(t, updateErr, `a's entity should have been unlocked`)
+}
+
+func Test_Coordinator_Commit_unknown_participant(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	c, _ := NewCoordinator(filepath.Join(dir, `log`), map[string]Participant{})
+	defer c.Close()
+
+	err := c.Commit(map[string]TxWrites{`a`: {}})
+
+	assert.Equal(t, `unknown participant "a"`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_ParticipantStore_locks_prepared_entities(t *testing.T){
+	p := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := p.Create()
+	p.Prepare(`tx`, []string{id}, []Version{f})
+
+	updateErr := p.Update(id, f)
+	staleErr := p.Update(id, &foo{Version: 5})
+	deleteErr := p.Delete(id)
+	prepareErr := p.Prepare(`other`, []string{id}, []Version{f})
+	countErr := p.Prepare(`other`, []string{id}, []Version{})
+	v, readErr := p.Read(id)
+	p.Abort(`tx`)
+	unlockedErr := p.Update(id, f)
+
+	assert.Equal(t, `entity with id "`+id+`" is locked by prepared transaction "tx"`, updateErr.Error(), `updateErr should contain expected msg`)
+	assert.Equal(t, `entity with id "`+id+`" is locked by prepared transaction "tx"`, staleErr.Error(), `locks should be checked before versions`)
+	assert.Equal(t, `entity with id "`+id+`" is locked by prepared transaction "tx"`, deleteErr.Error(), `deleteErr should contain expected msg`)
+	assert.Equal(t, `entity with id "`+id+`" is locked by prepared transaction "tx"`, prepareErr.Error(), `prepareErr should contain expected msg`)
+	assert.Equal(t, `id count (1) not equal to entity count (0)`, countErr.Error(), `countErr should contain expected msg`)
+	assert.Nil(t, readErr, `reads should not be blocked`)
+	assert.Equal(t, 0, v.GetVersion(), `reads should see the committed version`)
+	assert.Nil(t, unlockedErr, `unlockedErr should be nil`)
+	assert.Equal(t, 1, f.GetVersion(), `only the unlocked update should have incremented f's version`)
+}
+
+func Test_ParticipantStore_Prepare_errors(t *testing.T){
+	p := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	err := p.Prepare(`tx`, []string{`a_fake_id`}, []Version{&foo{}})
+
+	assert.Equal(t, `Non extant error, inner error message: entity with id "a_fake_id" does not exist`, err.Error(), `err should contain expected msg`)
+	assert.Nil(t, p.Commit(`tx`), `committing an unprepared transaction should do nothing`)
+	assert.Nil(t, p.Abort(`tx`), `aborting an unprepared transaction should do nothing`)
+}
+
+func Test_FileParticipantStore_keeps_prepared_transactions_across_restarts(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	p, _ := NewJsonFileParticipantStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := p.Create()
+	p.Prepare(`tx`, []string{id}, []Version{f})
+
+	reopened, err := NewJsonFileParticipantStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	lockedErr := reopened.Update(id, f)
+	commitErr := reopened.Commit(`tx`)
+	v, _ := reopened.Read(id)
+	reopenedAgain, _ := NewJsonFileParticipantStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, `entity with id "`+id+`" is locked by prepared transaction "tx"`, lockedErr.Error(), `lockedErr should contain expected msg`)
+	assert.Nil(t, commitErr, `commitErr should be nil`)
+	assert.Equal(t, 1, v.GetVersion(), `v's version should be 1`)
+	assert.Nil(t, reopenedAgain.Update(id, v), `nothing should be locked after the commit`)
+}
+
+func Test_FileParticipantStore_honours_locks_prepared_by_another_store(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	p, _ := NewJsonFileParticipantStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	other, _ := NewJsonFileParticipantStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	id, f, _ := p.Create()
+	p.Prepare(`tx`, []string{id}, []Version{f})
+
+	lockedErr := other.Update(id, f)
+	other.Commit(`tx`)
+	v, _ := p.Read(id)
+
+	assert.Equal(t, `entity with id "`+id+`" is locked by prepared transaction "tx"`, lockedErr.Error(), `lockedErr should contain expected msg`)
+	assert.Equal(t, 1, v.GetVersion(), `the other store should have been able to commit the transaction`)
+}
+
+func Test_NewFileParticipantStore_corrupt_index(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, twoPhaseIndexKey+`.json`), []byte(`garbage`), 0600)
+
+	_, err := NewJsonFileParticipantStore(dir, newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+
+	assert.Equal(t, `two phase commit record ".2pc" is corrupt`, err.Error(), `err should contain expected msg`)
+}
+
+func Test_FileParticipantStore_uses_its_options(t *testing.T){
+	fs := NewMemoryFileSystem()
+	p, _ := NewFileParticipantStoreWithOptions(`participant`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, FileStoreOptions{FileSystem: fs, EncodeIds: true})
+	id, f, _ := p.Create()
+
+	err := p.Prepare(`tx`, []string{id}, []Version{f})
+	name, _ := EncodeFileStoreId(twoPhaseIndexKey)
+	_, readErr := fs.ReadFile(filepath.Join(`participant`, name+`.json`))
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, readErr, `the prepared transaction should be kept on the given file system under its encoded id`)
+}
+
+func Test_Coordinator_Recover_finishes_committed_transactions(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	a := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	b := &flakyParticipant{ParticipantStore: NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer), failCommit: true}
+	logPath := filepath.Join(dir, `log`)
+	c, _ := NewCoordinator(logPath, map[string]Participant{`a`: a, `b`: b})
+	aId, aF, _ := a.Create()
+	bId, bF, _ := b.Create()
+
+	err := c.Commit(map[string]TxWrites{`a`: {[]string{aId}, []Version{aF}}, `b`: {[]string{bId}, []Version{bF}}})
+	c.Close()
+	stale, _ := b.Read(bId)
+	lockedErr := b.Update(bId, stale)
+	b.failCommit = false
+	restarted, restartErr := NewCoordinator(logPath, map[string]Participant{`a`: a, `b`: b})
+	defer restarted.Close()
+	bV, _ := b.Read(bId)
+	aV, _ := a.Read(aId)
+
+	assert.Contains(t, err.Error(), `is committed but participant "b" has not applied it yet, Recover will finish it: commit failed`, `err should contain expected msg`)
+	assert.Equal(t, 1, aF.GetVersion(), `aF's version should be 1 as the transaction is committed`)
+	assert.Contains(t, lockedErr.Error(), `is locked by prepared transaction`, `b's entity should still be locked`)
+	assert.Nil(t, restartErr, `restartErr should be nil`)
+	assert.Equal(t, 1, aV.GetVersion(), `aV's version should be 1`)
+	assert.Equal(t, 1, bV.GetVersion(), `recovery should have committed b's write`)
+}
+
+func Test_Coordinator_Recover_aborts_transactions_without_a_commit_record(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	a := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	logPath := filepath.Join(dir, `log`)
+	c, _ := NewCoordinator(logPath, map[string]Participant{`a`: a})
+	aId, aF, _ := a.Create()
+	// simulate a crash after the begin record and prepare but before the commit record.
+	c.(*coordinator).appendLog([]*logOp{{putOp, `tx`, []byte{txBegin}}, {putOp, `a`, nil}})
+	a.Prepare(`tx`, []string{aId}, []Version{aF})
+	c.Close()
+
+	restarted, err := NewCoordinator(logPath, map[string]Participant{`a`: a})
+	defer restarted.Close()
+	updateErr := a.Update(aId, aF)
+	v, _ := a.Read(aId)
+	info, _ := os.Stat(logPath)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Nil(t, updateErr, `the prepared write should have been aborted and the entity unlocked`)
+	assert.Equal(t, 1, v.GetVersion(), `only the later update should have been applied`)
+	assert.Equal(t, int64(0), info.Size(), `the recovered log should have been truncated`)
+}
+
+func Test_Coordinator_Recover_reads_records_logged_after_a_failed_append(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	a := NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	b := &flakyParticipant{ParticipantStore: NewJsonMemoryParticipantStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)}
+	logPath := filepath.Join(dir, `log`)
+	c, _ := NewCoordinator(logPath, map[string]Participant{`a`: a, `b`: b})
+	log := &faultyLog{appendableLog: c.(*coordinator).log, writeErr: diskFullErr}
+	c.(*coordinator).log = log
+	aId, aF, _ := a.Create()
+	bId, bF, _ := b.Create()
+
+	tornErr := c.Commit(map[string]TxWrites{`a`: {[]string{aId}, []Version{aF}}})
+	log.writeErr = nil
+	b.failCommit = true
+	c.Commit(map[string]TxWrites{`a`: {[]string{aId}, []Version{aF}}, `b`: {[]string{bId}, []Version{bF}}})
+	c.Close()
+	b.failCommit = false
+	restarted, restartErr := NewCoordinator(logPath, map[string]Participant{`a`: a, `b`: b})
+	defer restarted.Close()
+	bV, _ := b.Read(bId)
+
+	assert.Equal(t, diskFullErr, tornErr, `tornErr should be diskFullErr`)
+	assert.Nil(t, restartErr, `restartErr should be nil`)
+	assert.Equal(t, 1, bV.GetVersion(), `the commit record logged after the failed append should have been recovered`)
+}
+
+func Test_NewCoordinator_unknown_participant_in_log(t *testing.T){
+	dir, _ := ioutil.TempDir(``, `sus`)
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, `log`)
+	c, _ := NewCoordinator(logPath, map[string]Participant{})
+	c.(*coordinator).appendLog([]*logOp{{putOp, `tx`, []byte{txBegin}}, {putOp, `gone`, nil}})
+	c.Close()
+
+	_, err := NewCoordinator(logPath, map[string]Participant{})
+
+	assert.Equal(t, `unknown participant "gone"`, err.Error(), `err should contain expected msg`)
+}
+
+type flakyParticipant struct{
+	ParticipantStore
+	failCommit	bool
+}
+
+func (p *flakyParticipant) Commit(txId string) error {
+	if p.failCommit {
+		return commitFailedErr
+	}
+	return p.ParticipantStore.Commit(txId)
+}
@@ -0,0 +1,39 @@
+package sus
+
+import(
+	`reflect`
+)
+
+// Returns a Marshaler that encodes entities with the codec registered under codecId in r and wraps them in an Envelope
+// recording the schema their type was registered under in r, see Registry.RegisterType, at its current version in r,
+// see Registry.RegisterMigrations. A store's Create makes entities with its own VersionFactory, an entity of another
+// registered type can replace one through Update as only versions are compared.
+func NewTypedMarshaler(r *Registry, codecId string) Marshaler {
+	return func(src Version) ([]byte, error) {
+		schema, exists := r.typeSchema(reflect.TypeOf(src))
+		if !exists {
+			return nil, &unregisteredTypeError{reflect.TypeOf(src)}
+		}
+		schemaVersion := uint64(len(r.schemaMigrations(schema).steps))
+		return NewEnvelopeMarshaler(r, codecId, schema, schemaVersion)(src)
+	}
+}
+
+// Returns a new entity to decode the record d into, of the type registered in r under its envelope's schema if it has
+// one and from vf otherwise.
+func newRecordVersion(r *Registry, vf VersionFactory, d []byte) Version {
+	if IsEnvelope(d) {
+		if e, err := DecodeEnvelope(d); err == nil {
+			if tvf, exists := r.typeFactory(e.Schema); exists {
+				return tvf()
+			}
+		}
+	}
+	return vf()
+}
+
+type unregisteredTypeError struct{
+	t	reflect.Type
+}
+
+func (e *unregisteredTypeError) Error() string { return `type `+e.t.String()+` is not registered, see Registry.RegisterType` }
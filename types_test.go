@@ -0,0 +1,128 @@
+package sus
+
+import(
+	`time`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+type shape interface{
+	Version
+	Area() float64
+}
+
+type circle struct{
+	Version	int
+	Radius	float64
+}
+
+func (c *circle) GetVersion() int {
+	return c.Version
+}
+
+func (c *circle) IncrementVersion() {
+	c.Version++
+}
+
+func (c *circle) DecrementVersion() {
+	c.Version--
+}
+
+func (c *circle) Area() float64 {
+	return 3 * c.Radius * c.Radius
+}
+
+type square struct{
+	Version	int
+	Side	float64
+}
+
+func (s *square) GetVersion() int {
+	return s.Version
+}
+
+func (s *square) IncrementVersion() {
+	s.Version++
+}
+
+func (s *square) DecrementVersion() {
+	s.Version--
+}
+
+func (s *square) Area() float64 {
+	return s.Side * s.Side
+}
+
+func circleVersionFactory() Version {
+	return &circle{}
+}
+
+func newShapeRegistry() *Registry {
+	reg := NewRegistry()
+	reg.RegisterType(`circle`, circleVersionFactory)
+	reg.RegisterType(`square`, func() Version { return &square{} })
+	return reg
+}
+
+func Test_ByteStore_reads_registered_types(t *testing.T){
+	reg := newShapeRegistry()
+	s := NewMemoryStoreWithOptions(NewTypedMarshaler(reg, `json`), JsonUnmarshaler, newFooIdFactory(), circleVersionFactory, fooEntityInitializer, ByteStoreOptions{reg})
+	ids, vs, _ := s.CreateMulti(2)
+	vs[0].(*circle).Radius = 1
+	updateErr := s.UpdateMulti(ids, []Version{vs[0], &square{Side: 2}})
+
+	read, readErr := s.ReadMulti(ids)
+	report, _ := Verify(s, false)
+
+	assert.Nil(t, updateErr, `updateErr should be nil`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []Version{&circle{1, 1}, &square{1, 2}}, read, `each entity should be read back as its own type`)
+	assert.Equal(t, float64(3), read[0].(shape).Area(), `the circle should be usable as a shape`)
+	assert.Equal(t, float64(4), read[1].(shape).Area(), `the square should be usable as a shape`)
+	assert.True(t, report.OK(), `verify should decode each entity as its own type`)
+}
+
+func Test_NewTypedMarshaler(t *testing.T){
+	reg := newShapeRegistry()
+	reg.RegisterMigrations(`square`, false, func(payload []byte, dst Version) error { return nil })
+	m := NewTypedMarshaler(reg, `gob`)
+
+	d, err := m(&square{Version: 3, Side: 1})
+	e, _ := DecodeEnvelope(d)
+	_, unregisteredErr := m(&foo{})
+	_, otherRegistryErr := NewTypedMarshaler(NewRegistry(), `gob`)(&square{})
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, `gob`, e.Codec, `the codec should be recorded`)
+	assert.Equal(t, `square`, e.Schema, `the type's schema should be recorded`)
+	assert.Equal(t, uint64(1), e.SchemaVersion, `the current schema version should be recorded`)
+	assert.Equal(t, 3, e.Version, `the entity version should be recorded`)
+	assert.Equal(t, `type *sus.foo is not registered, see Registry.RegisterType`, unregisteredErr.Error(), `unregisteredErr should contain expected msg`)
+	assert.Equal(t, `type *sus.square is not registered, see Registry.RegisterType`, otherRegistryErr.Error(), `types should only be registered in their own registry`)
+}
+
+func Test_Migrate_registered_types(t *testing.T){
+	reg := newShapeRegistry()
+	reg.RegisterMigrations(`square`, false, func(payload []byte, dst Version) error {
+		dst.(*square).Side *= 2
+		return nil
+	})
+	get, put, del := memoryByteFuncs()
+	m := NewTypedMarshaler(reg, `json`)
+	put(`circle`, []byte(`{"Version":1,"Radius":1}`))
+	created := time.Unix(1, 0).UTC()
+	put(`square`, EncodeEnvelope(&Envelope{`json`, `square`, 0, 2, created, created, []byte(`{"Version":2,"Side":1}`)}))
+
+	count, err := Migrate(reg, []string{`circle`, `square`}, get, put, m, JsonUnmarshaler, circleVersionFactory, isLocalEntityDoesNotExistError, func(tran Transaction) error { return tran() })
+	stored, _ := get(`square`)
+	e, _ := DecodeEnvelope(stored)
+	s := NewByteStoreWithOptions(get, put, del, m, JsonUnmarshaler, newFooIdFactory(), circleVersionFactory, fooEntityInitializer, isLocalEntityDoesNotExistError, mutexRunInTransaction(), ByteStoreOptions{reg})
+	vs, readErr := s.ReadMulti([]string{`circle`, `square`})
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, count, `both records should have been rewritten`)
+	assert.Equal(t, `square`, e.Schema, `the square should keep its own schema`)
+	assert.Equal(t, uint64(1), e.SchemaVersion, `the square should be at the current schema version`)
+	assert.Nil(t, readErr, `readErr should be nil`)
+	assert.Equal(t, []Version{&circle{1, 1}, &square{2, 2}}, vs, `each entity should have been migrated as its own type`)
+}
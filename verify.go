@@ -0,0 +1,198 @@
+package sus
+
+import(
+	`os`
+	`sort`
+	`strings`
+	`path/filepath`
+	`encoding/json`
+)
+
+// The kinds of problem Verify reports.
+const(
+	// The record failed its checksum or its envelope can not be parsed.
+	CorruptRecord		= `corrupt`
+	// The record could not be decoded into an entity.
+	UndecodableRecord	= `undecodable`
+	// The entity has a negative version.
+	InvalidVersion		= `invalid_version`
+	// The entity's version differs from the one recorded in its envelope.
+	VersionMismatch		= `version_mismatch`
+	// A file store temp file left behind by a write that never finished.
+	OrphanTempFile		= `orphan_temp_file`
+	// A file in a file store's entity directories that the store did not write.
+	UnknownFile			= `unknown_file`
+)
+
+// The outcome of checking a store with Verify.
+type VerifyReport struct{
+	// How many entity records were checked.
+	Checked		int					`json:"checked"`
+	Problems	[]*VerifyProblem	`json:"problems"`
+}
+
+// A problem found by Verify.
+type VerifyProblem struct{
+	Kind		string	`json:"kind"`
+	// The id of the entity the problem is with, if known.
+	Id			string	`json:"id,omitempty"`
+	// The file the problem is with, for file stores.
+	Path		string	`json:"path,omitempty"`
+	Detail		string	`json:"detail,omitempty"`
+	// Whether Verify fixed the problem, corrupt files are fixed by quarantining them and orphan temp files by
+	// deleting them.
+	Repaired	bool	`json:"repaired"`
+}
+
+// Whether no problems were found, or all of them were repaired.
+func (r *VerifyReport) OK() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the report as indented json.
+func (r *VerifyReport) Json() ([]byte, error) {
+	return json.MarshalIndent(r, ``, `	`)
+}
+
+// Checks every entity record in s, which must be a memory or file store, decodes with the store's Unmarshaler and
+// VersionFactory into an entity with a sane version, and that file store records pass their checksums and that no
+// temp files have been left behind. When repair is true the problems that can be are fixed, see VerifyProblem. The
+// store is locked against writes while it is checked.
+func Verify(s Store, repair bool) (*VerifyReport, error) {
+	v, ok := s.(verifier)
+	if !ok {
+		return nil, &notVerifiableError{}
+	}
+	return v.verify(repair)
+}
+
+// Runs Verify over the file store in storeDir opened with opts, without needing the rest of the store's configuration.
+// Without repair the store's lock is only taken if its lock file already exists, so a check never creates one, stores
+// create it with their first transaction so until then there is no writer to wait for. File systems whose locks are not
+// files, such as NewMemoryFileSystem, are checked without the lock unless repairing.
+func VerifyFileStore(storeDir string, fileExt string, un Unmarshaler, vf VersionFactory, opts FileStoreOptions, repair bool) (*VerifyReport, error) {
+	if !repair {
+		if _, err := opts.fileSystem().ReadFile(filepath.Join(storeDir, fileLockName)); os.IsNotExist(err) {
+			return verifyFileStore(storeDir, fileExt, un, vf, opts, func(tran Transaction) error { return tran() }, repair)
+		}
+	}
+	rit, closeLock := fileStoreRunInTransaction(storeDir, opts)
+	defer closeLock()
+	return verifyFileStore(storeDir, fileExt, un, vf, opts, rit, repair)
+}
+
+type verifier interface{
+	verify(repair bool) (*VerifyReport, error)
+}
+
+// A store with a way to verify its records.
+type verifiableStore struct{
+	Store
+	verifyFn	func(repair bool) (*VerifyReport, error)
+}
+
+func (s *verifiableStore) verify(repair bool) (*VerifyReport, error) {
+	return s.verifyFn(repair)
+}
+
+// Runs fn as an interactive transaction on the wrapped store, failing if it does not support them.
+func (s *verifiableStore) Transact(fn func(tx Tx) error) error {
+	return transactOn(s.Store, fn)
+}
+
+func verifyMemoryStore(data map[string][]byte, un Unmarshaler, vf VersionFactory, r *Registry, rit RunInTransaction) (*VerifyReport, error) {
+	report := &VerifyReport{Problems: []*VerifyProblem{}}
+	err := rit(func() error {
+		ids := make([]string, 0, len(data))
+		for id := range data {
+			if !isReservedId(id) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			report.Checked++
+			if p := checkRecord(id, data[id], un, vf, r); p != nil {
+				report.Problems = append(report.Problems, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func verifyFileStore(storeDir string, fileExt string, un Unmarshaler, vf VersionFactory, opts FileStoreOptions, rit RunInTransaction, repair bool) (*VerifyReport, error) {
+	fs := opts.fileSystem()
+	report := &VerifyReport{Problems: []*VerifyProblem{}}
+	err := rit(func() error {
+		return walkFileStore(fs, storeDir, `.`+fileExt, opts, opts.FanOutLevels, func(path string, id string) error {
+			if id == `` {
+				p := &VerifyProblem{Kind: UnknownFile, Path: path}
+				if strings.HasPrefix(filepath.Base(path), fileTempPrefix) {
+					// writes happen under the lock verify is holding so no temp file can still be in use.
+					p.Kind = OrphanTempFile
+					p.Repaired = repair && fs.Remove(path) == nil
+				}
+				report.Problems = append(report.Problems, p)
+				return nil
+			}
+			report.Checked++
+			d, err := fs.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var p *VerifyProblem
+			if d, err = verifyChecksum(id, d); err != nil {
+				p = &VerifyProblem{Kind: CorruptRecord, Id: id, Detail: err.Error()}
+			} else {
+				p = checkRecord(id, d, un, vf, opts.Registry)
+			}
+			if p != nil {
+				p.Path = path
+				if p.Kind == CorruptRecord && repair {
+					p.Repaired = quarantineFile(fs, storeDir, path) == nil
+				}
+				report.Problems = append(report.Problems, p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Returns the problem with the record d of the entity with id, if it has one.
+func checkRecord(id string, d []byte, un Unmarshaler, vf VersionFactory, r *Registry) *VerifyProblem {
+	var e *Envelope
+	if IsEnvelope(d) {
+		var err error
+		if e, err = DecodeEnvelope(d); err != nil {
+			return &VerifyProblem{Kind: CorruptRecord, Id: id, Detail: err.Error()}
+		}
+	}
+	v := newRecordVersion(r, vf, d)
+	if err := unmarshalRecord(r, un, d, v); err != nil {
+		return &VerifyProblem{Kind: UndecodableRecord, Id: id, Detail: err.Error()}
+	}
+	if v.GetVersion() < 0 {
+		return &VerifyProblem{Kind: InvalidVersion, Id: id, Detail: `version is negative`}
+	}
+	if e != nil && e.Version != v.GetVersion() {
+		return &VerifyProblem{Kind: VersionMismatch, Id: id, Detail: `envelope records a different version`}
+	}
+	return nil
+}
+
+type notVerifiableError struct{}
+
+func (e *notVerifiableError) Error() string { return `store does not support verification` }
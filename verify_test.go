@@ -0,0 +1,107 @@
+package sus
+
+import(
+	`encoding/json`
+	`testing`
+	`github.com/stretchr/testify/assert`
+)
+
+func Test_Verify_memory_store(t *testing.T){
+	s := NewJsonMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer)
+	ids, fs, _ := s.CreateMulti(2)
+	fs[1].DecrementVersion()
+	s.(*verifiableStore).Store.(*store).putMulti([]string{ids[1]}, []Version{fs[1]})
+
+	report, err := Verify(s, true)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 2, report.Checked, `both entities should have been checked`)
+	assert.Equal(t, []*VerifyProblem{{Kind: InvalidVersion, Id: ids[1], Detail: `version is negative`}}, report.Problems, `the negative version should be reported`)
+	assert.False(t, report.OK(), `the report should not be OK`)
+}
+
+func Test_Verify_file_store(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs, FanOutLevels: 1}
+	s, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	ids, _, _ := s.CreateMulti(4)
+	path := func(id string) string {
+		return fanOutFileName(`store`, id, `json`, 1)
+	}
+	d, _ := mfs.ReadFile(path(ids[0]))
+	d[len(d)-2] = '9'
+	mfs.WriteFile(path(ids[0]), d, 0600)
+	_, put := NewChecksummedByteFuncs(nil, func(id string, d []byte) error { return mfs.WriteFile(path(id), d, 0600) })
+	put(ids[1], []byte(`not json`))
+	envelope := EncodeEnvelope(&Envelope{Codec: `json`, Version: 3, Payload: []byte(`{"version":0}`)})
+	put(ids[2], envelope)
+	orphan := `store/` + fileTempPrefix + `orphan.json`
+	mfs.WriteFile(orphan, nil, 0600)
+	mfs.WriteFile(`store/stray.txt`, nil, 0600)
+
+	report, err := Verify(s, false)
+	repaired, repairErr := VerifyFileStore(`store`, `json`, JsonUnmarshaler, fooVersionFactory, opts, true)
+	again, _ := VerifyFileStore(`store`, `json`, JsonUnmarshaler, fooVersionFactory, opts, false)
+	quarantined, _ := mfs.ReadDir(`store/` + fileQuarantineDir)
+	_, orphanErr := mfs.ReadFile(orphan)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 4, report.Checked, `every entity should have been checked`)
+	kinds := map[string]string{}
+	for _, p := range report.Problems {
+		kinds[p.Id+p.Path] = p.Kind
+	}
+	assert.Equal(t, map[string]string{
+		ids[0]+path(ids[0]): CorruptRecord,
+		ids[1]+path(ids[1]): UndecodableRecord,
+		ids[2]+path(ids[2]): VersionMismatch,
+		orphan: OrphanTempFile,
+		`store/stray.txt`: UnknownFile,
+	}, kinds, `every problem should be reported`)
+	assert.Nil(t, repairErr, `repairErr should be nil`)
+	assert.Equal(t, 5, len(repaired.Problems), `repairing should find the same problems`)
+	assert.Equal(t, 1, len(quarantined), `the corrupt file should have been quarantined`)
+	assert.NotNil(t, orphanErr, `the orphan temp file should have been removed`)
+	assert.Equal(t, 3, again.Checked, `the quarantined entity should no longer be checked`)
+	assert.Equal(t, 3, len(again.Problems), `only the unrepairable problems should remain`)
+}
+
+func Test_Verify_file_store_skips_reserved_ids(t *testing.T){
+	mfs := NewMemoryFileSystem()
+	opts := FileStoreOptions{FileSystem: mfs, FanOutLevels: 1}
+	s, _ := NewFileStoreWithOptions(`store`, `json`, JsonMarshaler, JsonUnmarshaler, newFooIdFactory(), fooVersionFactory, fooEntityInitializer, opts)
+	s.Create()
+	_, put, _, _ := fileByteFuncs(`store`, `json`, opts)
+	for _, id := range []string{`.2pc`, `.2pc.tx`, `.lease.a`} {
+		put(id, []byte(`not json`))
+	}
+
+	report, err := VerifyFileStore(`store`, `json`, JsonUnmarshaler, fooVersionFactory, opts, true)
+	_, twoPhaseErr := mfs.ReadFile(fanOutFileName(`store`, `.2pc`, `json`, 1))
+	ids, _ := ListFileStoreIds(`store`, `json`, opts)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.Equal(t, 1, report.Checked, `only the entity should have been checked`)
+	assert.True(t, report.OK(), `reserved records should not be reported`)
+	assert.Nil(t, twoPhaseErr, `reserved records should not be repaired`)
+	assert.Equal(t, 1, len(ids), `reserved ids should not be listed`)
+}
+
+func Test_VerifyReport_Json(t *testing.T){
+	report := &VerifyReport{Checked: 1, Problems: []*VerifyProblem{{Kind: OrphanTempFile, Path: `p`, Repaired: true}}}
+
+	d, err := report.Json()
+	parsed := map[string]interface{}{}
+	json.Unmarshal(d, &parsed)
+
+	assert.Nil(t, err, `err should be nil`)
+	assert.True(t, report.OK(), `repaired problems should not stop the report being OK`)
+	assert.Equal(t, float64(1), parsed[`checked`], `checked should be in the json`)
+	assert.Equal(t, `orphan_temp_file`, parsed[`problems`].([]interface{})[0].(map[string]interface{})[`kind`], `the problem kind should be in the json`)
+}
+
+func Test_Verify_unsupported_store(t *testing.T){
+	_, err := Verify(NewJsonMVCCMemoryStore(newFooIdFactory(), fooVersionFactory, fooEntityInitializer), false)
+
+	assert.Equal(t, `store does not support verification`, err.Error(), `err should contain expected msg`)
+}